@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// accountError explains why a user may not use their account, or returns
+// nil when they may.
+func accountError(user User, now time.Time) error {
+	if !accountRestricted(user, now) {
+		return nil
+	}
+	if user.Status == UserBanned {
+		return errors.New("this account has been banned")
+	}
+	return fmt.Errorf("this account is suspended until %s", user.SuspendedUntil.Format(time.RFC3339))
+}
+
+// checkAccount is accountError for a user ID from a token. A user that no
+// longer exists is left for the handler to report.
+func checkAccount(userID int) error {
+	chirpdb, err := NewDB("database.json")
+	if err != nil {
+		return err
+	}
+	user, err := chirpdb.GetUser(userID)
+	if err != nil {
+		return nil
+	}
+	return accountError(user, time.Now())
+}
+
+// respondWithRestricted turns away a suspended or banned user at login,
+// handing them an appeal token instead of an access token, along with the
+// action to appeal.
+func respondWithRestricted(w http.ResponseWriter, user User, actionID int) {
+	type returnVals struct {
+		Error          string     `json:"error"`
+		Status         string     `json:"status"`
+		SuspendedUntil *time.Time `json:"suspended_until,omitempty"`
+		ActionID       int        `json:"action_id,omitempty"`
+		AppealToken    string     `json:"appeal_token"`
+	}
+
+	appealToken, err := signToken(user.ID, appealTokenIssuer)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't produce token")
+		return
+	}
+	respondWithJSON(w, 403, returnVals{
+		Error:          accountError(user, time.Now()).Error(),
+		Status:         user.Status,
+		SuspendedUntil: user.SuspendedUntil,
+		ActionID:       actionID,
+		AppealToken:    appealToken,
+	})
+}
+
+// accountStatus is how a user's Status reads in the admin API.
+func accountStatus(user User) string {
+	if user.Status == UserActive || (user.Status == UserSuspended && !accountRestricted(user, time.Now())) {
+		return "active"
+	}
+	return user.Status
+}
+
+// statusActions maps the statuses an admin can set to the moderator
+// action that sets them.
+var statusActions = map[string]string{
+	"active":         ModReinstate,
+	UserSuspended:    ModSuspend,
+	UserBanned:       ModBan,
+	UserShadowbanned: ModShadowban,
+}
+
+func adminUserHandler(w http.ResponseWriter, r *http.Request) {
+	type returnVals struct {
+		ID             int         `json:"id"`
+		Email          string      `json:"email"`
+		Handle         string      `json:"handle"`
+		IsChirpyRed    bool        `json:"is_chirpy_red"`
+		Status         string      `json:"status"`
+		SuspendedUntil *time.Time  `json:"suspended_until,omitempty"`
+		Actions        []ModAction `json:"actions"`
+	}
+
+	validity, adminID := requireAdmin(w, r)
+	if !validity {
+		return
+	}
+
+	pathVal := r.PathValue("id")
+	userID, err := strconv.Atoi(pathVal)
+	if err != nil {
+		respondWithError(w, 400, fmt.Sprintf("Cannot convert %s to integer", pathVal))
+		return
+	}
+
+	chirpdb, err := NewDB("database.json")
+	if err != nil {
+		fmt.Println(err)
+	}
+
+	if r.Method == "POST" {
+		type parameters struct {
+			Status        string     `json:"status"`
+			Note          string     `json:"note"`
+			DurationHours int        `json:"duration_hours"`
+			Until         *time.Time `json:"until"`
+		}
+		params := parameters{}
+		decoder := json.NewDecoder(r.Body)
+		err = decoder.Decode(&params)
+		if err != nil {
+			respondWithError(w, 400, fmt.Sprintf("Error decoding parameters: %s", err))
+			return
+		}
+		action, ok := statusActions[params.Status]
+		if !ok {
+			respondWithError(w, 400, "status must be active, suspended, banned or shadowbanned")
+			return
+		}
+		if userID == adminID {
+			respondWithError(w, 400, "You can't change your own status")
+			return
+		}
+		taken, err := chirpdb.TakeModAction(modActionParams{
+			Action:        action,
+			TargetType:    ReportTargetUser,
+			TargetID:      userID,
+			Note:          params.Note,
+			DurationHours: params.DurationHours,
+			Until:         params.Until,
+		}.modAction(adminID))
+		if errors.Is(err, errUserNotFound) {
+			respondWithError(w, 404, "User does not exist")
+			return
+		} else if err != nil {
+			respondWithError(w, 400, fmt.Sprintf("Couldn't change status: %s", err))
+			return
+		}
+		recordModAction(r, taken)
+	}
+
+	user, err := chirpdb.GetUser(userID)
+	if err != nil {
+		respondWithError(w, 404, "User does not exist")
+		return
+	}
+	actions, err := chirpdb.GetModActions(userID)
+	if err != nil {
+		respondWithError(w, 500, fmt.Sprintf("Couldn't load actions: %s", err))
+		return
+	}
+	retVals := returnVals{
+		ID:          user.ID,
+		Email:       user.Email,
+		Handle:      user.Handle,
+		IsChirpyRed: user.IsChirpyRed,
+		Status:      accountStatus(user),
+		Actions:     actions,
+	}
+	if retVals.Status == UserSuspended {
+		retVals.SuspendedUntil = user.SuspendedUntil
+	}
+	respondWithJSON(w, http.StatusOK, retVals)
+}
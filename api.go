@@ -2,19 +2,19 @@ package main
 
 import (
 	"crypto/rand"
+	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/joho/godotenv"
 	"golang.org/x/crypto/bcrypt"
 	"net/http"
 	"os"
-	"slices"
 	"strconv"
 	"strings"
 	"time"
-	"sort"
 )
 
 type MyCustomClaims struct {
@@ -53,10 +53,16 @@ func (cfg *apiConfig) handlerMetrics(w http.ResponseWriter, r *http.Request) {
 
 func chirpHandler(w http.ResponseWriter, r *http.Request) {
 	type returnVals struct {
-		ID       int    `json:"id"`
-		Error    string `json:"error"`
-		Body     string `json:"body"`
-		AuthorID int    `json:"author_id"`
+		ID        int    `json:"id"`
+		Error     string `json:"error"`
+		Body      string `json:"body"`
+		AuthorID  int    `json:"author_id"`
+		InReplyTo int    `json:"in_reply_to,omitempty"`
+		Kind      string `json:"kind,omitempty"`
+		RefID     int    `json:"ref_id,omitempty"`
+		RefChirp  *Chirp `json:"ref_chirp,omitempty"`
+		MediaIDs  []int  `json:"media_ids,omitempty"`
+		Poll      *Poll  `json:"poll,omitempty"`
 	}
 
 	chirpdb, err := NewDB("database.json")
@@ -65,11 +71,7 @@ func chirpHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	fmt.Printf("loaded db %s\n", chirpdb.path)
 
-	type parameters struct {
-		Body string `json:"body"`
-	}
-
-	params := parameters{}
+	params := chirpParams{}
 
 	respBody := returnVals{}
 
@@ -81,7 +83,6 @@ func chirpHandler(w http.ResponseWriter, r *http.Request) {
 			w.WriteHeader(500)
 			return
 		}
-		w.WriteHeader(201)
 		// log in the user here
 
 		validity, userID := IsJWTValid(w, r)
@@ -91,79 +92,155 @@ func chirpHandler(w http.ResponseWriter, r *http.Request) {
 			fmt.Printf("Got valid JWT for %v\n", userID)
 		}
 
-		chirp, err := chirpdb.CreateChirp(params.Body, userID)
+		user, err := chirpdb.GetUser(userID)
+		if err != nil {
+			respondWithError(w, 401, fmt.Sprintf("Couldn't get user from token: %s", err))
+			return
+		}
+		newChirp, err := params.chirp(user)
+		if err != nil {
+			respondWithError(w, 400, err.Error())
+			return
+		}
+
+		chirp, err := chirpdb.CreateChirp(newChirp)
+		if errors.Is(err, errBlocked) {
+			respondWithError(w, 403, err.Error())
+			return
+		} else if err != nil {
+			respondWithError(w, 400, fmt.Sprintf("Couldn't create chirp: %s", err))
+			return
+		}
+		params.Body = chirp.Body
 		respBody.ID = chirp.ID
 		respBody.AuthorID = chirp.AuthorID
-		fmt.Printf("Added chirp: %s, err %s\n", chirp.Body, err)
-	} else if r.Method == "GET" {
-		sortOrder := r.URL.Query().Get("sort")
-		authorID := r.URL.Query().Get("author_id")
-		if authorID == "" {
-			chirps, err := chirpdb.GetChirps()
-			if err != nil {
-				fmt.Printf("Error getting chirps: %s", err)
-			}
-			fmt.Println(chirps)
-			if sortOrder == "desc" {
-			    sort.Slice(chirps, func(i, j int) bool {
-				return chirps[i].ID> chirps[j].ID
-			    })
-
-			    respondWithJSON(w, http.StatusOK, chirps)
-			} else {
-			    sort.Slice(chirps, func(i, j int) bool {
-				return chirps[i].ID< chirps[j].ID
-			    })
-			    respondWithJSON(w, http.StatusOK, chirps)
-			}
-			return
-		} else {
-			aID, err := strconv.Atoi(authorID)
-			if err != nil {
-				erro := fmt.Sprintf("bad authorID provided: %s", err)
-				respondWithError(w, 500, erro)
-				return
-			}
-			_, err = chirpdb.GetUser(aID)
-			if err != nil {
-				erro := fmt.Sprintf("could not find user %s", err)
-				respondWithError(w, 500, erro)
-				return
-			}
-			chirps, err:=chirpdb.GetChirpsByAuthor(aID)
-			if err != nil {
-			    erro := fmt.Sprintf("could not get chirps for %v: %s", aID, err)
-				respondWithError(w, 500, erro)
-			}
-			if sortOrder == "desc" {
-			    sort.Slice(chirps, func(i, j int) bool {
-				return chirps[i].ID> chirps[j].ID
-			    })
-
-			    respondWithJSON(w, http.StatusOK, chirps)
-			} else {
-			    sort.Slice(chirps, func(i, j int) bool {
-				return chirps[i].ID< chirps[j].ID
-			    })
-			    respondWithJSON(w, http.StatusOK, chirps)
+		respBody.InReplyTo = chirp.InReplyTo
+		respBody.Kind = chirp.Kind
+		respBody.RefID = chirp.RefID
+		respBody.MediaIDs = chirp.MediaIDs
+		if chirp.RefID != 0 {
+			respBody.RefChirp = embedReferenceFor(chirpdb, chirp, userID)
+		}
+		if chirp.Poll != nil {
+			viewed, err := chirpdb.ViewChirp(chirp.ID, userID)
+			if err == nil {
+				respBody.Poll = viewed.Poll
 			}
-			return
 		}
+		fmt.Printf("Added chirp: %s\n", chirp.Body)
+	} else if r.Method == "GET" {
+		listChirps(w, r, chirpdb)
+		return
 	} else {
 		fmt.Printf("Method %s not allowed\n", r.Method)
 		return
 	}
 
-	if len(params.Body) > 140 {
-		respBody.Error = "Chirp is too long"
-		respondWithError(w, 400, "Chirp is too long")
-		return
-	}
 	respBody.Body = cleanupBadWords(params.Body)
 
-	respondWithJSON(w, http.StatusOK, respBody)
+	respondWithJSON(w, 201, respBody)
 }
 
+// listChirps serves GET /api/chirps. Without limit or cursor it returns
+// every matching chirp as a plain array, as it always has; with either of
+// them it returns a page plus the cursor for the next one.
+func listChirps(w http.ResponseWriter, r *http.Request, chirpdb *DB) {
+	type returnVals struct {
+		Chirps     []Chirp `json:"chirps"`
+		NextCursor string  `json:"next_cursor,omitempty"`
+	}
+
+	query := r.URL.Query()
+	q := ChirpQuery{
+		ViewerID: optionalUserID(r),
+		Desc:     query.Get("sort") == "desc",
+		// mutes apply to the feed but not to one author's chirps
+		HideMuted: !query.Has("author_id"),
+	}
+	paginated := query.Has("limit") || query.Has("cursor")
+
+	var err error
+	if paginated {
+		q.Limit, err = parseLimit(query.Get("limit"))
+		if err != nil {
+			respondWithError(w, 400, err.Error())
+			return
+		}
+		q.Cursor, err = decodeCursor(query.Get("cursor"))
+		if err != nil {
+			respondWithError(w, 400, err.Error())
+			return
+		}
+	}
+	for _, name := range []string{"since_id", "max_id"} {
+		val := query.Get(name)
+		if val == "" {
+			continue
+		}
+		id, err := strconv.Atoi(val)
+		if err != nil {
+			respondWithError(w, 400, fmt.Sprintf("bad %s provided: %s", name, val))
+			return
+		}
+		if name == "since_id" {
+			q.SinceID = id
+		} else {
+			q.MaxID = id
+		}
+	}
+	for _, name := range []string{"since", "until"} {
+		val := query.Get(name)
+		if val == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, val)
+		if err != nil {
+			respondWithError(w, 400, fmt.Sprintf("bad %s provided, want RFC 3339: %s", name, val))
+			return
+		}
+		if name == "since" {
+			q.Since = t
+		} else {
+			q.Until = t
+		}
+	}
+
+	authorID := query.Get("author_id")
+	if authorID != "" {
+		aID, err := strconv.Atoi(authorID)
+		if err != nil {
+			respondWithError(w, 400, fmt.Sprintf("bad authorID provided: %s", err))
+			return
+		}
+		_, err = chirpdb.GetUser(aID)
+		if err != nil {
+			respondWithError(w, 404, fmt.Sprintf("could not find user %s", err))
+			return
+		}
+		q.AuthorIDs = []int{aID}
+	}
+
+	chirps, next, err := chirpdb.QueryChirps(q)
+	if err != nil {
+		respondWithError(w, 500, fmt.Sprintf("Error getting chirps: %s", err))
+		return
+	}
+	for i := range chirps {
+		chirps[i].Body = cleanupBadWords(chirps[i].Body)
+	}
+	if !paginated {
+		respondWithJSON(w, http.StatusOK, chirps)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, returnVals{
+		Chirps:     chirps,
+		NextCursor: encodeCursor(next),
+	})
+}
+
+// getChirpByID responds with the whole chirp, as GET /api/chirps does. It
+// used to answer with only id and body; those keep their names, and
+// author_id, created_at, updated_at and edited sit alongside them.
 func getChirpByID(w http.ResponseWriter, r *http.Request) {
 
 	pathVal := r.PathValue("id")
@@ -177,7 +254,7 @@ func getChirpByID(w http.ResponseWriter, r *http.Request) {
 		fmt.Println(err)
 	}
 
-	chirp, err := chirpdb.GetChirp(chirpID)
+	chirp, err := chirpdb.ViewChirp(chirpID, optionalUserID(r))
 	if err != nil {
 		msg := fmt.Sprintf("Chirp does not exist: %s", err)
 		respondWithError(w, 404, msg)
@@ -185,12 +262,8 @@ func getChirpByID(w http.ResponseWriter, r *http.Request) {
 	}
 
 	fmt.Printf("Getting chirp %v\n", chirpID)
-	retVals := returnVals{
-		ID:   chirpID,
-		Body: chirp.Body,
-	}
-
-	respondWithJSON(w, http.StatusOK, retVals)
+	chirp.Body = cleanupBadWords(chirp.Body)
+	respondWithJSON(w, http.StatusOK, chirp)
 }
 
 func deleteChirp(w http.ResponseWriter, r *http.Request) {
@@ -220,7 +293,12 @@ func deleteChirp(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if chirp.AuthorID == userID {
-		chirpdb.DeleteChirp(chirpID)
+		err = chirpdb.DeleteChirp(chirpID)
+		if err != nil {
+			respondWithError(w, 500, fmt.Sprintf("Couldn't delete chirp: %s", err))
+			return
+		}
+		recordAudit(r, AuditEntry{Event: AuditChirpDelete, ActorID: userID, TargetType: ReportTargetChirp, TargetID: chirpID})
 	} else {
 		respondWithError(w, 403, "You're only allowed to delete your own chirps")
 		return
@@ -240,6 +318,7 @@ func userHandler(w http.ResponseWriter, r *http.Request) {
 	type parameters struct {
 		Email    string `json:"email"`
 		Password string `json:"password"`
+		Handle   string `json:"handle"`
 	}
 
 	params := parameters{}
@@ -249,6 +328,7 @@ func userHandler(w http.ResponseWriter, r *http.Request) {
 		Error       string `json:"error"`
 		Email       string `json:"email"`
 		IsChirpyRed bool   `json:"is_chirpy_red"`
+		Handle      string `json:"handle"`
 	}
 	respBody := returnVals{}
 
@@ -260,16 +340,27 @@ func userHandler(w http.ResponseWriter, r *http.Request) {
 			w.WriteHeader(500)
 			return
 		}
-		w.WriteHeader(201)
+		if params.Handle != "" {
+			err = validateHandle(params.Handle)
+			if err != nil {
+				respondWithError(w, 400, err.Error())
+				return
+			}
+		}
 		encryptedPassword, err := bcrypt.GenerateFromPassword([]byte(params.Password), 4)
 		if err != nil {
 			fmt.Printf("Error generating password: %s\n", err)
 			w.WriteHeader(500)
 			return
 		}
-		user, err := chirpdb.CreateUser(params.Email, encryptedPassword)
+		user, err := chirpdb.CreateUser(params.Email, encryptedPassword, params.Handle)
+		if err != nil {
+			respondWithError(w, 400, fmt.Sprintf("couldn't create user: %s", err))
+			return
+		}
 		respBody.ID = user.ID
-		fmt.Printf("Added user: %s, err %s\n", user.Email, err)
+		respBody.Handle = user.Handle
+		fmt.Printf("Added user: %s\n", user.Email)
 
 	} else if r.Method == "GET" {
 
@@ -307,7 +398,7 @@ func userHandler(w http.ResponseWriter, r *http.Request) {
 			fmt.Printf("%s\n", err)
 			respondWithError(w, 401, "Authorization failed: couldn't parse token")
 			return
-		} else if claims, ok := token.Claims.(*MyCustomClaims); ok {
+		} else if claims, ok := token.Claims.(*MyCustomClaims); ok && claims.Issuer == tokenIssuer {
 			fmt.Printf("Got token: %s, %s\n", claims.Issuer, claims.Subject)
 		} else {
 			fmt.Printf("couldn't get token claims:%s, %t\n", err, ok)
@@ -329,21 +420,46 @@ func userHandler(w http.ResponseWriter, r *http.Request) {
 				return
 			}
 			fmt.Printf("Got user! %s %v \n", user.Email, user.ID)
+			if err := accountError(user, time.Now()); err != nil {
+				respondWithError(w, 403, err.Error())
+				return
+			}
 			encryptedPassword, err := bcrypt.GenerateFromPassword([]byte(params.Password), 4)
 			if err != nil {
 				fmt.Printf("Error generating password: %s\n", err)
 				w.WriteHeader(500)
 				return
 			}
-			upUser, err := chirpdb.UpdateUser(userIDI, params.Email, encryptedPassword)
+			if params.Handle != "" {
+				err = validateHandle(params.Handle)
+				if err != nil {
+					respondWithError(w, 400, err.Error())
+					return
+				}
+			}
+			passwordChanged := bcrypt.CompareHashAndPassword(user.Password, []byte(params.Password)) != nil
+			upUser, err := chirpdb.UpdateUser(userIDI, params.Email, encryptedPassword, params.Handle)
 			if err != nil {
 				erro := fmt.Sprintf("couldn't update user: %s", err)
-				respondWithError(w, 500, erro)
+				respondWithError(w, 400, erro)
 				return
 			}
+			if upUser.Email != user.Email {
+				recordAudit(r, AuditEntry{
+					Event:      AuditEmailChange,
+					ActorID:    user.ID,
+					TargetType: ReportTargetUser,
+					TargetID:   user.ID,
+					Details:    map[string]string{"from": user.Email, "to": upUser.Email},
+				})
+			}
+			if passwordChanged {
+				recordAudit(r, AuditEntry{Event: AuditPasswordChange, ActorID: user.ID, TargetType: ReportTargetUser, TargetID: user.ID})
+			}
 			respBody.ID = upUser.ID
 			respBody.Email = upUser.Email
 			respBody.IsChirpyRed = upUser.IsChirpyRed
+			respBody.Handle = upUser.Handle
 			respondWithJSON(w, http.StatusOK, respBody)
 		}
 		return
@@ -355,40 +471,120 @@ func userHandler(w http.ResponseWriter, r *http.Request) {
 
 	respBody.Email = params.Email
 
-	respondWithJSON(w, http.StatusOK, respBody)
+	respondWithJSON(w, 201, respBody)
 }
 
+// IsJWTValid checks the access token on a request, and that the account
+// it belongs to isn't suspended or banned, writing an error response if
+// not.
 func IsJWTValid(w http.ResponseWriter, r *http.Request) (bool, int) {
+	validity, userID, issuer := parseJWT(w, r)
+	if !validity {
+		return false, 0
+	}
+	if issuer != tokenIssuer {
+		respondWithError(w, 401, "Authorization failed: this token can only be used to appeal")
+		return false, 0
+	}
+	err := checkAccount(userID)
+	if err != nil {
+		respondWithError(w, 403, err.Error())
+		return false, 0
+	}
+	return true, userID
+}
+
+// queryTokenRoutes are opened by browsers with WebSocket and EventSource,
+// which can't set an Authorization header, so they may pass the access
+// token as ?access_token= instead.
+var queryTokenRoutes = map[string]bool{
+	"/api/ws":     true,
+	"/api/stream": true,
+}
+
+// bearerToken returns the token a request was sent with, or "" if none.
+func bearerToken(r *http.Request) string {
+	authHeader := r.Header.Get("Authorization")
+	if authHeader == "" {
+		if r.Method == "GET" && queryTokenRoutes[r.URL.Path] {
+			return r.URL.Query().Get("access_token")
+		}
+		return ""
+	}
+	authTokenS := strings.Split(authHeader, " ")
+	return authTokenS[len(authTokenS)-1]
+}
+
+// parseJWT checks the signature and expiry of the token on a request and
+// returns who it was issued to and by.
+func parseJWT(w http.ResponseWriter, r *http.Request) (bool, int, string) {
 	userID := 0
 	godotenv.Load()
 	jwtSecret := os.Getenv("JWT_SECRET")
 	// authorization header required
-	authHeader := r.Header.Get("Authorization")
-	if authHeader == "" {
+	authToken := bearerToken(r)
+	if authToken == "" {
 		respondWithError(w, 401, "Authorization header required")
-		return false, userID
+		return false, userID, ""
 	}
-	authTokenS := strings.Split(authHeader, " ")
-	authToken := authTokenS[len(authTokenS)-1]
 	token, err := jwt.ParseWithClaims(authToken, &MyCustomClaims{}, func(token *jwt.Token) (interface{}, error) {
 		return []byte(jwtSecret), nil
 	})
 	if err != nil {
 		fmt.Printf("%s\n", err)
 		respondWithError(w, 401, "Authorization failed: couldn't parse token")
-		return false, userID
-	} else if claims, ok := token.Claims.(*MyCustomClaims); ok {
-		userID, err = strconv.Atoi(claims.Subject)
-		if err != nil {
-			fmt.Printf("Error converting %s to int: %s\n", claims.Subject, err)
-		}
-		fmt.Printf("Got token: %s, %s\n", claims.Issuer, claims.Subject)
-	} else {
+		return false, userID, ""
+	}
+	claims, ok := token.Claims.(*MyCustomClaims)
+	if !ok {
 		fmt.Printf("couldn't get token claims:%s, %t\n", err, ok)
 		respondWithError(w, 401, "Authorization failed!")
-		return false, 0
+		return false, 0, ""
 	}
-	return true, userID
+	userID, err = strconv.Atoi(claims.Subject)
+	if err != nil {
+		fmt.Printf("Error converting %s to int: %s\n", claims.Subject, err)
+	}
+	fmt.Printf("Got token: %s, %s\n", claims.Issuer, claims.Subject)
+	return true, userID, claims.Issuer
+}
+
+// optionalUserID returns the user ID from a valid JWT, or 0 when the
+// request is anonymous or the token doesn't check out. Unlike IsJWTValid it
+// never writes a response, so public endpoints can personalise results.
+func optionalUserID(r *http.Request) int {
+	userID := tokenUserID(r)
+	if userID == 0 || checkAccount(userID) != nil {
+		return 0
+	}
+	return userID
+}
+
+// tokenUserID is the user a request's token was issued to, from the signed
+// claims alone. Unlike optionalUserID it doesn't look at the account, so it
+// never touches the database.
+func tokenUserID(r *http.Request) int {
+	authToken := bearerToken(r)
+	if authToken == "" {
+		return 0
+	}
+	godotenv.Load()
+	jwtSecret := os.Getenv("JWT_SECRET")
+	token, err := jwt.ParseWithClaims(authToken, &MyCustomClaims{}, func(token *jwt.Token) (interface{}, error) {
+		return []byte(jwtSecret), nil
+	})
+	if err != nil {
+		return 0
+	}
+	claims, ok := token.Claims.(*MyCustomClaims)
+	if !ok || claims.Issuer != tokenIssuer {
+		return 0
+	}
+	userID, err := strconv.Atoi(claims.Subject)
+	if err != nil {
+		return 0
+	}
+	return userID
 }
 
 func getUserByID(w http.ResponseWriter, r *http.Request) {
@@ -420,13 +616,25 @@ func getUserByID(w http.ResponseWriter, r *http.Request) {
 	respondWithJSON(w, http.StatusOK, retVals)
 }
 
+// Access tokens are issued by "Chirpy". A suspended or banned user who
+// logs in gets an appeal token instead, which only POST and GET
+// /api/appeals accept.
+const (
+	tokenIssuer       = "Chirpy"
+	appealTokenIssuer = "Chirpy-appeal"
+)
+
 func generateToken(userID int) (string, error) {
+	return signToken(userID, tokenIssuer)
+}
+
+func signToken(userID int, issuer string) (string, error) {
 	godotenv.Load()
 	jwtSecret := os.Getenv("JWT_SECRET")
 	claims := MyCustomClaims{
 		"bar",
 		jwt.RegisteredClaims{
-			Issuer:   "Chirpy",
+			Issuer:   issuer,
 			IssuedAt: jwt.NewNumericDate(time.Now()),
 			//ExpiresAt: expire_time,
 			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
@@ -471,6 +679,10 @@ func loginUser(w http.ResponseWriter, r *http.Request) {
 
 	user, err := chirpdb.GetUserByEmail(params.Email)
 	if err != nil {
+		recordAudit(r, AuditEntry{
+			Event:   AuditLoginFailed,
+			Details: map[string]string{"email": params.Email, "reason": "unknown user"},
+		})
 		msg := fmt.Sprintf("User does not exist: %s", err)
 		respondWithError(w, 404, msg)
 		return
@@ -514,9 +726,29 @@ func loginUser(w http.ResponseWriter, r *http.Request) {
 	}
 	err = bcrypt.CompareHashAndPassword(user.Password, []byte(params.Password))
 	if err != nil {
+		recordAudit(r, AuditEntry{
+			Event:      AuditLoginFailed,
+			TargetType: ReportTargetUser,
+			TargetID:   user.ID,
+			Details:    map[string]string{"email": params.Email, "reason": "wrong password"},
+		})
 		respondWithError(w, http.StatusUnauthorized, "Wrong password")
 		return
 	}
+	if accountRestricted(user, time.Now()) {
+		chirpdb.RevokeRefreshToken(user.ID)
+		recordAudit(r, AuditEntry{
+			Event:      AuditLoginFailed,
+			TargetType: ReportTargetUser,
+			TargetID:   user.ID,
+			Details:    map[string]string{"email": params.Email, "reason": "account " + accountStatus(user)},
+		})
+		// an account restricted by hand in the database has no action
+		action, _ := chirpdb.RestrictingAction(user.ID)
+		respondWithRestricted(w, user, action.ID)
+		return
+	}
+	recordAudit(r, AuditEntry{Event: AuditLogin, ActorID: user.ID, TargetType: ReportTargetUser, TargetID: user.ID})
 	respondWithJSON(w, http.StatusOK, retVals)
 }
 
@@ -542,10 +774,22 @@ func refreshToken(w http.ResponseWriter, r *http.Request) {
 
 	user, err := chirpdb.GetUserByRefreshToken(authToken)
 	if err != nil {
+		recordAudit(r, AuditEntry{Event: AuditRefreshFailed, Details: map[string]string{"reason": "unknown token"}})
 		respondWithError(w, 401, fmt.Sprintf("GetUserByRefreshToken err: %s", err))
 		return
 	}
+	if err := accountError(user, time.Now()); err != nil {
+		recordAudit(r, AuditEntry{
+			Event:      AuditRefreshFailed,
+			TargetType: ReportTargetUser,
+			TargetID:   user.ID,
+			Details:    map[string]string{"reason": err.Error()},
+		})
+		respondWithError(w, 403, err.Error())
+		return
+	}
 	token, err := generateToken(user.ID)
+	recordAudit(r, AuditEntry{Event: AuditRefresh, ActorID: user.ID, TargetType: ReportTargetUser, TargetID: user.ID})
 	retVals := returnVals{
 		Token: token,
 	}
@@ -573,6 +817,7 @@ func revokeToken(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	chirpdb.RevokeRefreshToken(user.ID)
+	recordAudit(r, AuditEntry{Event: AuditRevoke, ActorID: user.ID, TargetType: ReportTargetUser, TargetID: user.ID})
 
 	respondWithJSON(w, 204, "")
 }
@@ -612,21 +857,113 @@ func polkaWebhook(w http.ResponseWriter, r *http.Request) {
 			respondWithError(w, 404, fmt.Sprintf("User Not Found %s", err))
 			return
 		}
+		recordAudit(r, AuditEntry{
+			Event:      AuditRedUpgrade,
+			TargetType: ReportTargetUser,
+			TargetID:   params.Data.UserID,
+			Details:    map[string]string{"source": "polka"},
+		})
 	}
 
 	respondWithJSON(w, 204, "")
 }
 
-func cleanupBadWords(s string) string {
-	badWords := []string{"kerfuffle", "sharbert", "fornax"}
-	ss := strings.Split(s, " ")
-	for i, x := range ss {
-		if slices.Contains(badWords, strings.ToLower(x)) {
-			ss[i] = "****"
+// chirpParams is the body of a request to post a chirp, over HTTP or the
+// WebSocket API.
+type chirpParams struct {
+	Body      string `json:"body"`
+	InReplyTo int    `json:"in_reply_to"`
+	RechirpOf int    `json:"rechirp_of"`
+	QuoteOf   int    `json:"quote_of"`
+	MediaIDs  []int  `json:"media_ids"`
+	Poll      *struct {
+		Options         []string `json:"options"`
+		DurationMinutes int      `json:"duration_minutes"`
+		HideResults     bool     `json:"hide_results"`
+	} `json:"poll"`
+}
+
+// chirp validates params and turns them into a chirp by author, ready for
+// CreateChirp.
+func (params chirpParams) chirp(author User) (Chirp, error) {
+	err := validateChirpBody(params.Body, author)
+	if err != nil {
+		return Chirp{}, err
+	}
+
+	newChirp := Chirp{
+		Body:      params.Body,
+		AuthorID:  author.ID,
+		InReplyTo: params.InReplyTo,
+		MediaIDs:  params.MediaIDs,
+	}
+	if params.Poll != nil {
+		duration := time.Duration(params.Poll.DurationMinutes) * time.Minute
+		if duration == 0 {
+			duration = 24 * time.Hour
 		}
+		newChirp.Poll = &Poll{
+			Options:     params.Poll.Options,
+			Duration:    duration,
+			HideResults: params.Poll.HideResults,
+		}
+	}
+	if params.RechirpOf != 0 && params.QuoteOf != 0 {
+		return Chirp{}, errors.New("A chirp can't be both a rechirp and a quote")
+	} else if params.RechirpOf != 0 {
+		newChirp.Kind = ChirpKindRechirp
+		newChirp.RefID = params.RechirpOf
+	} else if params.QuoteOf != 0 {
+		newChirp.Kind = ChirpKindQuote
+		newChirp.RefID = params.QuoteOf
+	}
+	return newChirp, nil
+}
+
+// cleanupBadWords masks filtered words in text on its way out. Chirps are
+// filtered before they are stored, but this also covers text stored before
+// a rule was added.
+func cleanupBadWords(s string) string {
+	return filter.Mask(s)
+}
+
+const (
+	defaultPageLimit = 20
+	maxPageLimit     = 100
+)
+
+func parseLimit(s string) (int, error) {
+	if s == "" {
+		return defaultPageLimit, nil
+	}
+	limit, err := strconv.Atoi(s)
+	if err != nil || limit < 1 {
+		return 0, fmt.Errorf("bad limit provided: %s", s)
+	}
+	return min(limit, maxPageLimit), nil
+}
+
+// Cursors are opaque to clients; they wrap the ID of the last item returned.
+func encodeCursor(id int) string {
+	if id == 0 {
+		return ""
+	}
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.Itoa(id)))
+}
+
+func decodeCursor(s string) (int, error) {
+	if s == "" {
+		return 0, nil
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return 0, fmt.Errorf("bad cursor provided: %s", s)
+	}
+	id, err := strconv.Atoi(string(raw))
+	if err != nil || id < 1 {
+		return 0, fmt.Errorf("bad cursor provided: %s", s)
 	}
-	rss := strings.Join(ss, " ")
-	return rss
+	return id, nil
 }
 
 func respondWithJSON(w http.ResponseWriter, code int, payload interface{}) {
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestBearerToken(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		target string
+		header string
+		want   string
+	}{
+		{"header", "GET", "/api/chirps", "Bearer abc", "abc"},
+		{"header wins over query", "GET", "/api/ws?access_token=def", "Bearer abc", "abc"},
+		{"websocket query", "GET", "/api/ws?access_token=def", "", "def"},
+		{"event stream query", "GET", "/api/stream?access_token=def", "", "def"},
+		{"query elsewhere", "GET", "/api/chirps?access_token=def", "", ""},
+		{"query on a post", "POST", "/api/stream?access_token=def", "", ""},
+		{"none", "GET", "/api/ws", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, tt.target, nil)
+			if tt.header != "" {
+				r.Header.Set("Authorization", tt.header)
+			}
+			if got := bearerToken(r); got != tt.want {
+				t.Errorf("bearerToken = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/joho/godotenv"
+)
+
+// The audit log is a JSON Lines file that is only ever appended to. Each
+// entry carries the hash of the one before it, and its own hash covers
+// that, so editing or removing any entry breaks the chain from there on.
+
+const (
+	AuditLogin          = "login"
+	AuditLoginFailed    = "login_failed"
+	AuditRefresh        = "token_refresh"
+	AuditRefreshFailed  = "token_refresh_failed"
+	AuditRevoke         = "token_revoke"
+	AuditEmailChange    = "email_change"
+	AuditPasswordChange = "password_change"
+	AuditRedUpgrade     = "red_upgrade"
+	AuditChirpDelete    = "chirp_delete"
+	AuditAdminAction    = "admin_action"
+	AuditModAction      = "mod_action"
+)
+
+type AuditEntry struct {
+	Seq        int               `json:"seq"`
+	At         time.Time         `json:"at"`
+	Event      string            `json:"event"`
+	ActorID    int               `json:"actor_id,omitempty"`
+	TargetType string            `json:"target_type,omitempty"`
+	TargetID   int               `json:"target_id,omitempty"`
+	IP         string            `json:"ip,omitempty"`
+	Details    map[string]string `json:"details,omitempty"`
+	PrevHash   string            `json:"prev_hash"`
+	Hash       string            `json:"hash"`
+}
+
+// hash is computed over the entry as JSON with Hash left empty.
+func (e AuditEntry) hash() string {
+	e.Hash = ""
+	data, _ := json.Marshal(e)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+type auditLog struct {
+	mu       sync.Mutex
+	loaded   bool
+	seq      int
+	lastHash string
+}
+
+var audit = &auditLog{}
+
+func auditPath() string {
+	godotenv.Load()
+	if path := os.Getenv("AUDIT_LOG"); path != "" {
+		return path
+	}
+	return "audit.jsonl"
+}
+
+// readAuditLog returns every entry in the log, oldest first.
+func readAuditLog() ([]AuditEntry, error) {
+	entries := make([]AuditEntry, 0)
+	f, err := os.Open(auditPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return entries, nil
+	} else if err != nil {
+		return entries, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var entry AuditEntry
+		err := json.Unmarshal(scanner.Bytes(), &entry)
+		if err != nil {
+			return entries, fmt.Errorf("line %d: %w", len(entries)+1, err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+// Append chains an entry onto the end of the log and writes it out.
+func (l *auditLog) Append(entry AuditEntry) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.loaded {
+		entries, err := readAuditLog()
+		if err != nil {
+			return err
+		}
+		if len(entries) > 0 {
+			last := entries[len(entries)-1]
+			l.seq, l.lastHash = last.Seq, last.Hash
+		}
+		l.loaded = true
+	}
+
+	entry.Seq = l.seq + 1
+	entry.At = entry.At.UTC()
+	entry.PrevHash = l.lastHash
+	entry.Hash = entry.hash()
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(auditPath(), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(append(line, '\n'))
+	if err != nil {
+		return err
+	}
+	err = f.Sync()
+	if err != nil {
+		return err
+	}
+	l.seq, l.lastHash = entry.Seq, entry.Hash
+	return nil
+}
+
+// recordAudit logs an event caused by a request. A failure to write it is
+// reported but doesn't fail the request.
+func recordAudit(r *http.Request, entry AuditEntry) {
+	entry.At = time.Now()
+	entry.IP = clientIP(r)
+	err := audit.Append(entry)
+	if err != nil {
+		fmt.Printf("Couldn't write audit log: %s\n", err)
+	}
+}
+
+// recordModAction logs a moderator action against the chirp or user it
+// was taken on. auditAdmin only sees the request, which for POST
+// /admin/actions names neither.
+func recordModAction(r *http.Request, action ModAction) {
+	details := map[string]string{
+		"action":    action.Action,
+		"action_id": strconv.Itoa(action.ID),
+		"user_id":   strconv.Itoa(action.UserID),
+	}
+	if action.ReportID != 0 {
+		details["report_id"] = strconv.Itoa(action.ReportID)
+	}
+	recordAudit(r, AuditEntry{
+		Event:      AuditModAction,
+		ActorID:    action.ModeratorID,
+		TargetType: action.TargetType,
+		TargetID:   action.TargetID,
+		Details:    details,
+	})
+}
+
+// auditAdmin records every admin request that changes something, with the
+// route it hit and the status it got back.
+func auditAdmin(sm *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" || !strings.HasPrefix(r.URL.Path, "/admin/") {
+			sm.ServeHTTP(w, r)
+			return
+		}
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		sm.ServeHTTP(rec, r)
+		_, pattern := sm.Handler(r)
+		entry := AuditEntry{
+			Event:   AuditAdminAction,
+			ActorID: optionalUserID(r),
+			Details: map[string]string{
+				"route":  pattern,
+				"path":   r.URL.Path,
+				"status": strconv.Itoa(rec.status),
+			},
+		}
+		// the target is named by the path segment before {id}, so
+		// /admin/users/{id}/status targets a user
+		if id, err := strconv.Atoi(r.PathValue("id")); err == nil {
+			segments := strings.Split(pattern, "/")
+			if i := slices.Index(segments, "{id}"); i > 0 {
+				entry.TargetType = strings.TrimSuffix(segments[i-1], "s")
+			}
+			entry.TargetID = id
+		}
+		recordAudit(r, entry)
+	})
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	rec.status = status
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+// AuditFilter selects audit entries. Zero values match everything.
+type AuditFilter struct {
+	Event      string
+	ActorID    int
+	TargetType string
+	TargetID   int
+	IP         string
+	Since      time.Time
+	Until      time.Time
+}
+
+func (f AuditFilter) matches(entry AuditEntry) bool {
+	return (f.Event == "" || entry.Event == f.Event) &&
+		(f.ActorID == 0 || entry.ActorID == f.ActorID) &&
+		(f.TargetType == "" || entry.TargetType == f.TargetType) &&
+		(f.TargetID == 0 || entry.TargetID == f.TargetID) &&
+		(f.IP == "" || entry.IP == f.IP) &&
+		(f.Since.IsZero() || !entry.At.Before(f.Since)) &&
+		(f.Until.IsZero() || entry.At.Before(f.Until))
+}
+
+// verifyAuditLog walks the chain and returns the sequence number of the
+// first entry that doesn't check out, or 0 when all of them do.
+func verifyAuditLog(entries []AuditEntry) (int, string) {
+	prev := ""
+	for i, entry := range entries {
+		switch {
+		case entry.Seq != i+1:
+			return i + 1, fmt.Sprintf("expected entry %d, found %d", i+1, entry.Seq)
+		case entry.PrevHash != prev:
+			return entry.Seq, "does not follow the entry before it"
+		case entry.hash() != entry.Hash:
+			return entry.Seq, "has been altered"
+		}
+		prev = entry.Hash
+	}
+	return 0, ""
+}
+
+func auditHandler(w http.ResponseWriter, r *http.Request) {
+	type returnVals struct {
+		Entries    []AuditEntry `json:"entries"`
+		NextCursor string       `json:"next_cursor,omitempty"`
+	}
+
+	validity, _ := requireAdmin(w, r)
+	if !validity {
+		return
+	}
+
+	query := r.URL.Query()
+	limit, err := parseLimit(query.Get("limit"))
+	if err != nil {
+		respondWithError(w, 400, err.Error())
+		return
+	}
+	before, err := decodeCursor(query.Get("cursor"))
+	if err != nil {
+		respondWithError(w, 400, err.Error())
+		return
+	}
+	f := AuditFilter{
+		Event:      query.Get("event"),
+		TargetType: query.Get("target_type"),
+		IP:         query.Get("ip"),
+	}
+	for _, name := range []string{"actor_id", "target_id"} {
+		val := query.Get(name)
+		if val == "" {
+			continue
+		}
+		id, err := strconv.Atoi(val)
+		if err != nil {
+			respondWithError(w, 400, fmt.Sprintf("bad %s provided: %s", name, val))
+			return
+		}
+		if name == "actor_id" {
+			f.ActorID = id
+		} else {
+			f.TargetID = id
+		}
+	}
+	for _, name := range []string{"since", "until"} {
+		val := query.Get(name)
+		if val == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, val)
+		if err != nil {
+			respondWithError(w, 400, fmt.Sprintf("bad %s provided, want RFC 3339: %s", name, val))
+			return
+		}
+		if name == "since" {
+			f.Since = t
+		} else {
+			f.Until = t
+		}
+	}
+
+	entries, err := readAuditLog()
+	if err != nil {
+		respondWithError(w, 500, fmt.Sprintf("Couldn't read audit log: %s", err))
+		return
+	}
+	slices.Reverse(entries)
+	retVals := returnVals{Entries: make([]AuditEntry, 0, limit)}
+	for _, entry := range entries {
+		if (before > 0 && entry.Seq >= before) || !f.matches(entry) {
+			continue
+		}
+		if len(retVals.Entries) == limit {
+			retVals.NextCursor = encodeCursor(retVals.Entries[limit-1].Seq)
+			break
+		}
+		retVals.Entries = append(retVals.Entries, entry)
+	}
+	respondWithJSON(w, http.StatusOK, retVals)
+}
+
+func auditVerifyHandler(w http.ResponseWriter, r *http.Request) {
+	type returnVals struct {
+		Valid    bool   `json:"valid"`
+		Entries  int    `json:"entries"`
+		FirstBad int    `json:"first_bad,omitempty"`
+		Error    string `json:"error,omitempty"`
+		LastHash string `json:"last_hash,omitempty"`
+	}
+
+	validity, _ := requireAdmin(w, r)
+	if !validity {
+		return
+	}
+
+	entries, err := readAuditLog()
+	if err != nil {
+		respondWithJSON(w, http.StatusOK, returnVals{Entries: len(entries), Error: err.Error()})
+		return
+	}
+	firstBad, reason := verifyAuditLog(entries)
+	retVals := returnVals{
+		Valid:    firstBad == 0,
+		Entries:  len(entries),
+		FirstBad: firstBad,
+		Error:    reason,
+	}
+	if len(entries) > 0 {
+		retVals.LastHash = entries[len(entries)-1].Hash
+	}
+	respondWithJSON(w, http.StatusOK, retVals)
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testAuditLog points the audit log at a fresh file for one test.
+func testAuditLog(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	t.Setenv("AUDIT_LOG", path)
+	old := audit
+	audit = &auditLog{}
+	t.Cleanup(func() { audit = old })
+	return path
+}
+
+func appendAudit(t *testing.T, events ...string) {
+	t.Helper()
+	for i, event := range events {
+		err := audit.Append(AuditEntry{Event: event, ActorID: i + 1, At: time.Now()})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestAuditChain(t *testing.T) {
+	testAuditLog(t)
+	appendAudit(t, AuditLogin, AuditRefresh, AuditRevoke)
+	entries, err := readAuditLog()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("got %d entries, want 3", len(entries))
+	}
+	if entries[0].PrevHash != "" || entries[1].PrevHash != entries[0].Hash || entries[2].PrevHash != entries[1].Hash {
+		t.Error("entries aren't chained by hash")
+	}
+	if bad, reason := verifyAuditLog(entries); bad != 0 {
+		t.Errorf("verifyAuditLog = %d (%s), want a valid chain", bad, reason)
+	}
+
+	// a new writer picks the chain up from the file
+	audit = &auditLog{}
+	appendAudit(t, AuditLogin)
+	entries, _ = readAuditLog()
+	if got := entries[3]; got.Seq != 4 || got.PrevHash != entries[2].Hash {
+		t.Errorf("entry after reopening has seq %d and prev %q", got.Seq, got.PrevHash)
+	}
+}
+
+func TestAuditTamper(t *testing.T) {
+	tests := []struct {
+		name    string
+		tamper  func(lines []string) []string
+		wantBad int
+	}{
+		{"untouched", func(lines []string) []string { return lines }, 0},
+		{"edited entry", func(lines []string) []string {
+			lines[1] = strings.Replace(lines[1], `"token_refresh"`, `"token_revoke"`, 1)
+			return lines
+		}, 2},
+		{"edited and rehashed", func(lines []string) []string {
+			entries, _ := readAuditLog()
+			entry := entries[1]
+			entry.ActorID = 99
+			entry.Hash = entry.hash()
+			line, _ := json.Marshal(entry)
+			lines[1] = string(line)
+			return lines
+		}, 3},
+		{"removed entry", func(lines []string) []string {
+			return append(lines[:1], lines[2:]...)
+		}, 2},
+		// the chain alone can't show entries cut off the end; that is what
+		// the last_hash from /admin/audit/verify is for
+		{"truncated", func(lines []string) []string { return lines[:2] }, 0},
+		{"reordered", func(lines []string) []string {
+			lines[1], lines[2] = lines[2], lines[1]
+			return lines
+		}, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := testAuditLog(t)
+			appendAudit(t, AuditLogin, AuditRefresh, AuditRevoke, AuditLogin)
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			lines := tt.tamper(strings.Split(strings.TrimSpace(string(data)), "\n"))
+			os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0600)
+
+			entries, err := readAuditLog()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bad, reason := verifyAuditLog(entries); bad != tt.wantBad {
+				t.Errorf("verifyAuditLog = %d (%s), want %d", bad, reason, tt.wantBad)
+			}
+		})
+	}
+}
+
+func TestAuditFilter(t *testing.T) {
+	at := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	entry := AuditEntry{Event: AuditLogin, ActorID: 3, TargetType: "user", TargetID: 3, IP: "10.0.0.1", At: at}
+	tests := []struct {
+		name   string
+		filter AuditFilter
+		want   bool
+	}{
+		{"empty", AuditFilter{}, true},
+		{"event", AuditFilter{Event: AuditLogin}, true},
+		{"other event", AuditFilter{Event: AuditLoginFailed}, false},
+		{"actor", AuditFilter{ActorID: 3}, true},
+		{"other actor", AuditFilter{ActorID: 4}, false},
+		{"target", AuditFilter{TargetType: "user", TargetID: 3}, true},
+		{"other target type", AuditFilter{TargetType: "chirp"}, false},
+		{"ip", AuditFilter{IP: "10.0.0.2"}, false},
+		{"since", AuditFilter{Since: at}, true},
+		{"until is exclusive", AuditFilter{Until: at}, false},
+		{"window", AuditFilter{Since: at.Add(-time.Hour), Until: at.Add(time.Hour)}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.filter.matches(entry); got != tt.want {
+				t.Errorf("matches = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
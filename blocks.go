@@ -0,0 +1,426 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// A block hides two users from each other completely and stops them
+// replying to, quoting, mentioning, following or messaging one another.
+// A mute is one-sided and softer: the muted account's chirps, and chirps
+// matching a muted word, are left out of the muting user's feeds (the
+// chirp list, timelines and search) but can still be read on purpose, on
+// the author's page or in a thread.
+
+const maxMutedWordLen = 50
+
+var errBlocked = errors.New("you can't interact with this user")
+
+type MutedWord struct {
+	ID        int        `json:"id"`
+	Phrase    string     `json:"phrase"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+func (m MutedWord) active(now time.Time) bool {
+	return m.ExpiresAt == nil || now.Before(*m.ExpiresAt)
+}
+
+// blocked reports whether either user has blocked the other.
+func blocked(dbs DBStructure, a, b int) bool {
+	return hasEdge(dbs.Blocks, a, b) || hasEdge(dbs.Blocks, b, a)
+}
+
+// muted reports whether viewerID has muted the author of a chirp or a word
+// in it.
+func muted(dbs DBStructure, chirp Chirp, viewerID int, now time.Time) bool {
+	if viewerID == 0 || chirp.AuthorID == viewerID {
+		return false
+	}
+	if hasEdge(dbs.Mutes, viewerID, chirp.AuthorID) {
+		return true
+	}
+	var terms []string
+	for _, word := range dbs.MutedWords[viewerID] {
+		if !word.active(now) {
+			continue
+		}
+		if terms == nil {
+			terms = tokenize(chirp.Body)
+		}
+		if containsPhrase(terms, tokenize(word.Phrase)) {
+			return true
+		}
+	}
+	return false
+}
+
+// containsPhrase reports whether phrase appears as consecutive terms.
+func containsPhrase(terms, phrase []string) bool {
+	if len(phrase) == 0 {
+		return false
+	}
+	for i := 0; i+len(phrase) <= len(terms); i++ {
+		if slices.Equal(terms[i:i+len(phrase)], phrase) {
+			return true
+		}
+	}
+	return false
+}
+
+// BlockUser blocks blockedID for blockerID and drops any follows between
+// them, in both directions.
+func (db *DB) BlockUser(blockerID, blockedID int) error {
+	if blockerID == blockedID {
+		return errors.New("users cannot block themselves")
+	}
+	var unfollowed [][2]int
+	err := db.update(func(structure *DBStructure) error {
+		if _, ok := structure.Users[blockedID]; !ok {
+			return errNotFound
+		}
+		unfollowed = nil
+		for _, pair := range [][2]int{{blockerID, blockedID}, {blockedID, blockerID}} {
+			if hasEdge(structure.Following, pair[0], pair[1]) {
+				removeEdge(structure.Following, pair[0], pair[1])
+				removeEdge(structure.Followers, pair[1], pair[0])
+				unfollowed = append(unfollowed, pair)
+			}
+		}
+		addEdge(structure.Blocks, blockerID, blockedID)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("User %v blocked %v\n", blockerID, blockedID)
+	for _, pair := range unfollowed {
+		bus.Publish(Event{Type: EventUserUnfollowed, ActorID: pair[0], UserID: pair[1]})
+	}
+	bus.Publish(Event{Type: EventUserBlocked, ActorID: blockerID, UserID: blockedID})
+	return nil
+}
+
+func (db *DB) UnblockUser(blockerID, blockedID int) error {
+	err := db.update(func(structure *DBStructure) error {
+		removeEdge(structure.Blocks, blockerID, blockedID)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("User %v unblocked %v\n", blockerID, blockedID)
+	bus.Publish(Event{Type: EventUserUnblocked, ActorID: blockerID, UserID: blockedID})
+	return nil
+}
+
+func (db *DB) MuteUser(userID, mutedID int) error {
+	if userID == mutedID {
+		return errors.New("users cannot mute themselves")
+	}
+	err := db.update(func(structure *DBStructure) error {
+		if _, ok := structure.Users[mutedID]; !ok {
+			return errNotFound
+		}
+		addEdge(structure.Mutes, userID, mutedID)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	bus.Publish(Event{Type: EventUserMuted, ActorID: userID, UserID: mutedID})
+	return nil
+}
+
+func (db *DB) UnmuteUser(userID, mutedID int) error {
+	err := db.update(func(structure *DBStructure) error {
+		removeEdge(structure.Mutes, userID, mutedID)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	bus.Publish(Event{Type: EventUserUnmuted, ActorID: userID, UserID: mutedID})
+	return nil
+}
+
+func (db *DB) GetBlocked(userID int) ([]User, error) {
+	return db.getUsersByEdge(userID, func(dbs DBStructure) []int { return dbs.Blocks[userID] })
+}
+
+func (db *DB) GetMuted(userID int) ([]User, error) {
+	return db.getUsersByEdge(userID, func(dbs DBStructure) []int { return dbs.Mutes[userID] })
+}
+
+// AddMutedWord mutes a word or phrase for userID, forever when expiresAt
+// is nil.
+func (db *DB) AddMutedWord(userID int, phrase string, expiresAt *time.Time) (MutedWord, error) {
+	phrase = strings.TrimSpace(phrase)
+	if len(tokenize(phrase)) == 0 {
+		return MutedWord{}, errors.New("a muted phrase needs at least one word")
+	}
+	if utf8.RuneCountInString(phrase) > maxMutedWordLen {
+		return MutedWord{}, fmt.Errorf("muted phrases can be at most %d characters", maxMutedWordLen)
+	}
+	word := MutedWord{Phrase: phrase, ExpiresAt: expiresAt, CreatedAt: time.Now().UTC()}
+	err := db.update(func(structure *DBStructure) error {
+		words := slices.DeleteFunc(structure.MutedWords[userID], func(m MutedWord) bool {
+			return !m.active(word.CreatedAt)
+		})
+		for _, other := range words {
+			if slices.Equal(tokenize(other.Phrase), tokenize(phrase)) {
+				return errors.New("that phrase is already muted")
+			}
+		}
+		structure.LastMutedWordID++
+		word.ID = structure.LastMutedWordID
+		structure.MutedWords[userID] = append(words, word)
+		return nil
+	})
+	return word, err
+}
+
+// GetMutedWords returns the phrases userID has muted that haven't expired.
+func (db *DB) GetMutedWords(userID int) ([]MutedWord, error) {
+	words := make([]MutedWord, 0)
+	dbs, err := db.loadDB()
+	if err != nil {
+		return words, err
+	}
+	now := time.Now()
+	for _, word := range dbs.MutedWords[userID] {
+		if word.active(now) {
+			words = append(words, word)
+		}
+	}
+	return words, nil
+}
+
+func (db *DB) DeleteMutedWord(userID, id int) error {
+	return db.update(func(structure *DBStructure) error {
+		words := structure.MutedWords[userID]
+		i := slices.IndexFunc(words, func(m MutedWord) bool { return m.ID == id })
+		if i < 0 {
+			return errNotFound
+		}
+		words = slices.Delete(words, i, i+1)
+		if len(words) == 0 {
+			delete(structure.MutedWords, userID)
+		} else {
+			structure.MutedWords[userID] = words
+		}
+		return nil
+	})
+}
+
+// relations is what a live connection needs to know about who its user
+// has blocked or muted. The hubs keep it current from the event bus.
+type relations struct {
+	blocking  map[int]bool
+	blockedBy map[int]bool
+	muting    map[int]bool
+}
+
+func (db *DB) GetRelations(userID int) (relations, error) {
+	rel := relations{
+		blocking:  make(map[int]bool),
+		blockedBy: make(map[int]bool),
+		muting:    make(map[int]bool),
+	}
+	dbs, err := db.loadDB()
+	if err != nil {
+		return rel, err
+	}
+	for _, id := range dbs.Blocks[userID] {
+		rel.blocking[id] = true
+	}
+	for id, blockedIDs := range dbs.Blocks {
+		if _, found := slices.BinarySearch(blockedIDs, userID); found {
+			rel.blockedBy[id] = true
+		}
+	}
+	for _, id := range dbs.Mutes[userID] {
+		rel.muting[id] = true
+	}
+	return rel, nil
+}
+
+// observe updates the relations of userID from a block or mute event.
+func (rel relations) observe(userID int, event Event) {
+	switch {
+	case event.ActorID == userID && (event.Type == EventUserBlocked || event.Type == EventUserUnblocked):
+		rel.blocking[event.UserID] = event.Type == EventUserBlocked
+	case event.UserID == userID && (event.Type == EventUserBlocked || event.Type == EventUserUnblocked):
+		rel.blockedBy[event.ActorID] = event.Type == EventUserBlocked
+	case event.ActorID == userID && (event.Type == EventUserMuted || event.Type == EventUserUnmuted):
+		rel.muting[event.UserID] = event.Type == EventUserMuted
+	}
+}
+
+func (rel relations) blocks(authorID int) bool {
+	return rel.blocking[authorID] || rel.blockedBy[authorID]
+}
+
+func (rel relations) hides(authorID int) bool {
+	return rel.blocks(authorID) || rel.muting[authorID]
+}
+
+func blockHandler(w http.ResponseWriter, r *http.Request) {
+	validity, userID := IsJWTValid(w, r)
+	if !validity {
+		return
+	}
+
+	pathVal := r.PathValue("id")
+	targetID, err := strconv.Atoi(pathVal)
+	if err != nil {
+		respondWithError(w, 400, fmt.Sprintf("Cannot convert %s to integer", pathVal))
+		return
+	}
+	if targetID == userID {
+		respondWithError(w, 400, "You can't block or mute yourself")
+		return
+	}
+
+	chirpdb, err := NewDB("database.json")
+	if err != nil {
+		fmt.Println(err)
+	}
+
+	mute := strings.HasSuffix(r.URL.Path, "/mute")
+	switch {
+	case r.Method == "POST" && mute:
+		err = chirpdb.MuteUser(userID, targetID)
+	case r.Method == "POST":
+		err = chirpdb.BlockUser(userID, targetID)
+	case mute:
+		err = chirpdb.UnmuteUser(userID, targetID)
+	default:
+		err = chirpdb.UnblockUser(userID, targetID)
+	}
+	if err != nil {
+		respondWithError(w, 404, fmt.Sprintf("User does not exist: %s", err))
+		return
+	}
+	respondWithJSON(w, 204, "")
+}
+
+func blockListHandler(w http.ResponseWriter, r *http.Request) {
+	type returnVals struct {
+		Count int              `json:"count"`
+		Users []followUserVals `json:"users"`
+	}
+
+	validity, userID := IsJWTValid(w, r)
+	if !validity {
+		return
+	}
+
+	chirpdb, err := NewDB("database.json")
+	if err != nil {
+		fmt.Println(err)
+	}
+
+	var users []User
+	if r.URL.Path == "/api/mutes" {
+		users, err = chirpdb.GetMuted(userID)
+	} else {
+		users, err = chirpdb.GetBlocked(userID)
+	}
+	if err != nil {
+		respondWithError(w, 500, fmt.Sprintf("Couldn't load users: %s", err))
+		return
+	}
+
+	retVals := returnVals{
+		Count: len(users),
+		Users: make([]followUserVals, 0, len(users)),
+	}
+	for _, user := range users {
+		retVals.Users = append(retVals.Users, followUserVals{ID: user.ID, Handle: user.Handle})
+	}
+	respondWithJSON(w, http.StatusOK, retVals)
+}
+
+func mutedWordsHandler(w http.ResponseWriter, r *http.Request) {
+	validity, userID := IsJWTValid(w, r)
+	if !validity {
+		return
+	}
+
+	chirpdb, err := NewDB("database.json")
+	if err != nil {
+		fmt.Println(err)
+	}
+
+	if r.Method == "GET" {
+		words, err := chirpdb.GetMutedWords(userID)
+		if err != nil {
+			respondWithError(w, 500, fmt.Sprintf("Couldn't load muted words: %s", err))
+			return
+		}
+		respondWithJSON(w, http.StatusOK, words)
+		return
+	}
+
+	type parameters struct {
+		Phrase        string `json:"phrase"`
+		DurationHours int    `json:"duration_hours"`
+	}
+	params := parameters{}
+	decoder := json.NewDecoder(r.Body)
+	err = decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, 400, fmt.Sprintf("Error decoding parameters: %s", err))
+		return
+	}
+	if params.DurationHours < 0 {
+		respondWithError(w, 400, "duration_hours can't be negative")
+		return
+	}
+	var expiresAt *time.Time
+	if params.DurationHours > 0 {
+		t := time.Now().UTC().Add(time.Duration(params.DurationHours) * time.Hour)
+		expiresAt = &t
+	}
+	word, err := chirpdb.AddMutedWord(userID, params.Phrase, expiresAt)
+	if err != nil {
+		respondWithError(w, 400, fmt.Sprintf("Couldn't mute phrase: %s", err))
+		return
+	}
+	respondWithJSON(w, 201, word)
+}
+
+func deleteMutedWordHandler(w http.ResponseWriter, r *http.Request) {
+	validity, userID := IsJWTValid(w, r)
+	if !validity {
+		return
+	}
+
+	pathVal := r.PathValue("id")
+	wordID, err := strconv.Atoi(pathVal)
+	if err != nil {
+		respondWithError(w, 400, fmt.Sprintf("Cannot convert %s to integer", pathVal))
+		return
+	}
+
+	chirpdb, err := NewDB("database.json")
+	if err != nil {
+		fmt.Println(err)
+	}
+
+	err = chirpdb.DeleteMutedWord(userID, wordID)
+	if err != nil {
+		respondWithError(w, 404, "Muted phrase does not exist")
+		return
+	}
+	respondWithJSON(w, 204, "")
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// Bookmarks are private to the user who makes them. They are kept as a
+// sorted list of chirp IDs per user; IDs of deleted chirps are left in
+// place and skipped on the way out, since chirp IDs are never reused.
+
+func (db *DB) AddBookmark(userID, chirpID int) error {
+	return db.update(func(structure *DBStructure) error {
+		chirp, ok := structure.Chirps[chirpID]
+		if !ok {
+			return errNotFound
+		}
+		err := canInteract(*structure, chirp, userID)
+		if err != nil {
+			return err
+		}
+		addEdge(structure.Bookmarks, userID, chirpID)
+		return nil
+	})
+}
+
+func (db *DB) RemoveBookmark(userID, chirpID int) error {
+	return db.update(func(structure *DBStructure) error {
+		removeEdge(structure.Bookmarks, userID, chirpID)
+		return nil
+	})
+}
+
+// GetBookmarks returns the chirps userID has bookmarked, newest chirp
+// first, paginated like the home timeline.
+func (db *DB) GetBookmarks(userID, before, limit int) ([]Chirp, int, error) {
+	dbs, err := db.loadDB()
+	if err != nil {
+		return make([]Chirp, 0), 0, err
+	}
+	chirps, next := pageChirpIDs(dbs, dbs.Bookmarks[userID], userID, before, limit)
+	return chirps, next, nil
+}
+
+func bookmarkHandler(w http.ResponseWriter, r *http.Request) {
+	validity, userID := IsJWTValid(w, r)
+	if !validity {
+		return
+	}
+
+	pathVal := r.PathValue("id")
+	chirpID, err := strconv.Atoi(pathVal)
+	if err != nil {
+		respondWithError(w, 400, fmt.Sprintf("Cannot convert %s to integer", pathVal))
+		return
+	}
+
+	chirpdb, err := NewDB("database.json")
+	if err != nil {
+		fmt.Println(err)
+	}
+
+	if r.Method == "POST" {
+		err = chirpdb.AddBookmark(userID, chirpID)
+		if errors.Is(err, errBlocked) {
+			respondWithError(w, 403, err.Error())
+			return
+		} else if err != nil {
+			respondWithError(w, 404, fmt.Sprintf("Chirp does not exist: %s", err))
+			return
+		}
+	} else {
+		err = chirpdb.RemoveBookmark(userID, chirpID)
+		if err != nil {
+			respondWithError(w, 500, fmt.Sprintf("Couldn't remove bookmark: %s", err))
+			return
+		}
+	}
+
+	respondWithJSON(w, 204, "")
+}
+
+func bookmarksHandler(w http.ResponseWriter, r *http.Request) {
+	validity, userID := IsJWTValid(w, r)
+	if !validity {
+		return
+	}
+	respondWithChirpPage(w, r, func(db *DB, viewerID, before, limit int) ([]Chirp, int, error) {
+		return db.GetBookmarks(userID, before, limit)
+	})
+}
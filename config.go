@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/joho/godotenv"
+)
+
+// envDuration reads a Go duration such as "15m" from the environment,
+// falling back to def when it is unset or malformed.
+func envDuration(name string, def time.Duration) time.Duration {
+	godotenv.Load()
+	val := os.Getenv(name)
+	if val == "" {
+		return def
+	}
+	d, err := time.ParseDuration(val)
+	if err != nil {
+		fmt.Printf("Bad duration for %s: %s\n", name, err)
+		return def
+	}
+	return d
+}
+
+// envInt reads an integer from the environment, falling back to def when it
+// is unset or malformed.
+func envInt(name string, def int) int {
+	godotenv.Load()
+	val := os.Getenv(name)
+	if val == "" {
+		return def
+	}
+	n, err := strconv.Atoi(val)
+	if err != nil {
+		fmt.Printf("Bad integer for %s: %s\n", name, err)
+		return def
+	}
+	return n
+}
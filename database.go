@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"slices"
 	"sync"
 	"time"
 )
@@ -20,30 +21,168 @@ type User struct {
 	Password     []byte       `json:"password"`
 	RefreshToken RefreshToken `json:"refresh_token"`
 	IsChirpyRed  bool         `json:"is_chirpy_red"`
+	Handle       string       `json:"handle"`
+	Settings     UserSettings `json:"settings"`
+	CreatedAt    time.Time    `json:"created_at"`
+	// Status is empty for active accounts; see accountRestricted.
+	Status         string     `json:"status,omitempty"`
+	SuspendedUntil *time.Time `json:"suspended_until,omitempty"`
 }
 type Chirp struct {
-	ID       int    `json:"id"`
-	Body     string `json:"body"`
-	AuthorID int    `json:"author_id"`
+	ID        int       `json:"id"`
+	Body      string    `json:"body"`
+	AuthorID  int       `json:"author_id"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	Edited    bool      `json:"edited"`
+
+	InReplyTo  int  `json:"in_reply_to,omitempty"`
+	ReplyCount int  `json:"reply_count"`
+	Deleted    bool `json:"deleted,omitempty"`
+
+	Reactions map[string]int `json:"reactions,omitempty"`
+	// ReactedByMe is filled in for the authenticated viewer on the way out
+	// and is never stored.
+	ReactedByMe []string `json:"reacted_by_me,omitempty"`
+
+	Kind         string `json:"kind,omitempty"`
+	RefID        int    `json:"ref_id,omitempty"`
+	RechirpCount int    `json:"rechirp_count"`
+	QuoteCount   int    `json:"quote_count"`
+	// RefChirp embeds the chirp RefID points at; like ReactedByMe it is
+	// only filled in on the way out.
+	RefChirp *Chirp `json:"ref_chirp,omitempty"`
+
+	Entities []Entity `json:"entities,omitempty"`
+
+	MediaIDs []int `json:"media_ids,omitempty"`
+	// Media describes the attachments in MediaIDs on the way out.
+	Media []Media `json:"media,omitempty"`
+
+	Poll *Poll `json:"poll,omitempty"`
+
+	// Bookmarked is only filled in for the authenticated viewer.
+	Bookmarked bool `json:"bookmarked,omitempty"`
+
+	// Hidden chirps were taken down by a moderator; only their author still
+	// sees them.
+	Hidden bool `json:"hidden,omitempty"`
+}
+
+// ChirpQuery selects a page of chirps. Zero values mean "no filter".
+type ChirpQuery struct {
+	ViewerID  int   // the authenticated user, or 0
+	AuthorIDs []int // sorted
+	SinceID   int   // only chirps with an ID above this
+	MaxID     int   // only chirps with an ID at or below this
+	Since     time.Time
+	Until     time.Time
+	Desc      bool
+	Cursor    int // ID of the last chirp on the previous page
+	Limit     int // 0 returns every match
+	// HideMuted leaves out chirps the viewer has muted, for feeds.
+	HideMuted bool
 }
 
+// errNotFound is returned when whatever was asked for doesn't exist.
+// Handlers check for it with errors.Is to answer 404, so more specific
+// errors wrap it.
+var errNotFound = errors.New("not found")
+
+var (
+	errUserNotFound  = fmt.Errorf("user %w", errNotFound)
+	errChirpNotFound = fmt.Errorf("chirp %w", errNotFound)
+)
+
 type DB struct {
 	path string
 	mux  *sync.RWMutex
 }
 
 type DBStructure struct {
-	Chirps map[int]Chirp `json:"chirps"`
-	Users  map[int]User  `json:"users"`
+	Chirps       map[int]Chirp            `json:"chirps"`
+	Users        map[int]User             `json:"users"`
+	Following    map[int][]int            `json:"following"`
+	Followers    map[int][]int            `json:"followers"`
+	ChirpHistory map[int][]ChirpRevision  `json:"chirp_history"`
+	Replies      map[int][]int            `json:"replies"`
+	Reactions    map[int]map[string][]int `json:"reactions"`
+	Likes        map[int][]int            `json:"likes"`
+	References   map[int][]int            `json:"references"`
+	Handles      map[string]int           `json:"handles"`
+	Hashtags     map[string][]int         `json:"hashtags"`
+	Mentions     map[int][]int            `json:"mentions"`
+	AuthorChirps map[int][]int            `json:"author_chirps"`
+	SearchIndex  map[string]map[int][]int `json:"search_index"`
+	Media        map[int]Media            `json:"media"`
+	MediaChirps  map[int][]int            `json:"media_chirps"`
+	Drafts       map[int]Draft            `json:"drafts"`
+	PollVotes    map[int]map[int]int      `json:"poll_votes"`
+	Bookmarks    map[int][]int            `json:"bookmarks"`
+	Lists        map[int]List             `json:"lists"`
+	ListMembers  map[int][]int            `json:"list_members"`
+
+	Conversations        map[int]Conversation `json:"conversations"`
+	UserConversations    map[int][]int        `json:"user_conversations"`
+	Messages             map[int]Message      `json:"messages"`
+	ConversationMessages map[int][]int        `json:"conversation_messages"`
+
+	Notifications      map[int]Notification `json:"notifications"`
+	UserNotifications  map[int][]int        `json:"user_notifications"`
+	LastNotificationID int                  `json:"last_notification_id"`
+
+	FilterRules   map[int]FilterRule `json:"filter_rules"`
+	FilterSeeded  bool               `json:"filter_seeded"`
+	FlaggedChirps map[int][]int      `json:"flagged_chirps"`
+
+	Reports    map[int]Report    `json:"reports"`
+	ModActions map[int]ModAction `json:"mod_actions"`
+	Appeals    map[int]Appeal    `json:"appeals"`
+
+	Blocks          map[int][]int       `json:"blocks"`
+	Mutes           map[int][]int       `json:"mutes"`
+	MutedWords      map[int][]MutedWord `json:"muted_words"`
+	LastMutedWordID int                 `json:"last_muted_word_id"`
+
+	ContentHashes  map[string][]int    `json:"content_hashes"`
+	SpamVerdicts   map[int]SpamVerdict `json:"spam_verdicts"`
+	SpamRejections []SpamVerdict       `json:"spam_rejections"`
+
+	LastChirpID int `json:"last_chirp_id"`
 }
 
+var (
+	openDBs   = make(map[string]*DB)
+	openDBsMu sync.Mutex
+)
+
+// NewDB returns the database stored at path. Every caller asking for the
+// same path shares one DB, and with it one lock, so concurrent requests
+// can't overwrite each other's changes.
 func NewDB(path string) (*DB, error) {
+	openDBsMu.Lock()
+	defer openDBsMu.Unlock()
+	if db, ok := openDBs[path]; ok {
+		return db, nil
+	}
 	db := DB{
 		path: path,
 		mux:  &sync.RWMutex{},
 	}
 	db.ensureDB()
-	db.loadDB()
+	err := db.rebuildSearchIndex()
+	if err != nil {
+		fmt.Printf("Couldn't build search index: %s\n", err)
+	}
+	err = db.rebuildAuthorChirps()
+	if err != nil {
+		fmt.Printf("Couldn't build author index: %s\n", err)
+	}
+	err = db.backfillHandles()
+	if err != nil {
+		fmt.Printf("Couldn't assign handles: %s\n", err)
+	}
+	openDBs[path] = &db
 	return &db, nil
 }
 
@@ -58,26 +197,87 @@ func (db *DB) ensureDB() error {
 }
 
 func (db *DB) loadDB() (DBStructure, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+	return db.readDB()
+}
+
+// readDB reads the database from disk. Callers must hold db.mux.
+func (db *DB) readDB() (DBStructure, error) {
 	dbStructure := DBStructure{
-		Chirps: make(map[int]Chirp),
-		Users:  make(map[int]User),
+		Chirps:       make(map[int]Chirp),
+		Users:        make(map[int]User),
+		Following:    make(map[int][]int),
+		Followers:    make(map[int][]int),
+		ChirpHistory: make(map[int][]ChirpRevision),
+		Replies:      make(map[int][]int),
+		Reactions:    make(map[int]map[string][]int),
+		Likes:        make(map[int][]int),
+		References:   make(map[int][]int),
+		Handles:      make(map[string]int),
+		Hashtags:     make(map[string][]int),
+		Mentions:     make(map[int][]int),
+		AuthorChirps: make(map[int][]int),
+		SearchIndex:  make(map[string]map[int][]int),
+		Media:        make(map[int]Media),
+		MediaChirps:  make(map[int][]int),
+		Drafts:       make(map[int]Draft),
+		PollVotes:    make(map[int]map[int]int),
+		Bookmarks:    make(map[int][]int),
+		Lists:        make(map[int]List),
+		ListMembers:  make(map[int][]int),
+
+		Conversations:        make(map[int]Conversation),
+		UserConversations:    make(map[int][]int),
+		Messages:             make(map[int]Message),
+		ConversationMessages: make(map[int][]int),
+
+		Notifications:     make(map[int]Notification),
+		UserNotifications: make(map[int][]int),
+
+		FilterRules:   make(map[int]FilterRule),
+		FlaggedChirps: make(map[int][]int),
+
+		Reports:    make(map[int]Report),
+		ModActions: make(map[int]ModAction),
+		Appeals:    make(map[int]Appeal),
+
+		Blocks:     make(map[int][]int),
+		Mutes:      make(map[int][]int),
+		MutedWords: make(map[int][]MutedWord),
+
+		ContentHashes: make(map[string][]int),
+		SpamVerdicts:  make(map[int]SpamVerdict),
 	}
 	txt, err := os.ReadFile(db.path)
-	err = json.Unmarshal(txt, &dbStructure)
-	if err != nil {
-		err = db.writeDB(dbStructure)
+	if err != nil || len(txt) == 0 {
+		// a missing or freshly created database is simply empty
+		return dbStructure, nil
 	}
+	err = json.Unmarshal(txt, &dbStructure)
 	return dbStructure, err
 }
 
 func (db *DB) writeDB(dbstructure DBStructure) error {
 	db.mux.Lock()
 	defer db.mux.Unlock()
+	return db.persistDB(dbstructure)
+}
+
+// persistDB writes the database to a temporary file and renames it into
+// place, so readers never see a half-written file. Callers must hold
+// db.mux for writing.
+func (db *DB) persistDB(dbstructure DBStructure) error {
 	dbdata, err := json.MarshalIndent(dbstructure, "", "  ")
 	if err != nil {
 		return err
 	}
-	err = os.WriteFile(db.path, dbdata, 644)
+	tmpPath := db.path + ".tmp"
+	err = os.WriteFile(tmpPath, dbdata, 0644)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmpPath, db.path)
 	if err != nil {
 		return err
 	}
@@ -86,6 +286,23 @@ func (db *DB) writeDB(dbstructure DBStructure) error {
 	return nil
 }
 
+// update runs fn against the current database and writes the result back,
+// holding the write lock throughout so the read-modify-write is atomic. If
+// fn returns an error nothing is written.
+func (db *DB) update(fn func(structure *DBStructure) error) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+	structure, err := db.readDB()
+	if err != nil {
+		return err
+	}
+	err = fn(&structure)
+	if err != nil {
+		return err
+	}
+	return db.persistDB(structure)
+}
+
 func (db *DB) GetChirps() ([]Chirp, error) {
 	chirps := make([]Chirp, 0)
 	dbs, err := db.loadDB()
@@ -98,6 +315,105 @@ func (db *DB) GetChirps() ([]Chirp, error) {
 
 	return chirps, nil
 }
+
+// QueryChirps walks chirp IDs in the requested order and stops as soon as
+// the page is full, so neither sorting nor filtering has to copy the whole
+// table. The second return value is the cursor for the next page, or 0 when
+// there is none.
+func (db *DB) QueryChirps(q ChirpQuery) ([]Chirp, int, error) {
+	dbs, err := db.loadDB()
+	if err != nil {
+		return make([]Chirp, 0), 0, err
+	}
+	chirps, next := queryChirps(dbs, q)
+	return chirps, next, nil
+}
+
+func queryChirps(dbs DBStructure, q ChirpQuery) ([]Chirp, int) {
+	chirps := make([]Chirp, 0, q.Limit)
+	low, high := q.SinceID+1, maxChirpID(dbs)
+	if q.MaxID > 0 {
+		high = min(high, q.MaxID)
+	}
+	if q.Cursor > 0 {
+		if q.Desc {
+			high = min(high, q.Cursor-1)
+		} else {
+			low = max(low, q.Cursor+1)
+		}
+	}
+	step, id := 1, max(low, 1)
+	if q.Desc {
+		step, id = -1, high
+	}
+	now := time.Now()
+	for ; id >= low && id <= high; id += step {
+		chirp, ok := dbs.Chirps[id]
+		if !ok || chirp.Deleted || !q.matches(chirp) || !canView(dbs, chirp, q.ViewerID) {
+			continue
+		}
+		if q.HideMuted && muted(dbs, chirp, q.ViewerID, now) {
+			continue
+		}
+		if q.Limit > 0 && len(chirps) == q.Limit {
+			return chirps, chirps[len(chirps)-1].ID
+		}
+		chirps = append(chirps, viewChirp(dbs, chirp, q.ViewerID))
+	}
+	return chirps, 0
+}
+
+// pageChirpIDs pages through a sorted list of chirp IDs from an index,
+// newest first, skipping any that have since been deleted or that viewerID
+// can't see.
+func pageChirpIDs(dbs DBStructure, ids []int, viewerID, before, limit int) ([]Chirp, int) {
+	chirps := make([]Chirp, 0, limit)
+	for i := len(ids) - 1; i >= 0; i-- {
+		if before > 0 && ids[i] >= before {
+			continue
+		}
+		chirp, ok := dbs.Chirps[ids[i]]
+		if !ok || chirp.Deleted || !canView(dbs, chirp, viewerID) {
+			continue
+		}
+		if len(chirps) == limit {
+			return chirps, chirps[len(chirps)-1].ID
+		}
+		chirps = append(chirps, viewChirp(dbs, chirp, viewerID))
+	}
+	return chirps, 0
+}
+
+// viewChirp personalises a stored chirp for viewerID, who may be 0 for an
+// anonymous request.
+func viewChirp(dbs DBStructure, chirp Chirp, viewerID int) Chirp {
+	chirp.ReactedByMe = nil
+	chirp.Bookmarked = false
+	if viewerID != 0 {
+		chirp.ReactedByMe = reactedBy(dbs, chirp.ID, viewerID)
+		chirp.Bookmarked = hasEdge(dbs.Bookmarks, viewerID, chirp.ID)
+	}
+	chirp.RefChirp = embedReference(dbs, chirp, viewerID)
+	chirp.Media = chirpMedia(dbs, chirp)
+	chirp.Poll = viewPoll(dbs, chirp, viewerID)
+	return chirp
+}
+
+func (q ChirpQuery) matches(chirp Chirp) bool {
+	if len(q.AuthorIDs) > 0 {
+		if _, found := slices.BinarySearch(q.AuthorIDs, chirp.AuthorID); !found {
+			return false
+		}
+	}
+	if !q.Since.IsZero() && chirp.CreatedAt.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && !chirp.CreatedAt.Before(q.Until) {
+		return false
+	}
+	return true
+}
+
 func (db *DB) GetChirpsByAuthor(authorID int) ([]Chirp, error) {
 	chirps := make([]Chirp, 0)
 	dbs, err := db.loadDB()
@@ -118,42 +434,204 @@ func (db *DB) GetChirp(id int) (Chirp, error) {
 	if err != nil {
 		return Chirp{}, err
 	}
-	emptyChirp := Chirp{}
-	if dbs.Chirps[id] == emptyChirp {
-		return emptyChirp, errors.New("not found")
+	chirp, ok := dbs.Chirps[id]
+	if !ok || chirp.Deleted {
+		return Chirp{}, errNotFound
 	}
-	return dbs.Chirps[id], nil
+	return chirp, nil
 }
 
-func (db *DB) CreateChirp(body string, userID int) (Chirp, error) {
-	chirps, err := db.GetChirps()
+// ViewChirp returns a chirp as viewerID sees it.
+func (db *DB) ViewChirp(id, viewerID int) (Chirp, error) {
+	dbs, err := db.loadDB()
 	if err != nil {
 		return Chirp{}, err
 	}
-	newID := len(chirps) + 1
-	newChirp := Chirp{
-		ID:       newID,
-		Body:     body,
-		AuthorID: userID,
+	chirp, ok := dbs.Chirps[id]
+	if !ok || chirp.Deleted || !canView(dbs, chirp, viewerID) {
+		return Chirp{}, errNotFound
+	}
+	return viewChirp(dbs, chirp, viewerID), nil
+}
+
+// maxChirpID returns the highest chirp ID handed out so far. IDs are never
+// reused, even after the newest chirp is deleted, so it is also the newest.
+func maxChirpID(dbs DBStructure) int {
+	maxID := dbs.LastChirpID
+	for id := range dbs.Chirps {
+		maxID = max(maxID, id)
+	}
+	return maxID
+}
+
+// CreateChirp stores a new chirp from the body, author, reply target, kind
+// and reference of newChirp, assigning its ID and timestamps.
+func (db *DB) CreateChirp(newChirp Chirp) (Chirp, error) {
+	shadow := false
+	err := db.update(func(structure *DBStructure) error {
+		var err error
+		newChirp, err = createChirp(structure, newChirp)
+		shadow = newChirp.Hidden || structure.Users[newChirp.AuthorID].Status == UserShadowbanned
+		return err
+	})
+	if err != nil {
+		db.recordSpamRejection(err)
+		return Chirp{}, err
+	}
+	fmt.Printf("Added chirp id %v: %s\n", newChirp.ID, newChirp.Body)
+	bus.Publish(Event{Type: EventChirpCreated, ActorID: newChirp.AuthorID, Chirp: newChirp, Shadow: shadow})
+	return newChirp, nil
+}
+
+// createChirp does the work of CreateChirp inside an update, so callers
+// that publish chirps as part of a bigger change can share it.
+func createChirp(structure *DBStructure, newChirp Chirp) (Chirp, error) {
+	body, flagged, err := filter.Apply(newChirp.Body)
+	if err != nil {
+		return Chirp{}, err
+	}
+	newChirp.Body = body
+	if newChirp.InReplyTo != 0 {
+		parent, ok := structure.Chirps[newChirp.InReplyTo]
+		if !ok || parent.Deleted {
+			return Chirp{}, errors.New("parent chirp not found")
+		}
+		if blocked(*structure, parent.AuthorID, newChirp.AuthorID) {
+			return Chirp{}, errBlocked
+		}
+	}
+	err = resolveReference(structure, &newChirp)
+	if err != nil {
+		return Chirp{}, err
+	}
+	err = checkChirpMedia(*structure, newChirp)
+	if err != nil {
+		return Chirp{}, err
+	}
+	now := time.Now().UTC()
+	err = checkPoll(&newChirp, now)
+	if err != nil {
+		return Chirp{}, err
+	}
+	verdict := scoreChirp(*structure, newChirp, now)
+	if verdict.Outcome == SpamReject {
+		return Chirp{}, &spamError{verdict}
+	}
+	newID := maxChirpID(*structure) + 1
+	structure.LastChirpID = newID
+	newChirp = Chirp{
+		ID:        newID,
+		Body:      newChirp.Body,
+		AuthorID:  newChirp.AuthorID,
+		CreatedAt: now,
+		UpdatedAt: now,
+		InReplyTo: newChirp.InReplyTo,
+		Kind:      newChirp.Kind,
+		RefID:     newChirp.RefID,
+		Entities:  extractEntities(*structure, newChirp.Body),
+		MediaIDs:  newChirp.MediaIDs,
+		Poll:      newChirp.Poll,
+		Hidden:    verdict.Outcome == SpamHold,
 	}
-	structure, err := db.loadDB()
 	structure.Chirps[newID] = newChirp
-	db.writeDB(structure)
-	fmt.Printf("Added chirp id %v: %s\n", newID, body)
+	if len(flagged) > 0 {
+		flagForReview(structure, newID, flagged)
+	}
+	verdict.ChirpID = newID
+	recordSpamVerdict(structure, verdict)
+	indexChirp(*structure, newChirp)
+	addEdge(structure.AuthorChirps, newChirp.AuthorID, newID)
+	if newChirp.InReplyTo != 0 {
+		addEdge(structure.Replies, newChirp.InReplyTo, newID)
+		parent := structure.Chirps[newChirp.InReplyTo]
+		parent.ReplyCount++
+		structure.Chirps[parent.ID] = parent
+	}
+	addReference(*structure, newChirp)
+	for _, id := range newChirp.MediaIDs {
+		addEdge(structure.MediaChirps, id, newID)
+	}
 	return newChirp, nil
 }
 
+// DeleteChirp removes a chirp. A chirp that still has replies is replaced by
+// a tombstone instead, so the conversation below it stays connected.
 func (db *DB) DeleteChirp(chirpID int) error {
-	structure, err := db.loadDB()
+	var chirp Chirp
+	err := db.update(func(structure *DBStructure) error {
+		var ok bool
+		chirp, ok = structure.Chirps[chirpID]
+		if !ok {
+			return errNotFound
+		}
+		delete(structure.ChirpHistory, chirpID)
+		removeReactions(*structure, chirpID)
+		delete(structure.PollVotes, chirpID)
+		delete(structure.FlaggedChirps, chirpID)
+		delete(structure.SpamVerdicts, chirpID)
+		removeReference(*structure, chirp)
+		unindexChirp(*structure, chirp)
+		removeEdge(structure.AuthorChirps, chirp.AuthorID, chirpID)
+		for _, id := range chirp.MediaIDs {
+			removeEdge(structure.MediaChirps, id, chirpID)
+		}
+		if chirp.ReplyCount > 0 {
+			structure.Chirps[chirpID] = Chirp{
+				ID:         chirp.ID,
+				AuthorID:   chirp.AuthorID,
+				CreatedAt:  chirp.CreatedAt,
+				UpdatedAt:  time.Now().UTC(),
+				InReplyTo:  chirp.InReplyTo,
+				ReplyCount: chirp.ReplyCount,
+				Deleted:    true,
+			}
+			fmt.Printf("Tombstoned chirp id %v\n", chirpID)
+		} else {
+			removeChirp(*structure, chirp)
+			fmt.Printf("Deleted chirp id %v\n", chirpID)
+		}
+		return nil
+	})
 	if err != nil {
 		return err
 	}
-	delete(structure.Chirps, chirpID)
-	db.writeDB(structure)
-	fmt.Printf("Deleted chirp id %v\n", chirpID)
+	bus.Publish(Event{Type: EventChirpDeleted, ActorID: chirp.AuthorID, Chirp: chirp})
 	return nil
 }
 
+// indexChirp adds a chirp to every index built from its body.
+func indexChirp(structure DBStructure, chirp Chirp) {
+	indexEntities(structure, chirp)
+	indexSearchTerms(structure, chirp)
+	indexContentHash(structure, chirp)
+}
+
+func unindexChirp(structure DBStructure, chirp Chirp) {
+	unindexEntities(structure, chirp)
+	unindexSearchTerms(structure, chirp)
+	unindexContentHash(structure, chirp)
+}
+
+// removeChirp drops a chirp with no replies, then any tombstoned parent left
+// without replies of its own.
+func removeChirp(structure DBStructure, chirp Chirp) {
+	delete(structure.Chirps, chirp.ID)
+	delete(structure.Replies, chirp.ID)
+	if chirp.InReplyTo == 0 {
+		return
+	}
+	parent, ok := structure.Chirps[chirp.InReplyTo]
+	if !ok {
+		return
+	}
+	removeEdge(structure.Replies, parent.ID, chirp.ID)
+	parent.ReplyCount--
+	structure.Chirps[parent.ID] = parent
+	if parent.Deleted && parent.ReplyCount == 0 {
+		removeChirp(structure, parent)
+	}
+}
+
 func (db *DB) GetUsers() ([]User, error) {
 	users := make([]User, 0)
 	dbs, err := db.loadDB()
@@ -174,7 +652,7 @@ func (db *DB) GetUser(id int) (User, error) {
 		return emptyUser, err
 	}
 	if len(dbs.Users[id].Email) == 0 {
-		return emptyUser, errors.New("not found")
+		return emptyUser, errNotFound
 	}
 	return dbs.Users[id], nil
 }
@@ -211,80 +689,109 @@ func (db *DB) GetUserByRefreshToken(refreshToken string) (User, error) {
 	return emptyUser, errors.New("User matching token not found")
 }
 
-func (db *DB) CreateUser(email string, password []byte) (User, error) {
-	users, err := db.GetUsers()
+// CreateUser adds a user. An empty handle is derived from the email.
+func (db *DB) CreateUser(email string, password []byte, handle string) (User, error) {
+	newUser := User{
+		Email:     email,
+		Password:  password,
+		Handle:    handle,
+		CreatedAt: time.Now().UTC(),
+	}
+	err := db.update(func(structure *DBStructure) error {
+		if newUser.Handle == "" {
+			newUser.Handle = defaultHandle(*structure, email)
+		} else if _, taken := structure.Handles[normalizeHandle(handle)]; taken {
+			return errors.New("handle is already taken")
+		}
+		for _, user := range structure.Users {
+			newUser.ID = max(newUser.ID, user.ID)
+		}
+		newUser.ID++
+		structure.Users[newUser.ID] = newUser
+		structure.Handles[normalizeHandle(newUser.Handle)] = newUser.ID
+		return nil
+	})
 	if err != nil {
 		return User{}, err
 	}
-	newID := len(users) + 1
-	newUser := User{
-		ID:       newID,
-		Email:    email,
-		Password: password,
-	}
-	structure, err := db.loadDB()
-	structure.Users[newID] = newUser
-	db.writeDB(structure)
-	fmt.Printf("Added user id %v: %s\n", newID, email)
+	fmt.Printf("Added user id %v: %s\n", newUser.ID, email)
 	return newUser, nil
 }
+
+// updateUser applies fn to an existing user inside a single update.
+func (db *DB) updateUser(id int, fn func(user *User)) (User, error) {
+	var theUser User
+	err := db.update(func(structure *DBStructure) error {
+		user, ok := structure.Users[id]
+		if !ok {
+			return errNotFound
+		}
+		fn(&user)
+		structure.Users[id] = user
+		theUser = user
+		return nil
+	})
+	return theUser, err
+}
+
 func (db *DB) UpgradeUserToRed(id int) (User, error) {
-	structure, err := db.loadDB()
+	wasRed := false
+	theUser, err := db.updateUser(id, func(user *User) {
+		wasRed = user.IsChirpyRed
+		user.IsChirpyRed = true
+	})
 	if err != nil {
 		return User{}, err
 	}
-	theUser := structure.Users[id]
-	theUser.IsChirpyRed = true
-	structure.Users[id] = theUser
-	db.writeDB(structure)
 	fmt.Printf("~~Red~~ user %v: %s\n", id, theUser.Email)
-	return db.GetUser(id)
+	if !wasRed {
+		bus.Publish(Event{Type: EventUserUpgraded, UserID: id})
+	}
+	return theUser, nil
 }
-func (db *DB) UpdateUser(id int, email string, password []byte) (User, error) {
-	structure, err := db.loadDB()
+
+// UpdateUser changes a user's email and password, and their handle unless
+// handle is empty.
+func (db *DB) UpdateUser(id int, email string, password []byte, handle string) (User, error) {
+	var theUser User
+	err := db.update(func(structure *DBStructure) error {
+		user, ok := structure.Users[id]
+		if !ok {
+			return errNotFound
+		}
+		if handle != "" && normalizeHandle(handle) != normalizeHandle(user.Handle) {
+			if _, taken := structure.Handles[normalizeHandle(handle)]; taken {
+				return errors.New("handle is already taken")
+			}
+			delete(structure.Handles, normalizeHandle(user.Handle))
+			structure.Handles[normalizeHandle(handle)] = id
+		}
+		if handle != "" {
+			user.Handle = handle
+		}
+		user.Email = email
+		user.Password = password
+		structure.Users[id] = user
+		theUser = user
+		return nil
+	})
 	if err != nil {
 		return User{}, err
 	}
-	structure.Users[id] = User{
-		ID:           id,
-		Email:        email,
-		Password:     password,
-		RefreshToken: structure.Users[id].RefreshToken,
-	}
-	db.writeDB(structure)
 	fmt.Printf("Updated user %v: %s\n", id, email)
-	return db.GetUser(id)
+	return theUser, nil
 }
 func (db *DB) AddRefreshToken(id int, refreshToken string) (User, error) {
-	structure, err := db.loadDB()
-	if err != nil {
-		return User{}, err
-	}
-
 	expiryDate := time.Now().Add(time.Hour * 24 * 60)
 
-	user := structure.Users[id]
-	user.RefreshToken.Token = refreshToken
-	user.RefreshToken.Expiry = expiryDate
-	structure.Users[id] = user
-	err = db.writeDB(structure)
-	if err != nil {
-		return User{}, err
-	}
-	return db.GetUser(id)
+	return db.updateUser(id, func(user *User) {
+		user.RefreshToken.Token = refreshToken
+		user.RefreshToken.Expiry = expiryDate
+	})
 }
 func (db *DB) RevokeRefreshToken(id int) error {
-	structure, err := db.loadDB()
-	if err != nil {
-		return err
-	}
-
-	user := structure.Users[id]
-	user.RefreshToken = RefreshToken{}
-	structure.Users[id] = user
-	err = db.writeDB(structure)
-	if err != nil {
-		return err
-	}
-	return nil
+	_, err := db.updateUser(id, func(user *User) {
+		user.RefreshToken = RefreshToken{}
+	})
+	return err
 }
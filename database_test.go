@@ -0,0 +1,131 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// chirpIDs lists the IDs of chirps in order, for comparing pages.
+func chirpIDs(chirps []Chirp) []int {
+	ids := make([]int, 0, len(chirps))
+	for _, chirp := range chirps {
+		ids = append(ids, chirp.ID)
+	}
+	return ids
+}
+
+func TestCursor(t *testing.T) {
+	for _, id := range []int{1, 42, 1 << 40} {
+		got, err := decodeCursor(encodeCursor(id))
+		if err != nil || got != id {
+			t.Errorf("decodeCursor(encodeCursor(%d)) = %d, %v", id, got, err)
+		}
+	}
+	if encodeCursor(0) != "" {
+		t.Error("encodeCursor(0) should be empty, for no next page")
+	}
+	for _, bad := range []string{"!!", encodeCursor(1) + "x", "MA", "LTE"} {
+		if _, err := decodeCursor(bad); err == nil {
+			t.Errorf("decodeCursor(%q) accepted a bad cursor", bad)
+		}
+	}
+}
+
+func TestParseLimit(t *testing.T) {
+	tests := []struct {
+		in   string
+		want int
+		ok   bool
+	}{
+		{"", defaultPageLimit, true},
+		{"1", 1, true},
+		{"50", 50, true},
+		{"1000", maxPageLimit, true},
+		{"0", 0, false},
+		{"-3", 0, false},
+		{"ten", 0, false},
+	}
+	for _, tt := range tests {
+		got, err := parseLimit(tt.in)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("parseLimit(%q) = %d, %v", tt.in, got, err)
+		}
+	}
+}
+
+func TestQueryChirps(t *testing.T) {
+	structure := testStructure(t)
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	// chirps 1-9, by authors 1, 2 and 3 in turn, an hour apart
+	for i := 0; i < 9; i++ {
+		addTestChirp(structure, i%3+1, "chirp", start.Add(time.Duration(i)*time.Hour))
+	}
+	deleted := structure.Chirps[5]
+	deleted.Deleted = true
+	structure.Chirps[5] = deleted
+
+	tests := []struct {
+		name string
+		q    ChirpQuery
+		want []int
+		next int
+	}{
+		{"all", ChirpQuery{}, []int{1, 2, 3, 4, 6, 7, 8, 9}, 0},
+		{"newest first", ChirpQuery{Desc: true, Limit: 3}, []int{9, 8, 7}, 7},
+		{"next page", ChirpQuery{Desc: true, Limit: 3, Cursor: 7}, []int{6, 4, 3}, 3},
+		{"last page", ChirpQuery{Desc: true, Limit: 3, Cursor: 3}, []int{2, 1}, 0},
+		{"exact last page", ChirpQuery{Limit: 5, Cursor: 3}, []int{4, 6, 7, 8, 9}, 0},
+		{"oldest first", ChirpQuery{Limit: 2, Cursor: 2}, []int{3, 4}, 4},
+		{"authors", ChirpQuery{AuthorIDs: []int{1, 3}}, []int{1, 3, 4, 6, 7, 9}, 0},
+		{"since and max id", ChirpQuery{SinceID: 2, MaxID: 6}, []int{3, 4, 6}, 0},
+		{"time range", ChirpQuery{Since: start.Add(2 * time.Hour), Until: start.Add(4 * time.Hour)}, []int{3, 4}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chirps, next := queryChirps(structure, tt.q)
+			if got := chirpIDs(chirps); !reflect.DeepEqual(got, tt.want) || next != tt.next {
+				t.Errorf("queryChirps = %v next %d, want %v next %d", got, next, tt.want, tt.next)
+			}
+		})
+	}
+}
+
+func TestBackfillHandles(t *testing.T) {
+	// a database written before users had handles
+	path := filepath.Join(t.TempDir(), "database.json")
+	err := os.WriteFile(path, []byte(`{
+		"users": {
+			"1": {"id": 1, "email": "sam@example.com"},
+			"2": {"id": 2, "email": "Sam@example.org"},
+			"3": {"id": 3, "email": "kim@example.com", "handle": "kimmy"}
+		},
+		"handles": {"kimmy": 3}
+	}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := NewDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbs, err := db.loadDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[int]string{1: "sam", 2: "Sam2", 3: "kimmy"}
+	for id, handle := range want {
+		if got := dbs.Users[id].Handle; got != handle {
+			t.Errorf("user %d has handle %q, want %q", id, got, handle)
+		}
+		if got := dbs.Handles[normalizeHandle(handle)]; got != id {
+			t.Errorf("handle %q points at user %d, want %d", handle, got, id)
+		}
+	}
+	users, err := db.SearchUsers("sam", 0)
+	if err != nil || len(users) == 0 || users[0].ID != 1 {
+		t.Errorf("SearchUsers(sam) = %+v, %v", users, err)
+	}
+}
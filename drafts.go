@@ -0,0 +1,348 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Draft is an unpublished chirp. Setting PublishAt schedules it; the
+// scheduler publishes it once that time has passed.
+type Draft struct {
+	ID        int        `json:"id"`
+	AuthorID  int        `json:"author_id"`
+	Body      string     `json:"body"`
+	InReplyTo int        `json:"in_reply_to,omitempty"`
+	MediaIDs  []int      `json:"media_ids,omitempty"`
+	PublishAt *time.Time `json:"publish_at,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+	// LastError says why the scheduler couldn't publish the draft. It is
+	// unscheduled again until the author fixes it.
+	LastError string `json:"last_error,omitempty"`
+}
+
+func (db *DB) CreateDraft(draft Draft) (Draft, error) {
+	err := db.update(func(structure *DBStructure) error {
+		draft.ID = 0
+		for id := range structure.Drafts {
+			draft.ID = max(draft.ID, id)
+		}
+		draft.ID++
+		draft.CreatedAt = time.Now().UTC()
+		draft.UpdatedAt = draft.CreatedAt
+		structure.Drafts[draft.ID] = draft
+		return nil
+	})
+	if err != nil {
+		return Draft{}, err
+	}
+	fmt.Printf("Added draft id %v for user %v\n", draft.ID, draft.AuthorID)
+	return draft, nil
+}
+
+// GetDrafts returns a user's drafts, scheduled ones first in the order
+// they will go out.
+func (db *DB) GetDrafts(authorID int) ([]Draft, error) {
+	drafts := make([]Draft, 0)
+	dbs, err := db.loadDB()
+	if err != nil {
+		return drafts, err
+	}
+	for _, draft := range dbs.Drafts {
+		if draft.AuthorID == authorID {
+			drafts = append(drafts, draft)
+		}
+	}
+	sort.Slice(drafts, func(i, j int) bool {
+		a, b := drafts[i].PublishAt, drafts[j].PublishAt
+		if (a == nil) != (b == nil) {
+			return a != nil
+		}
+		if a != nil && !a.Equal(*b) {
+			return a.Before(*b)
+		}
+		return drafts[i].ID < drafts[j].ID
+	})
+	return drafts, nil
+}
+
+func (db *DB) GetDraft(id int) (Draft, error) {
+	dbs, err := db.loadDB()
+	if err != nil {
+		return Draft{}, err
+	}
+	draft, ok := dbs.Drafts[id]
+	if !ok {
+		return Draft{}, errNotFound
+	}
+	return draft, nil
+}
+
+func (db *DB) UpdateDraft(draft Draft) (Draft, error) {
+	err := db.update(func(structure *DBStructure) error {
+		old, ok := structure.Drafts[draft.ID]
+		if !ok {
+			return errNotFound
+		}
+		draft.AuthorID = old.AuthorID
+		draft.CreatedAt = old.CreatedAt
+		draft.UpdatedAt = time.Now().UTC()
+		draft.LastError = ""
+		structure.Drafts[draft.ID] = draft
+		return nil
+	})
+	return draft, err
+}
+
+func (db *DB) DeleteDraft(id int) error {
+	return db.update(func(structure *DBStructure) error {
+		if _, ok := structure.Drafts[id]; !ok {
+			return errNotFound
+		}
+		delete(structure.Drafts, id)
+		return nil
+	})
+}
+
+// PublishDueDrafts turns every draft scheduled at or before now into a
+// chirp. Each draft is removed in the same update that creates its chirp,
+// so a crash can neither lose a post nor publish it twice, and anything
+// missed while the server was down goes out on the next run.
+func (db *DB) PublishDueDrafts(now time.Time) ([]Chirp, error) {
+	published := make([]Chirp, 0)
+	// most runs have nothing to do, so look before taking the write lock
+	// and rewriting the database
+	dbs, err := db.loadDB()
+	if err != nil {
+		return published, err
+	}
+	if len(dueDrafts(dbs, now)) == 0 {
+		return published, nil
+	}
+	shadow := make(map[int]bool)
+	err = db.update(func(structure *DBStructure) error {
+		for _, draft := range dueDrafts(*structure, now) {
+			author := structure.Users[draft.AuthorID]
+			err := accountError(author, now)
+			if err == nil {
+				err = validateChirpBody(draft.Body, author)
+			}
+			var chirp Chirp
+			if err == nil {
+				chirp, err = createChirp(structure, Chirp{
+					Body:      draft.Body,
+					AuthorID:  draft.AuthorID,
+					InReplyTo: draft.InReplyTo,
+					MediaIDs:  draft.MediaIDs,
+				})
+			}
+			if err != nil {
+				var spam *spamError
+				if errors.As(err, &spam) {
+					logSpamRejection(structure, spam.verdict)
+				}
+				draft.PublishAt = nil
+				draft.LastError = err.Error()
+				structure.Drafts[draft.ID] = draft
+				fmt.Printf("Couldn't publish draft %v: %s\n", draft.ID, err)
+				continue
+			}
+			delete(structure.Drafts, draft.ID)
+			published = append(published, chirp)
+			shadow[chirp.ID] = chirp.Hidden || author.Status == UserShadowbanned
+		}
+		return nil
+	})
+	if err != nil {
+		return make([]Chirp, 0), err
+	}
+	for _, chirp := range published {
+		bus.Publish(Event{Type: EventChirpCreated, ActorID: chirp.AuthorID, Chirp: chirp, Shadow: shadow[chirp.ID]})
+	}
+	return published, nil
+}
+
+// dueDrafts returns the drafts scheduled at or before now, earliest first.
+func dueDrafts(dbs DBStructure, now time.Time) []Draft {
+	due := make([]Draft, 0)
+	for _, draft := range dbs.Drafts {
+		if draft.PublishAt != nil && !draft.PublishAt.After(now) {
+			due = append(due, draft)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool {
+		return due[i].PublishAt.Before(*due[j].PublishAt)
+	})
+	return due
+}
+
+// runScheduler publishes due drafts every interval until the process
+// exits, starting straight away to catch up after a restart.
+func runScheduler(db *DB, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for now := time.Now(); ; now = <-ticker.C {
+		chirps, err := db.PublishDueDrafts(now)
+		if err != nil {
+			fmt.Printf("Scheduler error: %s\n", err)
+		}
+		for _, chirp := range chirps {
+			fmt.Printf("Published scheduled chirp %v\n", chirp.ID)
+		}
+	}
+}
+
+// draftParams is the body of POST and PATCH /api/drafts. publish_at is
+// kept raw so PATCH can tell "leave it alone" (absent) from "unschedule"
+// (null).
+type draftParams struct {
+	Body      *string         `json:"body"`
+	InReplyTo *int            `json:"in_reply_to"`
+	MediaIDs  []int           `json:"media_ids"`
+	PublishAt json.RawMessage `json:"publish_at"`
+}
+
+// apply copies the fields present in params onto draft and checks the
+// result the same way chirpHandler checks a new chirp by author.
+func (params draftParams) apply(draft *Draft, author User) error {
+	if params.Body != nil {
+		draft.Body = *params.Body
+	}
+	if params.InReplyTo != nil {
+		draft.InReplyTo = *params.InReplyTo
+	}
+	if params.MediaIDs != nil {
+		draft.MediaIDs = params.MediaIDs
+	}
+	if len(params.PublishAt) > 0 {
+		if bytes.Equal(params.PublishAt, []byte("null")) {
+			draft.PublishAt = nil
+		} else {
+			var publishAt time.Time
+			err := json.Unmarshal(params.PublishAt, &publishAt)
+			if err != nil {
+				return fmt.Errorf("bad publish_at provided, want RFC 3339: %s", params.PublishAt)
+			}
+			publishAt = publishAt.UTC()
+			draft.PublishAt = &publishAt
+		}
+	}
+	if len(draft.MediaIDs) > maxChirpMedia {
+		return fmt.Errorf("a chirp can have at most %d media attachments", maxChirpMedia)
+	}
+	return validateChirpBody(draft.Body, author)
+}
+
+func draftsHandler(w http.ResponseWriter, r *http.Request) {
+	validity, userID := IsJWTValid(w, r)
+	if !validity {
+		return
+	}
+
+	chirpdb, err := NewDB("database.json")
+	if err != nil {
+		fmt.Println(err)
+	}
+
+	if r.Method == "GET" {
+		drafts, err := chirpdb.GetDrafts(userID)
+		if err != nil {
+			respondWithError(w, 500, fmt.Sprintf("Couldn't get drafts: %s", err))
+			return
+		}
+		respondWithJSON(w, http.StatusOK, drafts)
+		return
+	}
+
+	params := draftParams{}
+	decoder := json.NewDecoder(r.Body)
+	err = decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, 400, fmt.Sprintf("Error decoding parameters: %s", err))
+		return
+	}
+	user, err := chirpdb.GetUser(userID)
+	if err != nil {
+		respondWithError(w, 401, fmt.Sprintf("Couldn't get user from token: %s", err))
+		return
+	}
+	draft := Draft{AuthorID: userID}
+	err = params.apply(&draft, user)
+	if err != nil {
+		respondWithError(w, 400, err.Error())
+		return
+	}
+	draft, err = chirpdb.CreateDraft(draft)
+	if err != nil {
+		respondWithError(w, 500, fmt.Sprintf("Couldn't save draft: %s", err))
+		return
+	}
+	respondWithJSON(w, 201, draft)
+}
+
+func draftHandler(w http.ResponseWriter, r *http.Request) {
+	validity, userID := IsJWTValid(w, r)
+	if !validity {
+		return
+	}
+
+	pathVal := r.PathValue("id")
+	draftID, err := strconv.Atoi(pathVal)
+	if err != nil {
+		respondWithError(w, 400, fmt.Sprintf("Cannot convert %s to integer", pathVal))
+		return
+	}
+
+	chirpdb, err := NewDB("database.json")
+	if err != nil {
+		fmt.Println(err)
+	}
+
+	draft, err := chirpdb.GetDraft(draftID)
+	if err != nil || draft.AuthorID != userID {
+		respondWithError(w, 404, "Draft does not exist")
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		respondWithJSON(w, http.StatusOK, draft)
+	case "PATCH":
+		params := draftParams{}
+		decoder := json.NewDecoder(r.Body)
+		err = decoder.Decode(&params)
+		if err != nil {
+			respondWithError(w, 400, fmt.Sprintf("Error decoding parameters: %s", err))
+			return
+		}
+		user, err := chirpdb.GetUser(userID)
+		if err != nil {
+			respondWithError(w, 401, fmt.Sprintf("Couldn't get user from token: %s", err))
+			return
+		}
+		err = params.apply(&draft, user)
+		if err != nil {
+			respondWithError(w, 400, err.Error())
+			return
+		}
+		draft, err = chirpdb.UpdateDraft(draft)
+		if err != nil {
+			respondWithError(w, 404, fmt.Sprintf("Couldn't update draft: %s", err))
+			return
+		}
+		respondWithJSON(w, http.StatusOK, draft)
+	case "DELETE":
+		err = chirpdb.DeleteDraft(draftID)
+		if err != nil {
+			respondWithError(w, 404, fmt.Sprintf("Couldn't delete draft: %s", err))
+			return
+		}
+		respondWithJSON(w, 204, "")
+	}
+}
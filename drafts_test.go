@@ -0,0 +1,54 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPublishDueDrafts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	db, err := NewDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().UTC()
+	later := now.Add(time.Hour)
+	err = db.update(func(structure *DBStructure) error {
+		structure.Users[1] = User{ID: 1, CreatedAt: now.Add(-30 * 24 * time.Hour)}
+		structure.Drafts[1] = Draft{ID: 1, AuthorID: 1, Body: "a scheduled chirp for later", PublishAt: &later}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	before, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chirps, err := db.PublishDueDrafts(now)
+	if err != nil || len(chirps) != 0 {
+		t.Fatalf("nothing due: published %v, error %v", chirps, err)
+	}
+	after, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !after.ModTime().Equal(before.ModTime()) {
+		t.Error("PublishDueDrafts rewrote the database with nothing due")
+	}
+
+	chirps, err = db.PublishDueDrafts(later)
+	if err != nil || len(chirps) != 1 || chirps[0].Body != "a scheduled chirp for later" {
+		t.Fatalf("one due: published %v, error %v", chirps, err)
+	}
+	dbs, err := db.loadDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := dbs.Drafts[1]; ok {
+		t.Error("published draft was kept")
+	}
+}
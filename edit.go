@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// ChirpRevision is an earlier version of a chirp's body, kept when the
+// author edits it.
+type ChirpRevision struct {
+	Body      string    `json:"body"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+var errEditRechirp = errors.New("a rechirp has no text of its own to edit")
+
+// editWindow is how long after posting an author may still edit a chirp.
+// Chirpy Red subscribers get a longer window.
+func editWindow(user User) time.Duration {
+	if user.IsChirpyRed {
+		return envDuration("CHIRP_EDIT_WINDOW_RED", time.Hour)
+	}
+	return envDuration("CHIRP_EDIT_WINDOW", 15*time.Minute)
+}
+
+func (db *DB) EditChirp(id int, body string) (Chirp, error) {
+	var chirp Chirp
+	err := db.update(func(structure *DBStructure) error {
+		var ok bool
+		chirp, ok = structure.Chirps[id]
+		if !ok || chirp.Deleted {
+			return errNotFound
+		}
+		if chirp.Kind == ChirpKindRechirp {
+			return errEditRechirp
+		}
+		filtered, flagged, err := filter.Apply(body)
+		if err != nil {
+			return err
+		}
+		body = filtered
+		if len(flagged) > 0 {
+			flagForReview(structure, id, flagged)
+		}
+		previous := chirp.UpdatedAt
+		if previous.IsZero() {
+			previous = chirp.CreatedAt
+		}
+		structure.ChirpHistory[id] = append(structure.ChirpHistory[id], ChirpRevision{
+			Body:      chirp.Body,
+			CreatedAt: previous,
+		})
+		unindexChirp(*structure, chirp)
+		now := time.Now().UTC()
+		chirp, err = scoreEdit(structure, chirp, body, now)
+		if err != nil {
+			return err
+		}
+		chirp.Body = body
+		chirp.Entities = extractEntities(*structure, body)
+		indexChirp(*structure, chirp)
+		chirp.UpdatedAt = now
+		chirp.Edited = true
+		structure.Chirps[id] = chirp
+		return nil
+	})
+	if err != nil {
+		db.recordSpamRejection(err)
+		return Chirp{}, err
+	}
+	fmt.Printf("Edited chirp id %v: %s\n", id, body)
+	return chirp, nil
+}
+
+// GetChirpHistory returns every version of a chirp, oldest first, ending
+// with the current one.
+func (db *DB) GetChirpHistory(id, viewerID int) ([]ChirpRevision, error) {
+	dbs, err := db.loadDB()
+	if err != nil {
+		return nil, err
+	}
+	chirp, ok := dbs.Chirps[id]
+	if !ok || chirp.Deleted || !canView(dbs, chirp, viewerID) {
+		return nil, errNotFound
+	}
+	current := ChirpRevision{Body: chirp.Body, CreatedAt: chirp.UpdatedAt}
+	if current.CreatedAt.IsZero() {
+		current.CreatedAt = chirp.CreatedAt
+	}
+	revisions := make([]ChirpRevision, 0, len(dbs.ChirpHistory[id])+1)
+	revisions = append(revisions, dbs.ChirpHistory[id]...)
+	return append(revisions, current), nil
+}
+
+func editChirpHandler(w http.ResponseWriter, r *http.Request) {
+	validity, userID := IsJWTValid(w, r)
+	if !validity {
+		return
+	}
+
+	pathVal := r.PathValue("id")
+	chirpID, err := strconv.Atoi(pathVal)
+	if err != nil {
+		respondWithError(w, 400, fmt.Sprintf("Cannot convert %s to integer", pathVal))
+		return
+	}
+
+	type parameters struct {
+		Body string `json:"body"`
+	}
+	params := parameters{}
+	decoder := json.NewDecoder(r.Body)
+	err = decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, 400, fmt.Sprintf("Error decoding parameters: %s", err))
+		return
+	}
+
+	chirpdb, err := NewDB("database.json")
+	if err != nil {
+		fmt.Println(err)
+	}
+
+	chirp, err := chirpdb.GetChirp(chirpID)
+	if err != nil {
+		respondWithError(w, 404, fmt.Sprintf("Chirp does not exist: %s", err))
+		return
+	}
+	if chirp.AuthorID != userID {
+		respondWithError(w, 403, "You're only allowed to edit your own chirps")
+		return
+	}
+	user, err := chirpdb.GetUser(userID)
+	if err != nil {
+		respondWithError(w, 401, fmt.Sprintf("Couldn't get user from token: %s", err))
+		return
+	}
+	if time.Since(chirp.CreatedAt) > editWindow(user) {
+		respondWithError(w, 403, "The edit window for this chirp has closed")
+		return
+	}
+	err = validateChirpBody(params.Body, user)
+	if err != nil {
+		respondWithError(w, 400, err.Error())
+		return
+	}
+
+	chirp, err = chirpdb.EditChirp(chirpID, params.Body)
+	if errors.Is(err, errChirpRejected) || errors.Is(err, errChirpSpam) || errors.Is(err, errEditRechirp) {
+		respondWithError(w, 400, err.Error())
+		return
+	} else if err != nil {
+		respondWithError(w, 500, fmt.Sprintf("Couldn't edit chirp: %s", err))
+		return
+	}
+	chirp.Body = cleanupBadWords(chirp.Body)
+	respondWithJSON(w, http.StatusOK, chirp)
+}
+
+func chirpHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	type returnVals struct {
+		ChirpID   int             `json:"chirp_id"`
+		Revisions []ChirpRevision `json:"revisions"`
+	}
+
+	pathVal := r.PathValue("id")
+	chirpID, err := strconv.Atoi(pathVal)
+	if err != nil {
+		respondWithError(w, 400, fmt.Sprintf("Cannot convert %s to integer", pathVal))
+		return
+	}
+
+	chirpdb, err := NewDB("database.json")
+	if err != nil {
+		fmt.Println(err)
+	}
+
+	revisions, err := chirpdb.GetChirpHistory(chirpID, optionalUserID(r))
+	if err != nil {
+		respondWithError(w, 404, fmt.Sprintf("Chirp does not exist: %s", err))
+		return
+	}
+	for i := range revisions {
+		revisions[i].Body = cleanupBadWords(revisions[i].Body)
+	}
+	respondWithJSON(w, http.StatusOK, returnVals{
+		ChirpID:   chirpID,
+		Revisions: revisions,
+	})
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestEditChirp(t *testing.T) {
+	db, err := NewDB(filepath.Join(t.TempDir(), "database.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var original, rechirp, parent Chirp
+	err = db.update(func(structure *DBStructure) error {
+		structure.Users[1] = User{ID: 1, CreatedAt: time.Now().Add(-30 * 24 * time.Hour)}
+		structure.Users[2] = User{ID: 2, CreatedAt: time.Now().Add(-30 * 24 * time.Hour)}
+		var err error
+		original, err = createChirp(structure, Chirp{AuthorID: 1, Body: "the first version"})
+		if err != nil {
+			return err
+		}
+		rechirp, err = createChirp(structure, Chirp{AuthorID: 2, Kind: ChirpKindRechirp, RefID: original.ID})
+		if err != nil {
+			return err
+		}
+		parent, err = createChirp(structure, Chirp{AuthorID: 1, Body: "a chirp with replies"})
+		if err != nil {
+			return err
+		}
+		_, err = createChirp(structure, Chirp{AuthorID: 2, Body: "a reply", InReplyTo: parent.ID})
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	edited, err := db.EditChirp(original.ID, "the second version")
+	if err != nil || !edited.Edited || edited.Body != "the second version" {
+		t.Fatalf("EditChirp = %+v, %v", edited, err)
+	}
+	revisions, err := db.GetChirpHistory(original.ID, 0)
+	if err != nil || len(revisions) != 2 || revisions[0].Body != "the first version" {
+		t.Errorf("GetChirpHistory = %+v, %v", revisions, err)
+	}
+
+	_, err = db.EditChirp(rechirp.ID, "words of my own")
+	if !errors.Is(err, errEditRechirp) {
+		t.Errorf("editing a rechirp: got error %v, want errEditRechirp", err)
+	}
+
+	// a chirp with replies is tombstoned rather than removed
+	err = db.DeleteChirp(parent.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.GetChirpHistory(parent.ID, 1)
+	if !errors.Is(err, errNotFound) {
+		t.Errorf("history of a tombstone: got error %v, want errNotFound", err)
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+const (
+	EntityHashtag = "hashtag"
+	EntityMention = "mention"
+
+	maxHandleLength = 30
+)
+
+// Entity is a hashtag or mention found in a chirp body. Start and End are
+// offsets in Unicode code points, End exclusive, and cover the leading #
+// or @ so clients can link the whole thing.
+type Entity struct {
+	Type   string `json:"type"`
+	Text   string `json:"text"`
+	Start  int    `json:"start"`
+	End    int    `json:"end"`
+	UserID int    `json:"user_id,omitempty"`
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.Is(unicode.Mn, r) || r == '_'
+}
+
+// normalizeHandle folds a handle for case-insensitive lookups.
+func normalizeHandle(handle string) string {
+	return strings.ToLower(handle)
+}
+
+func validateHandle(handle string) error {
+	runes := []rune(handle)
+	if len(runes) == 0 || len(runes) > maxHandleLength {
+		return fmt.Errorf("handle must be 1 to %d characters", maxHandleLength)
+	}
+	for _, r := range runes {
+		if !isWordRune(r) {
+			return errors.New("handle may only contain letters, digits and underscores")
+		}
+	}
+	return nil
+}
+
+// defaultHandle derives a handle from the local part of an email address,
+// adding a number if it is already taken.
+func defaultHandle(structure DBStructure, email string) string {
+	local, _, _ := strings.Cut(email, "@")
+	var b strings.Builder
+	for _, r := range local {
+		if isWordRune(r) && b.Len() < maxHandleLength-4 {
+			b.WriteRune(r)
+		}
+	}
+	base := b.String()
+	if base == "" {
+		base = "user"
+	}
+	handle := base
+	for i := 2; ; i++ {
+		if _, taken := structure.Handles[normalizeHandle(handle)]; !taken {
+			return handle
+		}
+		handle = base + strconv.Itoa(i)
+	}
+}
+
+// backfillHandles gives users created before handles existed one derived
+// from their email, in ID order so the first gets the plain one.
+func (db *DB) backfillHandles() error {
+	return db.update(func(structure *DBStructure) error {
+		ids := make([]int, 0, len(structure.Users))
+		for id := range structure.Users {
+			ids = append(ids, id)
+		}
+		slices.Sort(ids)
+		for _, id := range ids {
+			user := structure.Users[id]
+			if user.Handle == "" {
+				user.Handle = defaultHandle(*structure, user.Email)
+				structure.Users[id] = user
+			}
+			if _, taken := structure.Handles[normalizeHandle(user.Handle)]; !taken {
+				structure.Handles[normalizeHandle(user.Handle)] = id
+			}
+		}
+		return nil
+	})
+}
+
+// extractEntities finds #hashtags and @mentions in body. A marker only
+// counts at the start of the body or after a non-word character, and
+// hashtags need at least one non-digit. Mentions of unknown handles are
+// left as plain text.
+func extractEntities(structure DBStructure, body string) []Entity {
+	var entities []Entity
+	runes := []rune(body)
+	for i := 0; i < len(runes); i++ {
+		marker := runes[i]
+		if marker != '#' && marker != '@' {
+			continue
+		}
+		if i > 0 && (isWordRune(runes[i-1]) || runes[i-1] == '#' || runes[i-1] == '@') {
+			continue
+		}
+		end := i + 1
+		for end < len(runes) && isWordRune(runes[end]) {
+			end++
+		}
+		text := string(runes[i+1 : end])
+		if text == "" {
+			continue
+		}
+		entity := Entity{Text: text, Start: i, End: end}
+		if marker == '#' {
+			if strings.IndexFunc(text, func(r rune) bool { return !unicode.IsDigit(r) }) < 0 {
+				continue
+			}
+			entity.Type = EntityHashtag
+		} else {
+			userID, ok := structure.Handles[normalizeHandle(text)]
+			if !ok {
+				continue
+			}
+			entity.Type = EntityMention
+			entity.UserID = userID
+		}
+		entities = append(entities, entity)
+		i = end - 1
+	}
+	return entities
+}
+
+// normalizeTag folds a hashtag for indexing and lookups.
+func normalizeTag(tag string) string {
+	return strings.ToLower(strings.TrimPrefix(tag, "#"))
+}
+
+func indexEntities(structure DBStructure, chirp Chirp) {
+	for _, entity := range chirp.Entities {
+		if entity.Type == EntityHashtag {
+			addEdge(structure.Hashtags, normalizeTag(entity.Text), chirp.ID)
+		} else {
+			addEdge(structure.Mentions, entity.UserID, chirp.ID)
+		}
+	}
+}
+
+func unindexEntities(structure DBStructure, chirp Chirp) {
+	for _, entity := range chirp.Entities {
+		if entity.Type == EntityHashtag {
+			removeEdge(structure.Hashtags, normalizeTag(entity.Text), chirp.ID)
+		} else {
+			removeEdge(structure.Mentions, entity.UserID, chirp.ID)
+		}
+	}
+}
+
+// GetChirpsByHashtag returns chirps tagged with tag, newest first.
+func (db *DB) GetChirpsByHashtag(tag string, viewerID, before, limit int) ([]Chirp, int, error) {
+	dbs, err := db.loadDB()
+	if err != nil {
+		return make([]Chirp, 0), 0, err
+	}
+	chirps, next := pageChirpIDs(dbs, dbs.Hashtags[normalizeTag(tag)], viewerID, before, limit)
+	return chirps, next, nil
+}
+
+// GetMentions returns chirps mentioning userID, newest first.
+func (db *DB) GetMentions(userID, viewerID, before, limit int) ([]Chirp, int, error) {
+	dbs, err := db.loadDB()
+	if err != nil {
+		return make([]Chirp, 0), 0, err
+	}
+	if _, ok := dbs.Users[userID]; !ok {
+		return make([]Chirp, 0), 0, errNotFound
+	}
+	chirps, next := pageChirpIDs(dbs, dbs.Mentions[userID], viewerID, before, limit)
+	return chirps, next, nil
+}
+
+func hashtagChirpsHandler(w http.ResponseWriter, r *http.Request) {
+	tag := r.PathValue("tag")
+	if tag == "" {
+		respondWithError(w, 400, "Hashtag required")
+		return
+	}
+	respondWithChirpPage(w, r, func(db *DB, viewerID, before, limit int) ([]Chirp, int, error) {
+		return db.GetChirpsByHashtag(tag, viewerID, before, limit)
+	})
+}
+
+func userMentionsHandler(w http.ResponseWriter, r *http.Request) {
+	pathVal := r.PathValue("id")
+	userID, err := strconv.Atoi(pathVal)
+	if err != nil {
+		respondWithError(w, 400, fmt.Sprintf("Cannot convert %s to integer", pathVal))
+		return
+	}
+	respondWithChirpPage(w, r, func(db *DB, viewerID, before, limit int) ([]Chirp, int, error) {
+		return db.GetMentions(userID, viewerID, before, limit)
+	})
+}
+
+// respondWithChirpPage parses limit and cursor, loads a page of chirps with
+// load and writes it out with the cursor for the next page.
+func respondWithChirpPage(w http.ResponseWriter, r *http.Request, load func(db *DB, viewerID, before, limit int) ([]Chirp, int, error)) {
+	type returnVals struct {
+		Chirps     []Chirp `json:"chirps"`
+		NextCursor string  `json:"next_cursor,omitempty"`
+	}
+
+	limit, err := parseLimit(r.URL.Query().Get("limit"))
+	if err != nil {
+		respondWithError(w, 400, err.Error())
+		return
+	}
+	before, err := decodeCursor(r.URL.Query().Get("cursor"))
+	if err != nil {
+		respondWithError(w, 400, err.Error())
+		return
+	}
+
+	chirpdb, err := NewDB("database.json")
+	if err != nil {
+		fmt.Println(err)
+	}
+
+	chirps, next, err := load(chirpdb, optionalUserID(r), before, limit)
+	if err != nil {
+		respondWithError(w, 404, fmt.Sprintf("Couldn't load chirps: %s", err))
+		return
+	}
+	for i := range chirps {
+		chirps[i].Body = cleanupBadWords(chirps[i].Body)
+	}
+	respondWithJSON(w, http.StatusOK, returnVals{
+		Chirps:     chirps,
+		NextCursor: encodeCursor(next),
+	})
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Events are published by the DB methods once a change has been written,
+// so anything that reacts to them (notifications, trends, streaming) stays
+// out of the handlers.
+const (
+	EventChirpCreated   = "chirp_created"
+	EventChirpDeleted   = "chirp_deleted"
+	EventUserFollowed   = "user_followed"
+	EventUserUnfollowed = "user_unfollowed"
+	EventUserUpgraded   = "user_upgraded"
+	EventNotification   = "notification"
+	EventModAction      = "mod_action"
+	EventUserBlocked    = "user_blocked"
+	EventUserUnblocked  = "user_unblocked"
+	EventUserMuted      = "user_muted"
+	EventUserUnmuted    = "user_unmuted"
+)
+
+type Event struct {
+	Type    string
+	ActorID int       // the user who caused the event
+	UserID  int       // the user it happened to, for follows, blocks, upgrades and moderation
+	Chirp   Chirp     // the chirp, for chirp events
+	At      time.Time // when it happened
+
+	// Shadow marks a chirp only its author may see: one by a shadowbanned
+	// user, or one held for review.
+	Shadow bool
+
+	Notification Notification // for notification events
+	Action       ModAction    // for moderation events
+}
+
+// eventBus delivers events to every subscriber in the publishing
+// goroutine, in the order they were published.
+type eventBus struct {
+	mu          sync.RWMutex
+	subscribers []func(Event)
+}
+
+var bus = &eventBus{}
+
+func (b *eventBus) Subscribe(fn func(Event)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.subscribers = append(b.subscribers, fn)
+}
+
+// Publish must not be called while holding the database lock, since
+// subscribers may write to the database themselves.
+func (b *eventBus) Publish(event Event) {
+	if event.At.IsZero() {
+		event.At = time.Now().UTC()
+	}
+	b.mu.RLock()
+	subscribers := b.subscribers
+	b.mu.RUnlock()
+	for _, fn := range subscribers {
+		fn(event)
+	}
+}
@@ -0,0 +1,576 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/joho/godotenv"
+)
+
+const (
+	FilterMask   = "mask"
+	FilterReject = "reject"
+	FilterFlag   = "flag"
+)
+
+var filterActions = []string{FilterMask, FilterReject, FilterFlag}
+
+// errChirpRejected is returned when a chirp matches a reject rule.
+var errChirpRejected = errors.New("Chirp contains a blocked word")
+
+// FilterRule is a word or phrase the content filter looks for and what to
+// do when it finds it.
+type FilterRule struct {
+	ID        int       `json:"id"`
+	Pattern   string    `json:"pattern"`
+	Action    string    `json:"action"`
+	CreatedAt time.Time `json:"created_at"`
+	CreatedBy int       `json:"created_by,omitempty"`
+}
+
+// contentFilter matches chirp text against the rules in the database. The
+// rules are compiled once here whenever they change, since they are needed
+// on every read as well as every write.
+type contentFilter struct {
+	mu    sync.RWMutex
+	rules []compiledRule
+}
+
+type compiledRule struct {
+	id     int
+	action string
+	words  [][]filterRun // normalised
+}
+
+var filter = &contentFilter{}
+
+// load replaces the filter's rules with those in structure.
+func (f *contentFilter) load(structure DBStructure) {
+	rules := make([]compiledRule, 0, len(structure.FilterRules))
+	for _, rule := range structure.FilterRules {
+		var words [][]filterRun
+		for _, word := range filterWords(rule.Pattern) {
+			words = append(words, word.runs)
+		}
+		if len(words) > 0 {
+			rules = append(rules, compiledRule{id: rule.ID, action: rule.Action, words: words})
+		}
+	}
+	sort.Slice(rules, func(i, j int) bool { return rules[i].id < rules[j].id })
+	f.mu.Lock()
+	f.rules = rules
+	f.mu.Unlock()
+}
+
+// Apply runs the filter over a chirp body before it is stored. It returns
+// the body with masked words replaced and the IDs of any flag rules that
+// matched, or errChirpRejected.
+func (f *contentFilter) Apply(body string) (string, []int, error) {
+	words := filterWords(body)
+	var masks [][2]int
+	var flagged []int
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	for _, rule := range f.rules {
+		for _, span := range rule.find(words) {
+			switch rule.action {
+			case FilterReject:
+				return body, nil, errChirpRejected
+			case FilterFlag:
+				if !slices.Contains(flagged, rule.id) {
+					flagged = append(flagged, rule.id)
+				}
+			default:
+				masks = append(masks, span)
+			}
+		}
+	}
+	return maskSpans(body, masks), flagged, nil
+}
+
+// Mask replaces every word matched by a mask or reject rule. It is used on
+// the way out, so text stored before a rule was added is covered too.
+func (f *contentFilter) Mask(body string) string {
+	words := filterWords(body)
+	var masks [][2]int
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	for _, rule := range f.rules {
+		if rule.action != FilterFlag {
+			masks = append(masks, rule.find(words)...)
+		}
+	}
+	return maskSpans(body, masks)
+}
+
+// find returns the byte spans where the rule's words appear as
+// consecutive words.
+func (rule compiledRule) find(words []filterWord) [][2]int {
+	var spans [][2]int
+	for i := 0; i+len(rule.words) <= len(words); i++ {
+		matched := true
+		for j, want := range rule.words {
+			if !runsMatch(words[i+j].runs, want) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			spans = append(spans, [2]int{words[i].start, words[i+len(rule.words)-1].end})
+		}
+	}
+	return spans
+}
+
+func maskSpans(body string, spans [][2]int) string {
+	if len(spans) == 0 {
+		return body
+	}
+	sort.Slice(spans, func(i, j int) bool { return spans[i][0] < spans[j][0] })
+	var b strings.Builder
+	last := 0
+	for _, span := range spans {
+		if span[0] < last {
+			// overlaps a span already masked
+			last = max(last, span[1])
+			continue
+		}
+		b.WriteString(body[last:span[0]])
+		b.WriteString("****")
+		last = span[1]
+	}
+	b.WriteString(body[last:])
+	return b.String()
+}
+
+// filterWord is a word of text with its byte offsets and its normalised
+// form, as runs of the same letter.
+type filterWord struct {
+	start, end int
+	runs       []filterRun
+}
+
+// filterRun is a letter and how many times in a row it appears.
+type filterRun struct {
+	r rune
+	n int
+}
+
+// runsMatch reports whether a word of text matches a word of a rule. The
+// letters must be the same, and each run in the text must be at least as
+// long as the rule's, so "fooorrnax" matches "fornax" but "as" doesn't
+// match "ass".
+func runsMatch(text, rule []filterRun) bool {
+	if len(text) != len(rule) {
+		return false
+	}
+	for i := range rule {
+		if text[i].r != rule[i].r || text[i].n < rule[i].n {
+			return false
+		}
+	}
+	return true
+}
+
+// filterWords splits text into words the way the filter compares them.
+// Punctuation separates words, so "fornax!" is the word "fornax"; leetspeak
+// symbols that stand for letters count as part of a word.
+func filterWords(text string) []filterWord {
+	var words []filterWord
+	start := -1
+	for i, r := range text {
+		inWord := isFilterWordRune(r)
+		if inWord && start < 0 {
+			start = i
+		} else if !inWord && start >= 0 {
+			words = append(words, newFilterWord(text, start, i))
+			start = -1
+		}
+	}
+	if start >= 0 {
+		words = append(words, newFilterWord(text, start, len(text)))
+	}
+	return words
+}
+
+func isFilterWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.IsMark(r) ||
+		r == '@' || r == '$' || isInvisible(r)
+}
+
+func isInvisible(r rune) bool {
+	switch r {
+	case '\u00AD', '\u200B', '\u200C', '\u200D', '\u2060', '\uFEFF':
+		return true
+	}
+	return false
+}
+
+// newFilterWord normalises text[start:end]: case is folded, lookalike
+// letters from other scripts, accented letters and ligatures are mapped to
+// plain Latin, combining marks and invisible characters are dropped, and
+// repeated letters are counted as runs. Leetspeak is only read as letters
+// in a word that has a letter in it, so "a55" is "ass" but "455" is a
+// number.
+func newFilterWord(text string, start, end int) filterWord {
+	leet := strings.IndexFunc(text[start:end], unicode.IsLetter) >= 0
+	var runs []filterRun
+	for _, r := range text[start:end] {
+		if unicode.IsMark(r) || isInvisible(r) {
+			continue
+		}
+		r = foldRune(r, leet)
+		expanded, ok := ligatures[r]
+		if !ok {
+			expanded = string(r)
+		}
+		for _, r := range expanded {
+			if len(runs) > 0 && runs[len(runs)-1].r == r {
+				runs[len(runs)-1].n++
+			} else {
+				runs = append(runs, filterRun{r: r, n: 1})
+			}
+		}
+	}
+	return filterWord{start: start, end: end, runs: runs}
+}
+
+var leetFolds = map[rune]rune{
+	'0': 'o', '1': 'i', '3': 'e', '4': 'a', '5': 's', '7': 't', '8': 'b',
+	'@': 'a', '$': 's',
+}
+
+var runeFolds = map[rune]rune{
+	// Cyrillic lookalikes
+	'а': 'a', 'в': 'b', 'е': 'e', 'ё': 'e', 'к': 'k', 'м': 'm', 'н': 'h',
+	'о': 'o', 'р': 'p', 'с': 'c', 'т': 't', 'у': 'y', 'х': 'x', 'і': 'i',
+	'ї': 'i', 'ј': 'j', 'ѕ': 's', 'ԁ': 'd', 'ԛ': 'q', 'ԝ': 'w',
+	// Greek lookalikes
+	'α': 'a', 'β': 'b', 'ε': 'e', 'η': 'n', 'ι': 'i', 'κ': 'k', 'ν': 'v',
+	'ο': 'o', 'ρ': 'p', 'τ': 't', 'υ': 'u', 'χ': 'x',
+	// accented Latin
+	'à': 'a', 'á': 'a', 'â': 'a', 'ã': 'a', 'ä': 'a', 'å': 'a', 'ā': 'a',
+	'ç': 'c', 'è': 'e', 'é': 'e', 'ê': 'e', 'ë': 'e', 'ē': 'e', 'ì': 'i',
+	'í': 'i', 'î': 'i', 'ï': 'i', 'ī': 'i', 'ñ': 'n', 'ò': 'o', 'ó': 'o',
+	'ô': 'o', 'õ': 'o', 'ö': 'o', 'ø': 'o', 'ō': 'o', 'ù': 'u', 'ú': 'u',
+	'û': 'u', 'ü': 'u', 'ū': 'u', 'ý': 'y', 'ÿ': 'y', 'ı': 'i',
+}
+
+var ligatures = map[rune]string{
+	'ß': "ss", 'æ': "ae", 'œ': "oe",
+	'\uFB00': "ff", '\uFB01': "fi", '\uFB02': "fl", '\uFB03': "ffi", '\uFB04': "ffl",
+}
+
+func foldRune(r rune, leet bool) rune {
+	if r >= '\uFF01' && r <= '\uFF5E' {
+		// fullwidth forms of ASCII
+		r -= 0xFEE0
+	}
+	r = unicode.ToLower(r)
+	if folded, ok := leetFolds[r]; ok && leet {
+		return folded
+	}
+	if folded, ok := runeFolds[r]; ok {
+		return folded
+	}
+	return r
+}
+
+func validateFilterRule(rule FilterRule) error {
+	if len(filterWords(rule.Pattern)) == 0 {
+		return errors.New("a rule needs a word or phrase to match")
+	}
+	if utf8.RuneCountInString(rule.Pattern) > 100 {
+		return errors.New("patterns can be at most 100 characters")
+	}
+	if !slices.Contains(filterActions, rule.Action) {
+		return fmt.Errorf("action must be one of %s", strings.Join(filterActions, ", "))
+	}
+	return nil
+}
+
+// SeedFilterRules adds the rules in FILTER_WORDS the first time the
+// server starts, then loads the rules into the filter. FILTER_WORDS is a
+// comma separated list of patterns, each optionally followed by
+// :mask, :reject or :flag.
+func (db *DB) SeedFilterRules() error {
+	godotenv.Load()
+	configured := os.Getenv("FILTER_WORDS")
+	if configured == "" {
+		configured = "kerfuffle,sharbert,fornax"
+	}
+	return db.update(func(structure *DBStructure) error {
+		if !structure.FilterSeeded {
+			structure.FilterSeeded = true
+			for _, entry := range strings.Split(configured, ",") {
+				pattern, action, found := strings.Cut(strings.TrimSpace(entry), ":")
+				if !found {
+					action = FilterMask
+				}
+				rule := FilterRule{Pattern: strings.TrimSpace(pattern), Action: action}
+				err := validateFilterRule(rule)
+				if err != nil {
+					fmt.Printf("Skipping filter rule %q: %s\n", entry, err)
+					continue
+				}
+				addFilterRule(structure, rule)
+			}
+		}
+		filter.load(*structure)
+		return nil
+	})
+}
+
+func addFilterRule(structure *DBStructure, rule FilterRule) FilterRule {
+	rule.ID = 0
+	for id := range structure.FilterRules {
+		rule.ID = max(rule.ID, id)
+	}
+	rule.ID++
+	rule.CreatedAt = time.Now().UTC()
+	structure.FilterRules[rule.ID] = rule
+	return rule
+}
+
+func (db *DB) GetFilterRules() ([]FilterRule, error) {
+	rules := make([]FilterRule, 0)
+	dbs, err := db.loadDB()
+	if err != nil {
+		return rules, err
+	}
+	for _, rule := range dbs.FilterRules {
+		rules = append(rules, rule)
+	}
+	sort.Slice(rules, func(i, j int) bool { return rules[i].ID < rules[j].ID })
+	return rules, nil
+}
+
+func (db *DB) CreateFilterRule(rule FilterRule) (FilterRule, error) {
+	err := validateFilterRule(rule)
+	if err != nil {
+		return FilterRule{}, err
+	}
+	err = db.update(func(structure *DBStructure) error {
+		rule = addFilterRule(structure, rule)
+		filter.load(*structure)
+		return nil
+	})
+	return rule, err
+}
+
+func (db *DB) UpdateFilterRule(id int, fn func(rule *FilterRule)) (FilterRule, error) {
+	var rule FilterRule
+	err := db.update(func(structure *DBStructure) error {
+		var ok bool
+		rule, ok = structure.FilterRules[id]
+		if !ok {
+			return errNotFound
+		}
+		fn(&rule)
+		err := validateFilterRule(rule)
+		if err != nil {
+			return err
+		}
+		structure.FilterRules[id] = rule
+		filter.load(*structure)
+		return nil
+	})
+	return rule, err
+}
+
+func (db *DB) DeleteFilterRule(id int) error {
+	return db.update(func(structure *DBStructure) error {
+		if _, ok := structure.FilterRules[id]; !ok {
+			return errNotFound
+		}
+		delete(structure.FilterRules, id)
+		filter.load(*structure)
+		return nil
+	})
+}
+
+// FlaggedChirp is a chirp that matched a flag rule, waiting for review.
+type FlaggedChirp struct {
+	Chirp   Chirp `json:"chirp"`
+	RuleIDs []int `json:"rule_ids"`
+}
+
+func (db *DB) GetFlaggedChirps() ([]FlaggedChirp, error) {
+	flagged := make([]FlaggedChirp, 0)
+	dbs, err := db.loadDB()
+	if err != nil {
+		return flagged, err
+	}
+	for id, rules := range dbs.FlaggedChirps {
+		if chirp, ok := dbs.Chirps[id]; ok && !chirp.Deleted {
+			flagged = append(flagged, FlaggedChirp{Chirp: chirp, RuleIDs: rules})
+		}
+	}
+	sort.Slice(flagged, func(i, j int) bool { return flagged[i].Chirp.ID > flagged[j].Chirp.ID })
+	return flagged, nil
+}
+
+// requireAdmin checks that the request comes from an admin, one of the
+// users whose email is listed in ADMIN_EMAILS, writing an error response if
+// not.
+func requireAdmin(w http.ResponseWriter, r *http.Request) (bool, int) {
+	validity, userID := IsJWTValid(w, r)
+	if !validity {
+		return false, 0
+	}
+	chirpdb, err := NewDB("database.json")
+	if err != nil {
+		fmt.Println(err)
+	}
+	user, err := chirpdb.GetUser(userID)
+	if err != nil || !isAdmin(user) {
+		respondWithError(w, 403, "Admins only")
+		return false, 0
+	}
+	return true, userID
+}
+
+func isAdmin(user User) bool {
+	godotenv.Load()
+	for _, email := range strings.Split(os.Getenv("ADMIN_EMAILS"), ",") {
+		email = strings.TrimSpace(email)
+		if email != "" && strings.EqualFold(email, user.Email) {
+			return true
+		}
+	}
+	return false
+}
+
+func filterRulesHandler(w http.ResponseWriter, r *http.Request) {
+	validity, adminID := requireAdmin(w, r)
+	if !validity {
+		return
+	}
+
+	chirpdb, err := NewDB("database.json")
+	if err != nil {
+		fmt.Println(err)
+	}
+
+	if r.Method == "GET" {
+		rules, err := chirpdb.GetFilterRules()
+		if err != nil {
+			respondWithError(w, 500, fmt.Sprintf("Couldn't load rules: %s", err))
+			return
+		}
+		respondWithJSON(w, http.StatusOK, rules)
+		return
+	}
+
+	type parameters struct {
+		Pattern string `json:"pattern"`
+		Action  string `json:"action"`
+	}
+	params := parameters{}
+	decoder := json.NewDecoder(r.Body)
+	err = decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, 400, fmt.Sprintf("Error decoding parameters: %s", err))
+		return
+	}
+	if params.Action == "" {
+		params.Action = FilterMask
+	}
+	rule, err := chirpdb.CreateFilterRule(FilterRule{
+		Pattern:   strings.TrimSpace(params.Pattern),
+		Action:    params.Action,
+		CreatedBy: adminID,
+	})
+	if err != nil {
+		respondWithError(w, 400, fmt.Sprintf("Couldn't add rule: %s", err))
+		return
+	}
+	respondWithJSON(w, 201, rule)
+}
+
+func filterRuleHandler(w http.ResponseWriter, r *http.Request) {
+	validity, _ := requireAdmin(w, r)
+	if !validity {
+		return
+	}
+
+	pathVal := r.PathValue("id")
+	ruleID, err := strconv.Atoi(pathVal)
+	if err != nil {
+		respondWithError(w, 400, fmt.Sprintf("Cannot convert %s to integer", pathVal))
+		return
+	}
+
+	chirpdb, err := NewDB("database.json")
+	if err != nil {
+		fmt.Println(err)
+	}
+
+	if r.Method == "DELETE" {
+		err = chirpdb.DeleteFilterRule(ruleID)
+		if err != nil {
+			respondWithError(w, 404, fmt.Sprintf("Couldn't delete rule: %s", err))
+			return
+		}
+		respondWithJSON(w, 204, "")
+		return
+	}
+
+	type parameters struct {
+		Pattern *string `json:"pattern"`
+		Action  *string `json:"action"`
+	}
+	params := parameters{}
+	decoder := json.NewDecoder(r.Body)
+	err = decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, 400, fmt.Sprintf("Error decoding parameters: %s", err))
+		return
+	}
+	rule, err := chirpdb.UpdateFilterRule(ruleID, func(rule *FilterRule) {
+		if params.Pattern != nil {
+			rule.Pattern = strings.TrimSpace(*params.Pattern)
+		}
+		if params.Action != nil {
+			rule.Action = *params.Action
+		}
+	})
+	if errors.Is(err, errNotFound) {
+		respondWithError(w, 404, "Rule does not exist")
+		return
+	} else if err != nil {
+		respondWithError(w, 400, fmt.Sprintf("Couldn't update rule: %s", err))
+		return
+	}
+	respondWithJSON(w, http.StatusOK, rule)
+}
+
+func flaggedChirpsHandler(w http.ResponseWriter, r *http.Request) {
+	validity, _ := requireAdmin(w, r)
+	if !validity {
+		return
+	}
+
+	chirpdb, err := NewDB("database.json")
+	if err != nil {
+		fmt.Println(err)
+	}
+
+	flagged, err := chirpdb.GetFlaggedChirps()
+	if err != nil {
+		respondWithError(w, 500, fmt.Sprintf("Couldn't load flagged chirps: %s", err))
+		return
+	}
+	respondWithJSON(w, http.StatusOK, flagged)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func testFilter(rules ...FilterRule) *contentFilter {
+	structure := DBStructure{FilterRules: make(map[int]FilterRule)}
+	for i, rule := range rules {
+		rule.ID = i + 1
+		structure.FilterRules[rule.ID] = rule
+	}
+	f := &contentFilter{}
+	f.load(structure)
+	return f
+}
+
+func TestFilterMask(t *testing.T) {
+	f := testFilter(
+		FilterRule{Pattern: "ass", Action: FilterMask},
+		FilterRule{Pattern: "butt", Action: FilterMask},
+		FilterRule{Pattern: "fornax", Action: FilterMask},
+		FilterRule{Pattern: "sharp knife", Action: FilterMask},
+	)
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"plain", "what an ass", "what an ****"},
+		{"case", "What an ASS!", "What an ****!"},
+		{"leetspeak", "what an a$$", "what an ****"},
+		{"leet digits", "what an a55", "what an ****"},
+		{"stretched", "what an aaass", "what an ****"},
+		{"stretched rule", "fooorrrnax", "****"},
+		{"lookalikes", "f\u043ern\u0430\u0445", "****"},
+		{"invisible", "for\u200bnax", "****"},
+		{"fullwidth", "ｆｏｒｎａｘ", "****"},
+		{"phrase", "a sharp  knife here", "a **** here"},
+		{"short run", "as it is", "as it is"},
+		{"short run in word", "but why", "but why"},
+		{"inside longer word", "class assignment", "class assignment"},
+		{"bare number", "route 455", "route 455"},
+		{"phrase split", "sharp, not a knife", "sharp, not a knife"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := f.Mask(tt.in); got != tt.want {
+				t.Errorf("Mask(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFilterApply(t *testing.T) {
+	f := testFilter(
+		FilterRule{Pattern: "ass", Action: FilterReject},
+		FilterRule{Pattern: "sharbert", Action: FilterFlag},
+		FilterRule{Pattern: "kerfuffle", Action: FilterMask},
+	)
+	tests := []struct {
+		name    string
+		in      string
+		want    string
+		flagged []int
+		err     error
+	}{
+		{"clean", "hello there", "hello there", nil, nil},
+		{"reject", "you a$$", "", nil, errChirpRejected},
+		{"no false reject", "as good as new", "as good as new", nil, nil},
+		{"flag", "sharbert time", "sharbert time", []int{2}, nil},
+		{"mask and flag", "kerfuffle sharbert", "**** sharbert", []int{2}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, flagged, err := f.Apply(tt.in)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("Apply(%q) error = %v, want %v", tt.in, err, tt.err)
+			}
+			if err != nil {
+				return
+			}
+			if got != tt.want {
+				t.Errorf("Apply(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+			if len(flagged) != len(tt.flagged) || (len(flagged) > 0 && flagged[0] != tt.flagged[0]) {
+				t.Errorf("Apply(%q) flagged %v, want %v", tt.in, flagged, tt.flagged)
+			}
+		})
+	}
+}
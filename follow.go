@@ -0,0 +1,305 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Follow edges are kept as sorted adjacency lists in both directions so
+// followers, following and the home timeline never have to scan every edge.
+
+func addEdge[K comparable](edges map[K][]int, from K, to int) {
+	list := edges[from]
+	i, found := slices.BinarySearch(list, to)
+	if !found {
+		edges[from] = slices.Insert(list, i, to)
+	}
+}
+
+func removeEdge[K comparable](edges map[K][]int, from K, to int) {
+	list := edges[from]
+	i, found := slices.BinarySearch(list, to)
+	if found {
+		list = slices.Delete(list, i, i+1)
+	}
+	if len(list) == 0 {
+		delete(edges, from)
+	} else {
+		edges[from] = list
+	}
+}
+
+func hasEdge(edges map[int][]int, from, to int) bool {
+	_, found := slices.BinarySearch(edges[from], to)
+	return found
+}
+
+func (db *DB) FollowUser(followerID, followeeID int) error {
+	if followerID == followeeID {
+		return errors.New("users cannot follow themselves")
+	}
+	already := false
+	err := db.update(func(structure *DBStructure) error {
+		if _, ok := structure.Users[followeeID]; !ok {
+			return errNotFound
+		}
+		if blocked(*structure, followerID, followeeID) {
+			return errBlocked
+		}
+		already = hasEdge(structure.Following, followerID, followeeID)
+		addEdge(structure.Following, followerID, followeeID)
+		addEdge(structure.Followers, followeeID, followerID)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("User %v followed %v\n", followerID, followeeID)
+	if !already {
+		bus.Publish(Event{Type: EventUserFollowed, ActorID: followerID, UserID: followeeID})
+	}
+	return nil
+}
+
+func (db *DB) UnfollowUser(followerID, followeeID int) error {
+	err := db.update(func(structure *DBStructure) error {
+		removeEdge(structure.Following, followerID, followeeID)
+		removeEdge(structure.Followers, followeeID, followerID)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("User %v unfollowed %v\n", followerID, followeeID)
+	bus.Publish(Event{Type: EventUserUnfollowed, ActorID: followerID, UserID: followeeID})
+	return nil
+}
+
+func (db *DB) IsFollowing(followerID, followeeID int) (bool, error) {
+	dbs, err := db.loadDB()
+	if err != nil {
+		return false, err
+	}
+	return hasEdge(dbs.Following, followerID, followeeID), nil
+}
+
+func (db *DB) GetFollowers(userID int) ([]User, error) {
+	return db.getUsersByEdge(userID, func(dbs DBStructure) []int { return dbs.Followers[userID] })
+}
+
+func (db *DB) GetFollowing(userID int) ([]User, error) {
+	return db.getUsersByEdge(userID, func(dbs DBStructure) []int { return dbs.Following[userID] })
+}
+
+func (db *DB) getUsersByEdge(userID int, edges func(DBStructure) []int) ([]User, error) {
+	users := make([]User, 0)
+	dbs, err := db.loadDB()
+	if err != nil {
+		return users, err
+	}
+	if _, ok := dbs.Users[userID]; !ok {
+		return users, errNotFound
+	}
+	for _, id := range edges(dbs) {
+		if user, ok := dbs.Users[id]; ok {
+			users = append(users, user)
+		}
+	}
+	return users, nil
+}
+
+// GetTimeline returns up to limit chirps written by users that userID
+// follows, newest first, starting below the chirp ID before (0 for the
+// newest). The second return value is the ID to continue from, or 0 when
+// there are no more chirps.
+func (db *DB) GetTimeline(userID, before, limit int) ([]Chirp, int, error) {
+	dbs, err := db.loadDB()
+	if err != nil {
+		return make([]Chirp, 0), 0, err
+	}
+	// merge the followed authors' chirp lists newest first, always taking
+	// the newest remaining head, rather than scanning every chirp
+	heads := make([][]int, 0, len(dbs.Following[userID]))
+	for _, authorID := range dbs.Following[userID] {
+		ids := dbs.AuthorChirps[authorID]
+		if before > 0 {
+			i, _ := slices.BinarySearch(ids, before)
+			ids = ids[:i]
+		}
+		if len(ids) > 0 {
+			heads = append(heads, ids)
+		}
+	}
+	chirps := make([]Chirp, 0, limit)
+	now := time.Now()
+	for len(heads) > 0 {
+		newest := 0
+		for i, ids := range heads {
+			if ids[len(ids)-1] > heads[newest][len(heads[newest])-1] {
+				newest = i
+			}
+		}
+		ids := heads[newest]
+		id := ids[len(ids)-1]
+		if len(ids) == 1 {
+			heads = slices.Delete(heads, newest, newest+1)
+		} else {
+			heads[newest] = ids[:len(ids)-1]
+		}
+		chirp, ok := dbs.Chirps[id]
+		if !ok || chirp.Deleted || !canView(dbs, chirp, userID) || muted(dbs, chirp, userID, now) {
+			continue
+		}
+		if len(chirps) == limit {
+			return chirps, chirps[len(chirps)-1].ID, nil
+		}
+		chirps = append(chirps, viewChirp(dbs, chirp, userID))
+	}
+	return chirps, 0, nil
+}
+
+// rebuildAuthorChirps indexes every chirp by its author from scratch, so
+// chirps written before the index existed still reach timelines.
+func (db *DB) rebuildAuthorChirps() error {
+	return db.update(func(structure *DBStructure) error {
+		structure.AuthorChirps = make(map[int][]int)
+		for _, chirp := range structure.Chirps {
+			if !chirp.Deleted {
+				addEdge(structure.AuthorChirps, chirp.AuthorID, chirp.ID)
+			}
+		}
+		return nil
+	})
+}
+
+type followUserVals struct {
+	ID     int    `json:"id"`
+	Handle string `json:"handle"`
+}
+
+func followHandler(w http.ResponseWriter, r *http.Request) {
+	validity, userID := IsJWTValid(w, r)
+	if !validity {
+		return
+	}
+
+	pathVal := r.PathValue("id")
+	followeeID, err := strconv.Atoi(pathVal)
+	if err != nil {
+		respondWithError(w, 400, fmt.Sprintf("Cannot convert %s to integer", pathVal))
+		return
+	}
+
+	chirpdb, err := NewDB("database.json")
+	if err != nil {
+		fmt.Println(err)
+	}
+
+	if r.Method == "POST" {
+		if followeeID == userID {
+			respondWithError(w, 400, "You can't follow yourself")
+			return
+		}
+		err = chirpdb.FollowUser(userID, followeeID)
+		if errors.Is(err, errBlocked) {
+			respondWithError(w, 403, err.Error())
+			return
+		} else if err != nil {
+			respondWithError(w, 404, fmt.Sprintf("Couldn't follow user: %s", err))
+			return
+		}
+	} else {
+		err = chirpdb.UnfollowUser(userID, followeeID)
+		if err != nil {
+			respondWithError(w, 500, fmt.Sprintf("Couldn't unfollow user: %s", err))
+			return
+		}
+	}
+
+	respondWithJSON(w, 204, "")
+}
+
+func followListHandler(w http.ResponseWriter, r *http.Request) {
+	type returnVals struct {
+		Count int              `json:"count"`
+		Users []followUserVals `json:"users"`
+	}
+
+	pathVal := r.PathValue("id")
+	userID, err := strconv.Atoi(pathVal)
+	if err != nil {
+		respondWithError(w, 400, fmt.Sprintf("Cannot convert %s to integer", pathVal))
+		return
+	}
+
+	chirpdb, err := NewDB("database.json")
+	if err != nil {
+		fmt.Println(err)
+	}
+
+	var users []User
+	if strings.HasSuffix(r.URL.Path, "/followers") {
+		users, err = chirpdb.GetFollowers(userID)
+	} else {
+		users, err = chirpdb.GetFollowing(userID)
+	}
+	if err != nil {
+		respondWithError(w, 404, fmt.Sprintf("User does not exist: %s", err))
+		return
+	}
+
+	retVals := returnVals{
+		Count: len(users),
+		Users: make([]followUserVals, 0, len(users)),
+	}
+	for _, user := range users {
+		retVals.Users = append(retVals.Users, followUserVals{ID: user.ID, Handle: user.Handle})
+	}
+	respondWithJSON(w, http.StatusOK, retVals)
+}
+
+func timelineHandler(w http.ResponseWriter, r *http.Request) {
+	type returnVals struct {
+		Chirps     []Chirp `json:"chirps"`
+		NextCursor string  `json:"next_cursor,omitempty"`
+	}
+
+	validity, userID := IsJWTValid(w, r)
+	if !validity {
+		return
+	}
+
+	limit, err := parseLimit(r.URL.Query().Get("limit"))
+	if err != nil {
+		respondWithError(w, 400, err.Error())
+		return
+	}
+	before, err := decodeCursor(r.URL.Query().Get("cursor"))
+	if err != nil {
+		respondWithError(w, 400, err.Error())
+		return
+	}
+
+	chirpdb, err := NewDB("database.json")
+	if err != nil {
+		fmt.Println(err)
+	}
+
+	chirps, next, err := chirpdb.GetTimeline(userID, before, limit)
+	if err != nil {
+		respondWithError(w, 500, fmt.Sprintf("Couldn't load timeline: %s", err))
+		return
+	}
+	for i := range chirps {
+		chirps[i].Body = cleanupBadWords(chirps[i].Body)
+	}
+	respondWithJSON(w, http.StatusOK, returnVals{
+		Chirps:     chirps,
+		NextCursor: encodeCursor(next),
+	})
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestGetTimeline(t *testing.T) {
+	db, err := NewDB(filepath.Join(t.TempDir(), "database.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.update(func(structure *DBStructure) error {
+		for id := 1; id <= 4; id++ {
+			structure.Users[id] = User{ID: id}
+		}
+		// chirps 1-8, by authors 2, 3 and 4 in turn
+		for i := 0; i < 8; i++ {
+			_, err := createChirp(structure, Chirp{AuthorID: i%3 + 2, Body: "chirp"})
+			if err != nil {
+				return err
+			}
+		}
+		addEdge(structure.Following, 1, 2)
+		addEdge(structure.Following, 1, 3)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.DeleteChirp(5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		user   int
+		before int
+		limit  int
+		want   []int
+		next   int
+	}{
+		{"merged newest first", 1, 0, 10, []int{8, 7, 4, 2, 1}, 0},
+		{"first page", 1, 0, 2, []int{8, 7}, 7},
+		{"next page", 1, 7, 2, []int{4, 2}, 2},
+		{"last page", 1, 2, 2, []int{1}, 0},
+		{"follows nobody", 4, 0, 10, []int{}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chirps, next, err := db.GetTimeline(tt.user, tt.before, tt.limit)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := chirpIDs(chirps); !reflect.DeepEqual(got, tt.want) || next != tt.next {
+				t.Errorf("GetTimeline = %v next %d, want %v next %d", got, next, tt.want, tt.next)
+			}
+		})
+	}
+}
+
+func TestGetTimelineBeforeAuthorIndex(t *testing.T) {
+	// a database written before chirps were indexed by author
+	path := filepath.Join(t.TempDir(), "database.json")
+	err := os.WriteFile(path, []byte(`{
+		"chirps": {
+			"1": {"id": 1, "body": "old chirp", "author_id": 2},
+			"2": {"id": 2, "body": "", "author_id": 2, "deleted": true},
+			"3": {"id": 3, "body": "another old chirp", "author_id": 2}
+		},
+		"users": {"1": {"id": 1}, "2": {"id": 2}},
+		"following": {"1": [2]},
+		"followers": {"2": [1]}
+	}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := NewDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chirps, _, err := db.GetTimeline(1, 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := chirpIDs(chirps); !reflect.DeepEqual(got, []int{3, 1}) {
+		t.Errorf("GetTimeline = %v, want [3 1]", got)
+	}
+}
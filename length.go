@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// maxChirpLength is the longest chirp a user may post, in the units
+// chirpLength counts. Chirpy Red subscribers get longer chirps.
+func maxChirpLength(user User) int {
+	if user.IsChirpyRed {
+		return envInt("CHIRP_MAX_LENGTH_RED", 280)
+	}
+	return envInt("CHIRP_MAX_LENGTH", 140)
+}
+
+// validateChirpBody runs the checks every chirp body must pass before it is
+// stored, whether it is posted, edited or published from a draft.
+func validateChirpBody(body string, author User) error {
+	length, limit := chirpLength(body), maxChirpLength(author)
+	if length > limit {
+		return fmt.Errorf("Chirp is too long: %d characters, the limit is %d", length, limit)
+	}
+	return nil
+}
+
+var urlPattern = regexp.MustCompile(`(?i)\b(?:https?://|www\.)\S+`)
+
+// chirpLength counts a chirp the way people read it: one per character as
+// they see it (an emoji with skin tone, a flag or an accented letter made
+// of several code points is one), and a fixed CHIRP_URL_LENGTH for every
+// link however long it is.
+func chirpLength(body string) int {
+	urlLength := envInt("CHIRP_URL_LENGTH", 23)
+	length, last := 0, 0
+	for _, loc := range urlPattern.FindAllStringIndex(body, -1) {
+		url := strings.TrimRight(body[loc[0]:loc[1]], ".,:;!?'\")]}")
+		if strings.HasSuffix(url, "://") {
+			// just a scheme, not a link
+			continue
+		}
+		length += graphemeCount(body[last:loc[0]]) + urlLength
+		last = loc[0] + len(url)
+	}
+	return length + graphemeCount(body[last:])
+}
+
+// graphemeCount counts extended grapheme clusters, following the rules of
+// Unicode Standard Annex #29 closely enough for chirp lengths: combining
+// marks, variation selectors, emoji modifiers and tags join the character
+// before them; emoji joined by ZWJ, pairs of regional indicators (flags),
+// Hangul syllable sequences and CR LF each count once.
+func graphemeCount(s string) int {
+	count := 0
+	var prev rune
+	pictographic := false // the current cluster contains an emoji
+	regional := 0         // regional indicators in the current cluster
+	for i, r := range s {
+		if i == 0 || !joinsCluster(prev, r, pictographic, regional) {
+			count++
+			pictographic = false
+			regional = 0
+		}
+		if isPictographic(r) {
+			pictographic = true
+		}
+		if isRegionalIndicator(r) {
+			regional++
+		}
+		prev = r
+	}
+	return count
+}
+
+func joinsCluster(prev, r rune, pictographic bool, regional int) bool {
+	switch {
+	case prev == '\r' && r == '\n':
+		return true
+	case prev == '\r' || prev == '\n' || r == '\r' || r == '\n':
+		return false
+	case isGraphemeExtend(r) || r == '\u200D':
+		return true
+	case prev == '\u200D' && pictographic && isPictographic(r):
+		return true
+	case isRegionalIndicator(prev) && isRegionalIndicator(r):
+		return regional%2 == 1
+	}
+	return joinsHangul(prev, r)
+}
+
+func isGraphemeExtend(r rune) bool {
+	return unicode.In(r, unicode.Mn, unicode.Me, unicode.Mc) ||
+		(r >= 0x1F3FB && r <= 0x1F3FF) || // emoji skin tones
+		(r >= 0xE0020 && r <= 0xE007F) // tags, used in subdivision flags
+}
+
+func isRegionalIndicator(r rune) bool {
+	return r >= 0x1F1E6 && r <= 0x1F1FF
+}
+
+func isPictographic(r rune) bool {
+	return (r >= 0x1F000 && r <= 0x1FAFF) ||
+		(r >= 0x2600 && r <= 0x27BF) ||
+		(r >= 0x2300 && r <= 0x23FF) ||
+		(r >= 0x2B00 && r <= 0x2BFF) ||
+		r == 0x00A9 || r == 0x00AE || r == 0x203C || r == 0x2049 || r == 0x2122
+}
+
+// Hangul syllable types, for joinsHangul.
+const (
+	hangulNone = iota
+	hangulL
+	hangulV
+	hangulT
+	hangulLV
+	hangulLVT
+)
+
+func hangulType(r rune) int {
+	switch {
+	case (r >= 0x1100 && r <= 0x115F) || (r >= 0xA960 && r <= 0xA97C):
+		return hangulL
+	case (r >= 0x1160 && r <= 0x11A7) || (r >= 0xD7B0 && r <= 0xD7C6):
+		return hangulV
+	case (r >= 0x11A8 && r <= 0x11FF) || (r >= 0xD7CB && r <= 0xD7FB):
+		return hangulT
+	case r >= 0xAC00 && r <= 0xD7A3:
+		if (r-0xAC00)%28 == 0 {
+			return hangulLV
+		}
+		return hangulLVT
+	}
+	return hangulNone
+}
+
+func joinsHangul(prev, r rune) bool {
+	p, c := hangulType(prev), hangulType(r)
+	switch p {
+	case hangulL:
+		return c == hangulL || c == hangulV || c == hangulLV || c == hangulLVT
+	case hangulLV, hangulV:
+		return c == hangulV || c == hangulT
+	case hangulLVT, hangulT:
+		return c == hangulT
+	}
+	return false
+}
@@ -0,0 +1,52 @@
+package main
+
+import "testing"
+
+func TestChirpLength(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want int
+	}{
+		{"empty", "", 0},
+		{"ascii", "hello", 5},
+		{"precomposed accent", "café", 4},
+		{"combining accent", "cafe\u0301", 4},
+		{"skin tone", "\U0001F44D\U0001F3FD", 1},
+		{"zwj family", "\U0001F468\u200d\U0001F469\u200d\U0001F467", 1},
+		{"two flags", "\U0001F1FA\U0001F1F8\U0001F1EC\U0001F1E7", 2},
+		{"odd regional indicator", "\U0001F1FA\U0001F1F8\U0001F1EC", 2},
+		{"subdivision flag", "\U0001F3F4\U000E0067\U000E0062\U000E0065\U000E006E\U000E0067\U000E007F", 1},
+		{"crlf", "a\r\nb", 3},
+		{"hangul jamo", "\u1100\u1161\u11a8", 1},
+		{"hangul syllables", "한글", 2},
+		{"link", "see https://example.com/a/very/long/path/indeed", 4 + 23},
+		{"link with trailing punctuation", "(https://example.com).", 1 + 23 + 2},
+		{"www link", "www.example.com", 23},
+		{"bare scheme", "https://", 8},
+		{"two links", "http://a.co http://b.co", 23 + 1 + 23},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := chirpLength(tt.body); got != tt.want {
+				t.Errorf("chirpLength(%q) = %d, want %d", tt.body, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateChirpBody(t *testing.T) {
+	long := make([]byte, 141)
+	for i := range long {
+		long[i] = 'a'
+	}
+	if err := validateChirpBody(string(long[:140]), User{}); err != nil {
+		t.Errorf("140 characters: %s", err)
+	}
+	if err := validateChirpBody(string(long), User{}); err == nil {
+		t.Error("141 characters was accepted")
+	}
+	if err := validateChirpBody(string(long), User{IsChirpyRed: true}); err != nil {
+		t.Errorf("141 characters for a Red user: %s", err)
+	}
+}
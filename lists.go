@@ -0,0 +1,448 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	maxListNameLen        = 25
+	maxListDescriptionLen = 100
+	maxListMembers        = 500
+)
+
+// List is a named set of users curated by its owner, with its own
+// timeline. Private lists are only visible to the owner. Members are kept
+// in DBStructure.ListMembers as a sorted adjacency list, like follows.
+type List struct {
+	ID          int       `json:"id"`
+	OwnerID     int       `json:"owner_id"`
+	Name        string    `json:"name"`
+	Description string    `json:"description,omitempty"`
+	Private     bool      `json:"private"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+	// MemberCount is filled in on the way out.
+	MemberCount int `json:"member_count"`
+}
+
+func (list *List) validate() error {
+	list.Name = strings.TrimSpace(list.Name)
+	list.Description = strings.TrimSpace(list.Description)
+	if list.Name == "" {
+		return errors.New("a list needs a name")
+	}
+	if utf8.RuneCountInString(list.Name) > maxListNameLen {
+		return fmt.Errorf("list names can be at most %d characters", maxListNameLen)
+	}
+	if utf8.RuneCountInString(list.Description) > maxListDescriptionLen {
+		return fmt.Errorf("list descriptions can be at most %d characters", maxListDescriptionLen)
+	}
+	return nil
+}
+
+// visibleList returns a list if viewerID may see it.
+func visibleList(dbs DBStructure, listID, viewerID int) (List, bool) {
+	list, ok := dbs.Lists[listID]
+	if !ok || (list.Private && list.OwnerID != viewerID) {
+		return List{}, false
+	}
+	list.MemberCount = len(dbs.ListMembers[listID])
+	return list, true
+}
+
+func (db *DB) CreateList(list List) (List, error) {
+	err := list.validate()
+	if err != nil {
+		return List{}, err
+	}
+	err = db.update(func(structure *DBStructure) error {
+		list.ID = 0
+		for id := range structure.Lists {
+			list.ID = max(list.ID, id)
+		}
+		list.ID++
+		list.CreatedAt = time.Now().UTC()
+		list.UpdatedAt = list.CreatedAt
+		list.MemberCount = 0
+		structure.Lists[list.ID] = list
+		return nil
+	})
+	if err != nil {
+		return List{}, err
+	}
+	fmt.Printf("Added list id %v for user %v\n", list.ID, list.OwnerID)
+	return list, nil
+}
+
+func (db *DB) GetList(listID, viewerID int) (List, error) {
+	dbs, err := db.loadDB()
+	if err != nil {
+		return List{}, err
+	}
+	list, ok := visibleList(dbs, listID, viewerID)
+	if !ok {
+		return List{}, errNotFound
+	}
+	return list, nil
+}
+
+// GetUserLists returns the lists ownerID has made that viewerID may see,
+// oldest first.
+func (db *DB) GetUserLists(ownerID, viewerID int) ([]List, error) {
+	lists := make([]List, 0)
+	dbs, err := db.loadDB()
+	if err != nil {
+		return lists, err
+	}
+	if _, ok := dbs.Users[ownerID]; !ok {
+		return lists, errNotFound
+	}
+	for id, list := range dbs.Lists {
+		if list.OwnerID != ownerID {
+			continue
+		}
+		if list, ok := visibleList(dbs, id, viewerID); ok {
+			lists = append(lists, list)
+		}
+	}
+	sort.Slice(lists, func(i, j int) bool { return lists[i].ID < lists[j].ID })
+	return lists, nil
+}
+
+func (db *DB) UpdateList(list List) (List, error) {
+	err := list.validate()
+	if err != nil {
+		return List{}, err
+	}
+	err = db.update(func(structure *DBStructure) error {
+		old, ok := structure.Lists[list.ID]
+		if !ok {
+			return errNotFound
+		}
+		list.OwnerID = old.OwnerID
+		list.CreatedAt = old.CreatedAt
+		list.UpdatedAt = time.Now().UTC()
+		list.MemberCount = 0
+		structure.Lists[list.ID] = list
+		list.MemberCount = len(structure.ListMembers[list.ID])
+		return nil
+	})
+	return list, err
+}
+
+func (db *DB) DeleteList(listID int) error {
+	return db.update(func(structure *DBStructure) error {
+		if _, ok := structure.Lists[listID]; !ok {
+			return errNotFound
+		}
+		delete(structure.Lists, listID)
+		delete(structure.ListMembers, listID)
+		return nil
+	})
+}
+
+func (db *DB) AddListMember(listID, userID int) error {
+	return db.update(func(structure *DBStructure) error {
+		if _, ok := structure.Lists[listID]; !ok {
+			return errNotFound
+		}
+		if _, ok := structure.Users[userID]; !ok {
+			return errUserNotFound
+		}
+		if len(structure.ListMembers[listID]) >= maxListMembers && !hasEdge(structure.ListMembers, listID, userID) {
+			return fmt.Errorf("a list can have at most %d members", maxListMembers)
+		}
+		addEdge(structure.ListMembers, listID, userID)
+		return nil
+	})
+}
+
+func (db *DB) RemoveListMember(listID, userID int) error {
+	return db.update(func(structure *DBStructure) error {
+		if _, ok := structure.Lists[listID]; !ok {
+			return errNotFound
+		}
+		removeEdge(structure.ListMembers, listID, userID)
+		return nil
+	})
+}
+
+func (db *DB) GetListMembers(listID, viewerID int) ([]User, error) {
+	users := make([]User, 0)
+	dbs, err := db.loadDB()
+	if err != nil {
+		return users, err
+	}
+	if _, ok := visibleList(dbs, listID, viewerID); !ok {
+		return users, errNotFound
+	}
+	for _, id := range dbs.ListMembers[listID] {
+		if user, ok := dbs.Users[id]; ok {
+			users = append(users, user)
+		}
+	}
+	return users, nil
+}
+
+// GetListTimeline returns chirps by the members of a list, newest first,
+// paginated like the home timeline.
+func (db *DB) GetListTimeline(listID, viewerID, before, limit int) ([]Chirp, int, error) {
+	dbs, err := db.loadDB()
+	if err != nil {
+		return make([]Chirp, 0), 0, err
+	}
+	if _, ok := visibleList(dbs, listID, viewerID); !ok {
+		return make([]Chirp, 0), 0, errNotFound
+	}
+	members := dbs.ListMembers[listID]
+	if len(members) == 0 {
+		return make([]Chirp, 0), 0, nil
+	}
+	chirps, next := queryChirps(dbs, ChirpQuery{
+		ViewerID:  viewerID,
+		AuthorIDs: members,
+		Desc:      true,
+		Cursor:    before,
+		Limit:     limit,
+		HideMuted: true,
+	})
+	return chirps, next, nil
+}
+
+// ownedList loads the list in the request path and checks that userID owns
+// it, writing an error response if not.
+func ownedList(w http.ResponseWriter, r *http.Request, chirpdb *DB, userID int) (List, bool) {
+	pathVal := r.PathValue("id")
+	listID, err := strconv.Atoi(pathVal)
+	if err != nil {
+		respondWithError(w, 400, fmt.Sprintf("Cannot convert %s to integer", pathVal))
+		return List{}, false
+	}
+	list, err := chirpdb.GetList(listID, userID)
+	if err != nil {
+		respondWithError(w, 404, "List does not exist")
+		return List{}, false
+	}
+	if list.OwnerID != userID {
+		respondWithError(w, 403, "You can't change someone else's list")
+		return List{}, false
+	}
+	return list, true
+}
+
+func createListHandler(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Name        string `json:"name"`
+		Description string `json:"description"`
+		Private     bool   `json:"private"`
+	}
+
+	validity, userID := IsJWTValid(w, r)
+	if !validity {
+		return
+	}
+
+	params := parameters{}
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, 400, fmt.Sprintf("Error decoding parameters: %s", err))
+		return
+	}
+
+	chirpdb, err := NewDB("database.json")
+	if err != nil {
+		fmt.Println(err)
+	}
+
+	list, err := chirpdb.CreateList(List{
+		OwnerID:     userID,
+		Name:        params.Name,
+		Description: params.Description,
+		Private:     params.Private,
+	})
+	if err != nil {
+		respondWithError(w, 400, fmt.Sprintf("Couldn't create list: %s", err))
+		return
+	}
+	respondWithJSON(w, 201, list)
+}
+
+func listHandler(w http.ResponseWriter, r *http.Request) {
+	chirpdb, err := NewDB("database.json")
+	if err != nil {
+		fmt.Println(err)
+	}
+
+	if r.Method == "GET" {
+		pathVal := r.PathValue("id")
+		listID, err := strconv.Atoi(pathVal)
+		if err != nil {
+			respondWithError(w, 400, fmt.Sprintf("Cannot convert %s to integer", pathVal))
+			return
+		}
+		list, err := chirpdb.GetList(listID, optionalUserID(r))
+		if err != nil {
+			respondWithError(w, 404, "List does not exist")
+			return
+		}
+		respondWithJSON(w, http.StatusOK, list)
+		return
+	}
+
+	validity, userID := IsJWTValid(w, r)
+	if !validity {
+		return
+	}
+	list, ok := ownedList(w, r, chirpdb, userID)
+	if !ok {
+		return
+	}
+
+	if r.Method == "DELETE" {
+		err = chirpdb.DeleteList(list.ID)
+		if err != nil {
+			respondWithError(w, 404, fmt.Sprintf("Couldn't delete list: %s", err))
+			return
+		}
+		respondWithJSON(w, 204, "")
+		return
+	}
+
+	type parameters struct {
+		Name        *string `json:"name"`
+		Description *string `json:"description"`
+		Private     *bool   `json:"private"`
+	}
+	params := parameters{}
+	decoder := json.NewDecoder(r.Body)
+	err = decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, 400, fmt.Sprintf("Error decoding parameters: %s", err))
+		return
+	}
+	if params.Name != nil {
+		list.Name = *params.Name
+	}
+	if params.Description != nil {
+		list.Description = *params.Description
+	}
+	if params.Private != nil {
+		list.Private = *params.Private
+	}
+	list, err = chirpdb.UpdateList(list)
+	if err != nil {
+		respondWithError(w, 400, fmt.Sprintf("Couldn't update list: %s", err))
+		return
+	}
+	respondWithJSON(w, http.StatusOK, list)
+}
+
+func userListsHandler(w http.ResponseWriter, r *http.Request) {
+	pathVal := r.PathValue("id")
+	ownerID, err := strconv.Atoi(pathVal)
+	if err != nil {
+		respondWithError(w, 400, fmt.Sprintf("Cannot convert %s to integer", pathVal))
+		return
+	}
+
+	chirpdb, err := NewDB("database.json")
+	if err != nil {
+		fmt.Println(err)
+	}
+
+	lists, err := chirpdb.GetUserLists(ownerID, optionalUserID(r))
+	if err != nil {
+		respondWithError(w, 404, fmt.Sprintf("User does not exist: %s", err))
+		return
+	}
+	respondWithJSON(w, http.StatusOK, lists)
+}
+
+func listMembersHandler(w http.ResponseWriter, r *http.Request) {
+	type returnVals struct {
+		Count int              `json:"count"`
+		Users []followUserVals `json:"users"`
+	}
+
+	pathVal := r.PathValue("id")
+	listID, err := strconv.Atoi(pathVal)
+	if err != nil {
+		respondWithError(w, 400, fmt.Sprintf("Cannot convert %s to integer", pathVal))
+		return
+	}
+
+	chirpdb, err := NewDB("database.json")
+	if err != nil {
+		fmt.Println(err)
+	}
+
+	users, err := chirpdb.GetListMembers(listID, optionalUserID(r))
+	if err != nil {
+		respondWithError(w, 404, "List does not exist")
+		return
+	}
+
+	retVals := returnVals{
+		Count: len(users),
+		Users: make([]followUserVals, 0, len(users)),
+	}
+	for _, user := range users {
+		retVals.Users = append(retVals.Users, followUserVals{ID: user.ID, Handle: user.Handle})
+	}
+	respondWithJSON(w, http.StatusOK, retVals)
+}
+
+func listMemberHandler(w http.ResponseWriter, r *http.Request) {
+	validity, userID := IsJWTValid(w, r)
+	if !validity {
+		return
+	}
+
+	chirpdb, err := NewDB("database.json")
+	if err != nil {
+		fmt.Println(err)
+	}
+
+	list, ok := ownedList(w, r, chirpdb, userID)
+	if !ok {
+		return
+	}
+	pathVal := r.PathValue("user_id")
+	memberID, err := strconv.Atoi(pathVal)
+	if err != nil {
+		respondWithError(w, 400, fmt.Sprintf("Cannot convert %s to integer", pathVal))
+		return
+	}
+
+	if r.Method == "PUT" {
+		err = chirpdb.AddListMember(list.ID, memberID)
+	} else {
+		err = chirpdb.RemoveListMember(list.ID, memberID)
+	}
+	if err != nil {
+		respondWithError(w, 400, fmt.Sprintf("Couldn't change list members: %s", err))
+		return
+	}
+	respondWithJSON(w, 204, "")
+}
+
+func listTimelineHandler(w http.ResponseWriter, r *http.Request) {
+	pathVal := r.PathValue("id")
+	listID, err := strconv.Atoi(pathVal)
+	if err != nil {
+		respondWithError(w, 400, fmt.Sprintf("Cannot convert %s to integer", pathVal))
+		return
+	}
+	respondWithChirpPage(w, r, func(db *DB, viewerID, before, limit int) ([]Chirp, int, error) {
+		return db.GetListTimeline(listID, viewerID, before, limit)
+	})
+}
@@ -0,0 +1,435 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The WebSocket API at /api/ws speaks JSON. Clients send requests
+//
+//	{"id": "1", "type": "subscribe", "topic": "hashtag:golang"}
+//	{"id": "2", "type": "post", "chirp": {"body": "hello"}}
+//
+// and get back {"id": "1", "type": "ok"} or {"id": "2", "type": "error",
+// "code": 400, "error": "..."}. Topics are timeline, all, notifications,
+// hashtag:<tag> and thread:<chirp id>; matching events arrive as
+// {"type": "event", "event": "chirp_created", "topics": [...], "data": ...}.
+
+const maxWSSubscriptions = 50
+
+type wsRequest struct {
+	ID    string      `json:"id"`
+	Type  string      `json:"type"`
+	Topic string      `json:"topic"`
+	Chirp chirpParams `json:"chirp"`
+}
+
+type wsResponse struct {
+	ID     string      `json:"id,omitempty"`
+	Type   string      `json:"type"`
+	Code   int         `json:"code,omitempty"`
+	Error  string      `json:"error,omitempty"`
+	Event  string      `json:"event,omitempty"`
+	Topics []string    `json:"topics,omitempty"`
+	Data   interface{} `json:"data,omitempty"`
+}
+
+type wsClient struct {
+	userID int
+	// topics, following and relations are guarded by the hub's lock.
+	topics    map[string]bool
+	following map[int]bool
+	relations relations
+	out       chan []byte
+}
+
+// wsHub fans events from the bus out to WebSocket clients. Like the SSE
+// hub it never waits on a client: one whose queue fills is dropped.
+type wsHub struct {
+	mu       sync.Mutex
+	clients  map[*wsClient]bool
+	perUser  map[int]int
+	maxConns int
+	buffer   int
+}
+
+var liveHub = &wsHub{
+	clients:  make(map[*wsClient]bool),
+	perUser:  make(map[int]int),
+	maxConns: max(envInt("WS_MAX_CONNECTIONS_PER_USER", 5), 1),
+	buffer:   max(envInt("WS_BUFFER", 64), 1),
+}
+
+func (h *wsHub) register(c *wsClient) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.perUser[c.userID] >= h.maxConns {
+		return fmt.Errorf("at most %d connections per user", h.maxConns)
+	}
+	h.perUser[c.userID]++
+	c.out = make(chan []byte, h.buffer)
+	h.clients[c] = true
+	return nil
+}
+
+func (h *wsHub) unregister(c *wsClient) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.drop(c)
+}
+
+// drop removes a client and closes its queue, which tells its writer to
+// hang up. Callers must hold h.mu.
+func (h *wsHub) drop(c *wsClient) {
+	if !h.clients[c] {
+		return
+	}
+	delete(h.clients, c)
+	h.perUser[c.userID]--
+	if h.perUser[c.userID] == 0 {
+		delete(h.perUser, c.userID)
+	}
+	close(c.out)
+}
+
+// send queues a message for a client. Callers must hold h.mu.
+func (h *wsHub) send(c *wsClient, resp wsResponse) {
+	if !h.clients[c] {
+		return
+	}
+	data, err := json.Marshal(resp)
+	if err != nil {
+		fmt.Printf("Couldn't encode websocket message: %s\n", err)
+		return
+	}
+	select {
+	case c.out <- data:
+	default:
+		fmt.Printf("Dropping slow websocket client for user %v\n", c.userID)
+		h.drop(c)
+	}
+}
+
+func (h *wsHub) reply(c *wsClient, resp wsResponse) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.send(c, resp)
+}
+
+func (h *wsHub) replyError(c *wsClient, id string, code int, msg string) {
+	h.reply(c, wsResponse{ID: id, Type: "error", Code: code, Error: msg})
+}
+
+// Observe feeds the hub from the event bus.
+func (h *wsHub) Observe(event Event) {
+	switch event.Type {
+	case EventChirpCreated, EventChirpDeleted:
+		h.publishChirp(event)
+	case EventNotification:
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		for c := range h.clients {
+			if c.userID == event.UserID && c.topics["notifications"] {
+				h.send(c, wsResponse{Type: "event", Event: event.Type, Topics: []string{"notifications"}, Data: event.Notification})
+			}
+		}
+	case EventUserFollowed, EventUserUnfollowed:
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		for c := range h.clients {
+			if c.userID == event.ActorID {
+				c.following[event.UserID] = event.Type == EventUserFollowed
+			}
+		}
+	case EventUserBlocked, EventUserUnblocked, EventUserMuted, EventUserUnmuted:
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		for c := range h.clients {
+			c.relations.observe(c.userID, event)
+		}
+	}
+}
+
+func (h *wsHub) publishChirp(event Event) {
+	chirp := event.Chirp
+	chirp.Body = cleanupBadWords(chirp.Body)
+	var data interface{} = chirp
+	if event.Type == EventChirpDeleted {
+		data = map[string]int{"id": chirp.ID, "author_id": chirp.AuthorID}
+	}
+
+	chirpdb, err := NewDB("database.json")
+	if err != nil {
+		fmt.Println(err)
+	}
+	dbs, err := chirpdb.loadDB()
+	if err != nil {
+		fmt.Printf("Couldn't load database for websocket event: %s\n", err)
+		return
+	}
+
+	topics := []string{"all"}
+	for _, entity := range chirp.Entities {
+		if entity.Type == EntityHashtag {
+			topics = append(topics, "hashtag:"+normalizeTag(entity.Text))
+		}
+	}
+	if h.hasThreadSubscribers() {
+		topics = append(topics, threadTopics(dbs, chirp)...)
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for c := range h.clients {
+		own := chirp.AuthorID == c.userID
+		if !own && (event.Shadow || c.relations.blocks(chirp.AuthorID) || !canView(dbs, event.Chirp, c.userID)) {
+			continue
+		}
+		// like GET /api/chirps, mutes only apply to the feeds
+		hidden := !own && c.relations.muting[chirp.AuthorID]
+		var matched []string
+		if c.topics["timeline"] && !hidden && (own || c.following[chirp.AuthorID]) {
+			matched = append(matched, "timeline")
+		}
+		for _, topic := range topics {
+			if c.topics[topic] && !(hidden && topic == "all") {
+				matched = append(matched, topic)
+			}
+		}
+		if len(matched) > 0 {
+			h.send(c, wsResponse{Type: "event", Event: event.Type, Topics: matched, Data: data})
+		}
+	}
+}
+
+func (h *wsHub) hasThreadSubscribers() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for c := range h.clients {
+		for topic := range c.topics {
+			if strings.HasPrefix(topic, "thread:") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// threadTopics names the threads a chirp belongs to: its own and those of
+// every ancestor.
+func threadTopics(dbs DBStructure, chirp Chirp) []string {
+	topics := []string{"thread:" + strconv.Itoa(chirp.ID)}
+	for id := chirp.InReplyTo; id != 0; id = dbs.Chirps[id].InReplyTo {
+		topics = append(topics, "thread:"+strconv.Itoa(id))
+	}
+	return topics
+}
+
+// normalizeTopic checks a topic a client asked for and returns it in the
+// form events are matched against. A thread must be one the viewer can
+// see.
+func normalizeTopic(chirpdb *DB, topic string, viewerID int) (string, error) {
+	name, arg, _ := strings.Cut(topic, ":")
+	switch name {
+	case "timeline", "all", "notifications":
+		if arg == "" {
+			return name, nil
+		}
+	case "hashtag":
+		if tag := normalizeTag(strings.TrimPrefix(arg, "#")); tag != "" {
+			return "hashtag:" + tag, nil
+		}
+	case "thread":
+		id, err := strconv.Atoi(arg)
+		if err != nil {
+			return "", fmt.Errorf("bad thread id %s", arg)
+		}
+		dbs, err := chirpdb.loadDB()
+		if err != nil {
+			return "", err
+		}
+		chirp, ok := dbs.Chirps[id]
+		if !ok || chirp.Deleted || !canView(dbs, chirp, viewerID) {
+			return "", fmt.Errorf("chirp %v not found", id)
+		}
+		return "thread:" + strconv.Itoa(id), nil
+	}
+	return "", fmt.Errorf("unknown topic %s", topic)
+}
+
+func (h *wsHub) subscribe(c *wsClient, topic string, on bool) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if on && !c.topics[topic] && len(c.topics) >= maxWSSubscriptions {
+		return fmt.Errorf("at most %d subscriptions per connection", maxWSSubscriptions)
+	}
+	if on {
+		c.topics[topic] = true
+	} else {
+		delete(c.topics, topic)
+	}
+	return nil
+}
+
+// wsHandler upgrades GET /api/ws. The JWT is checked before the upgrade
+// and again before every post, so an expired token can still listen but
+// no longer write. Browsers can't set headers on a WebSocket, so the token
+// may come as ?access_token= instead.
+func wsHandler(w http.ResponseWriter, r *http.Request) {
+	validity, userID := IsJWTValid(w, r)
+	if !validity {
+		return
+	}
+
+	chirpdb, err := NewDB("database.json")
+	if err != nil {
+		fmt.Println(err)
+	}
+	following, err := chirpdb.GetFollowing(userID)
+	if err != nil {
+		respondWithError(w, 404, fmt.Sprintf("User does not exist: %s", err))
+		return
+	}
+	rel, err := chirpdb.GetRelations(userID)
+	if err != nil {
+		respondWithError(w, 500, fmt.Sprintf("Couldn't load blocks: %s", err))
+		return
+	}
+
+	client := &wsClient{
+		userID:    userID,
+		topics:    make(map[string]bool),
+		following: make(map[int]bool),
+		relations: rel,
+	}
+	for _, user := range following {
+		client.following[user.ID] = true
+	}
+	err = liveHub.register(client)
+	if err != nil {
+		respondWithError(w, 429, fmt.Sprintf("Too many connections: %s", err))
+		return
+	}
+	defer liveHub.unregister(client)
+
+	conn, err := wsUpgrade(w, r, envInt("WS_MAX_MESSAGE_BYTES", 16384))
+	if err != nil {
+		fmt.Printf("Websocket upgrade failed: %s\n", err)
+		return
+	}
+	defer conn.conn.Close()
+
+	// The client must answer pings (or send something) within two ping
+	// intervals or it is considered gone.
+	pingInterval := envDuration("WS_PING_INTERVAL", 30*time.Second)
+	extendDeadline := func() {
+		conn.conn.SetReadDeadline(time.Now().Add(2 * pingInterval))
+	}
+	conn.onPong = extendDeadline
+	extendDeadline()
+
+	go wsWriter(conn, client.out, pingInterval)
+
+	for {
+		message, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		extendDeadline()
+
+		req := wsRequest{}
+		err = json.Unmarshal(message, &req)
+		if err != nil {
+			liveHub.replyError(client, "", 400, fmt.Sprintf("Error decoding request: %s", err))
+			continue
+		}
+		switch req.Type {
+		case "ping":
+			liveHub.reply(client, wsResponse{ID: req.ID, Type: "pong"})
+		case "subscribe", "unsubscribe":
+			topic, err := normalizeTopic(chirpdb, req.Topic, userID)
+			if err == nil {
+				err = liveHub.subscribe(client, topic, req.Type == "subscribe")
+			}
+			if err != nil {
+				liveHub.replyError(client, req.ID, 400, err.Error())
+				continue
+			}
+			liveHub.reply(client, wsResponse{ID: req.ID, Type: "ok", Topics: []string{topic}})
+		case "post":
+			chirp, code, err := wsPost(r, chirpdb, userID, req.Chirp)
+			if err != nil {
+				liveHub.replyError(client, req.ID, code, err.Error())
+				continue
+			}
+			liveHub.reply(client, wsResponse{ID: req.ID, Type: "ok", Data: chirp})
+		default:
+			liveHub.replyError(client, req.ID, 400, fmt.Sprintf("Unknown request type %s", req.Type))
+		}
+	}
+}
+
+// wsPost creates a chirp the way chirpHandler does, returning a status code
+// to report alongside any error.
+func wsPost(r *http.Request, chirpdb *DB, userID int, params chirpParams) (Chirp, int, error) {
+	if optionalUserID(r) != userID {
+		return Chirp{}, 401, errors.New("Authorization failed: token is no longer valid")
+	}
+	// a post here counts against the same limit as POST /api/chirps
+	allowed, wait := limiter.takeUser("POST /api/chirps", userID, time.Now())
+	if !allowed {
+		return Chirp{}, 429, fmt.Errorf("Too many requests, try again in %d seconds", int(math.Ceil(wait.Seconds())))
+	}
+	user, err := chirpdb.GetUser(userID)
+	if err != nil {
+		return Chirp{}, 401, fmt.Errorf("Couldn't get user from token: %s", err)
+	}
+	newChirp, err := params.chirp(user)
+	if err != nil {
+		return Chirp{}, 400, err
+	}
+	chirp, err := chirpdb.CreateChirp(newChirp)
+	if errors.Is(err, errBlocked) {
+		return Chirp{}, 403, err
+	} else if err != nil {
+		return Chirp{}, 400, fmt.Errorf("Couldn't create chirp: %s", err)
+	}
+	chirp, err = chirpdb.ViewChirp(chirp.ID, userID)
+	if err != nil {
+		return Chirp{}, 500, err
+	}
+	chirp.Body = cleanupBadWords(chirp.Body)
+	return chirp, 0, nil
+}
+
+// wsWriter sends queued messages and pings until the queue is closed,
+// either because the client left or because it fell too far behind.
+func wsWriter(conn *wsConn, out <-chan []byte, pingInterval time.Duration) {
+	ticker := time.NewTicker(pingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case message, ok := <-out:
+			if !ok {
+				conn.Close(wsCloseTryAgainLater, "closing")
+				return
+			}
+			if conn.WriteText(message) != nil {
+				conn.conn.Close()
+				return
+			}
+		case <-ticker.C:
+			if conn.Ping() != nil {
+				conn.conn.Close()
+				return
+			}
+		}
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"io"
 	"net/http"
 	"os"
+	"time"
 )
 
 func main() {
@@ -18,6 +19,26 @@ func main() {
 		os.Remove("database.json")
 	}
 
+	chirpdb, err := NewDB("database.json")
+	if err != nil {
+		fmt.Println(err)
+	}
+	err = chirpdb.SeedFilterRules()
+	if err != nil {
+		fmt.Printf("Couldn't load filter rules: %s\n", err)
+	}
+	bus.Subscribe(trends.Observe)
+	bus.Subscribe(hub.Observe)
+	bus.Subscribe(liveHub.Observe)
+	bus.Subscribe(chirpdb.notify)
+	bus.Subscribe(limiter.Observe)
+	err = trends.Seed(chirpdb)
+	if err != nil {
+		fmt.Printf("Couldn't seed trends: %s\n", err)
+	}
+	go trends.Run(time.Minute)
+	go runScheduler(chirpdb, envDuration("SCHEDULER_INTERVAL", 15*time.Second))
+
 	apiCfg := apiConfig{
 		fileserverHits: 0,
 	}
@@ -47,9 +68,75 @@ func main() {
 	sm.HandleFunc("/api/chirps", chirpHandler)
 	sm.HandleFunc("GET /api/chirps/{id}", getChirpByID)
 	sm.HandleFunc("DELETE /api/chirps/{id}", deleteChirp)
+	sm.HandleFunc("PATCH /api/chirps/{id}", editChirpHandler)
+	sm.HandleFunc("GET /api/chirps/{id}/history", chirpHistoryHandler)
+	sm.HandleFunc("GET /api/chirps/{id}/thread", chirpThreadHandler)
+	sm.HandleFunc("POST /api/chirps/{id}/reactions", reactionHandler)
+	sm.HandleFunc("DELETE /api/chirps/{id}/reactions", reactionHandler)
+	sm.HandleFunc("POST /api/chirps/{id}/votes", voteHandler)
+	sm.HandleFunc("POST /api/chirps/{id}/bookmark", bookmarkHandler)
+	sm.HandleFunc("DELETE /api/chirps/{id}/bookmark", bookmarkHandler)
+	sm.HandleFunc("GET /api/bookmarks", bookmarksHandler)
 	// api/users
 	sm.HandleFunc("/api/users", userHandler)
 	sm.HandleFunc("GET /api/users/{id}", getUserByID)
+	sm.HandleFunc("POST /api/users/{id}/follow", followHandler)
+	sm.HandleFunc("DELETE /api/users/{id}/follow", followHandler)
+	sm.HandleFunc("GET /api/users/{id}/followers", followListHandler)
+	sm.HandleFunc("GET /api/users/{id}/following", followListHandler)
+	sm.HandleFunc("GET /api/users/{id}/likes", userLikesHandler)
+	sm.HandleFunc("GET /api/users/{id}/mentions", userMentionsHandler)
+	sm.HandleFunc("GET /api/users/{id}/lists", userListsHandler)
+	sm.HandleFunc("POST /api/users/{id}/block", blockHandler)
+	sm.HandleFunc("DELETE /api/users/{id}/block", blockHandler)
+	sm.HandleFunc("POST /api/users/{id}/mute", blockHandler)
+	sm.HandleFunc("DELETE /api/users/{id}/mute", blockHandler)
+	sm.HandleFunc("GET /api/blocks", blockListHandler)
+	sm.HandleFunc("GET /api/mutes", blockListHandler)
+	sm.HandleFunc("GET /api/mutes/words", mutedWordsHandler)
+	sm.HandleFunc("POST /api/mutes/words", mutedWordsHandler)
+	sm.HandleFunc("DELETE /api/mutes/words/{id}", deleteMutedWordHandler)
+	// api/lists
+	sm.HandleFunc("POST /api/lists", createListHandler)
+	sm.HandleFunc("GET /api/lists/{id}", listHandler)
+	sm.HandleFunc("PATCH /api/lists/{id}", listHandler)
+	sm.HandleFunc("DELETE /api/lists/{id}", listHandler)
+	sm.HandleFunc("GET /api/lists/{id}/members", listMembersHandler)
+	sm.HandleFunc("PUT /api/lists/{id}/members/{user_id}", listMemberHandler)
+	sm.HandleFunc("DELETE /api/lists/{id}/members/{user_id}", listMemberHandler)
+	sm.HandleFunc("GET /api/lists/{id}/timeline", listTimelineHandler)
+	sm.HandleFunc("GET /api/hashtags/{tag}/chirps", hashtagChirpsHandler)
+	sm.HandleFunc("GET /api/search", searchHandler)
+	sm.HandleFunc("GET /api/trends", trendsHandler)
+	// api/drafts
+	sm.HandleFunc("POST /api/drafts", draftsHandler)
+	sm.HandleFunc("GET /api/drafts", draftsHandler)
+	sm.HandleFunc("GET /api/drafts/{id}", draftHandler)
+	sm.HandleFunc("PATCH /api/drafts/{id}", draftHandler)
+	sm.HandleFunc("DELETE /api/drafts/{id}", draftHandler)
+	// api/conversations
+	sm.HandleFunc("POST /api/conversations", conversationsHandler)
+	sm.HandleFunc("GET /api/conversations", conversationsHandler)
+	sm.HandleFunc("GET /api/conversations/{id}", conversationHandler)
+	sm.HandleFunc("GET /api/conversations/{id}/messages", messagesHandler)
+	sm.HandleFunc("POST /api/conversations/{id}/messages", messagesHandler)
+	sm.HandleFunc("POST /api/conversations/{id}/read", readConversationHandler)
+	sm.HandleFunc("GET /api/notifications", notificationsHandler)
+	sm.HandleFunc("POST /api/notifications/read", readNotificationsHandler)
+	sm.HandleFunc("POST /api/notifications/{id}/read", readNotificationsHandler)
+	sm.HandleFunc("GET /api/settings", settingsHandler)
+	sm.HandleFunc("PUT /api/settings", settingsHandler)
+	sm.HandleFunc("POST /api/reports", reportHandler)
+	sm.HandleFunc("GET /api/reports/reasons", reportReasonsHandler)
+	sm.HandleFunc("GET /api/appeals", appealsHandler)
+	sm.HandleFunc("POST /api/appeals", appealsHandler)
+	// api/media
+	sm.HandleFunc("POST /api/media", uploadMediaHandler)
+	sm.HandleFunc("GET /api/media/{id}", getMediaHandler)
+	sm.HandleFunc("GET /api/media/{id}/thumbnail", getMediaHandler)
+	sm.HandleFunc("GET /api/timeline", timelineHandler)
+	sm.HandleFunc("GET /api/stream", streamHandler)
+	sm.HandleFunc("GET /api/ws", wsHandler)
 	sm.HandleFunc("POST /api/login", loginUser)
 	// refresh / revoke
 	sm.HandleFunc("POST /api/refresh", refreshToken)
@@ -65,16 +152,33 @@ func main() {
 		io.WriteString(w, fmt.Sprintf("<html><body><h1>Welcome, Chirpy Admin</h1><p>Chirpy has been visited %d times!</p></body></html>", apiCfg.fileserverHits))
 	}
 	sm.HandleFunc("GET /admin/metrics", adminMetricsHandler)
+	sm.HandleFunc("GET /admin/filter/rules", filterRulesHandler)
+	sm.HandleFunc("POST /admin/filter/rules", filterRulesHandler)
+	sm.HandleFunc("PATCH /admin/filter/rules/{id}", filterRuleHandler)
+	sm.HandleFunc("DELETE /admin/filter/rules/{id}", filterRuleHandler)
+	sm.HandleFunc("GET /admin/filter/flagged", flaggedChirpsHandler)
+	sm.HandleFunc("GET /admin/reports", adminReportsHandler)
+	sm.HandleFunc("POST /admin/reports/{id}/assign", assignReportHandler)
+	sm.HandleFunc("POST /admin/reports/{id}/resolve", resolveReportHandler)
+	sm.HandleFunc("GET /admin/actions", modActionsHandler)
+	sm.HandleFunc("POST /admin/actions", modActionsHandler)
+	sm.HandleFunc("GET /admin/appeals", adminAppealsHandler)
+	sm.HandleFunc("POST /admin/appeals/{id}/decide", decideAppealHandler)
+	sm.HandleFunc("GET /admin/users/{id}", adminUserHandler)
+	sm.HandleFunc("POST /admin/users/{id}/status", adminUserHandler)
+	sm.HandleFunc("GET /admin/spam", spamVerdictsHandler)
+	sm.HandleFunc("GET /admin/audit", auditHandler)
+	sm.HandleFunc("GET /admin/audit/verify", auditVerifyHandler)
 
 	// app
 	appHandler := apiCfg.middlewareMetricsInc(http.StripPrefix("/app/", http.FileServer(http.Dir("html"))))
 	sm.Handle("/app/", appHandler)
 
 	server := http.Server{
-		Handler: sm,
+		Handler: rateLimit(sm, auditAdmin(sm)),
 		Addr:    ":8080",
 	}
-	err := server.ListenAndServe()
+	err = server.ListenAndServe()
 	if err != nil {
 		fmt.Println(err)
 	}
@@ -0,0 +1,460 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/joho/godotenv"
+)
+
+const (
+	maxChirpMedia   = 4
+	maxImagePixels  = 16_000_000
+	maxGIFPixels    = 32_000_000 // across all frames
+	thumbnailSize   = 320
+	jpegQuality     = 90
+	multipartMemory = 1 << 20
+)
+
+var (
+	errImageTooLarge     = errors.New("image dimensions are too large")
+	errAnimationTooLarge = errors.New("animation is too large")
+)
+
+// blobs is where uploaded media lives. MEDIA_DIR picks the directory for
+// the default local disk store.
+var blobs BlobStore = newDiskBlobStore()
+
+func newDiskBlobStore() diskBlobStore {
+	godotenv.Load()
+	dir := os.Getenv("MEDIA_DIR")
+	if dir == "" {
+		dir = "media"
+	}
+	return diskBlobStore{dir: dir}
+}
+
+type Media struct {
+	ID           int       `json:"id"`
+	OwnerID      int       `json:"owner_id"`
+	ContentType  string    `json:"content_type"`
+	Width        int       `json:"width"`
+	Height       int       `json:"height"`
+	Size         int       `json:"size"`
+	URL          string    `json:"url"`
+	ThumbnailURL string    `json:"thumbnail_url"`
+	CreatedAt    time.Time `json:"created_at"`
+
+	// the blob store keys are cleared by public before responding
+	Key          string `json:"key,omitempty"`
+	ThumbnailKey string `json:"thumbnail_key,omitempty"`
+}
+
+// public returns media as clients see it, without the blob store keys.
+func (media Media) public() Media {
+	media.Key = ""
+	media.ThumbnailKey = ""
+	return media
+}
+
+// maxUploadBytes is the largest upload a user may send. Chirpy Red
+// subscribers get a bigger allowance.
+func maxUploadBytes(user User) int64 {
+	if user.IsChirpyRed {
+		return int64(envInt("MEDIA_MAX_BYTES_RED", 15<<20))
+	}
+	return int64(envInt("MEDIA_MAX_BYTES", 5<<20))
+}
+
+var allowedMediaTypes = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/gif":  ".gif",
+}
+
+// processImage checks an upload really is one of the allowed image types
+// and re-encodes it. Re-encoding keeps only the pixels, which strips EXIF
+// and any other embedded metadata. It also returns a thumbnail.
+func processImage(data []byte) (contentType string, cleaned, thumb []byte, config image.Config, err error) {
+	contentType = http.DetectContentType(data)
+	if _, ok := allowedMediaTypes[contentType]; !ok {
+		return "", nil, nil, config, fmt.Errorf("unsupported media type %s", contentType)
+	}
+	config, _, err = image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return "", nil, nil, config, fmt.Errorf("couldn't read image: %w", err)
+	}
+	if config.Width*config.Height > maxImagePixels {
+		return "", nil, nil, config, errImageTooLarge
+	}
+	if contentType == "image/gif" {
+		// every frame is decoded, so the check has to cover all of them
+		pixels, err := gifFramePixels(data)
+		if err != nil {
+			return "", nil, nil, config, fmt.Errorf("couldn't read image: %w", err)
+		}
+		if pixels > maxGIFPixels {
+			return "", nil, nil, config, errAnimationTooLarge
+		}
+	}
+
+	var out, thumbOut bytes.Buffer
+	var first image.Image
+	switch contentType {
+	case "image/gif":
+		anim, err := gif.DecodeAll(bytes.NewReader(data))
+		if err != nil {
+			return "", nil, nil, config, fmt.Errorf("couldn't decode image: %w", err)
+		}
+		err = gif.EncodeAll(&out, &gif.GIF{
+			Image:     anim.Image,
+			Delay:     anim.Delay,
+			LoopCount: anim.LoopCount,
+			Disposal:  anim.Disposal,
+			Config:    anim.Config,
+		})
+		if err != nil {
+			return "", nil, nil, config, err
+		}
+		first = anim.Image[0]
+	default:
+		img, _, err := image.Decode(bytes.NewReader(data))
+		if err != nil {
+			return "", nil, nil, config, fmt.Errorf("couldn't decode image: %w", err)
+		}
+		if contentType == "image/png" {
+			err = png.Encode(&out, img)
+		} else {
+			err = jpeg.Encode(&out, img, &jpeg.Options{Quality: jpegQuality})
+		}
+		if err != nil {
+			return "", nil, nil, config, err
+		}
+		first = img
+	}
+
+	small := thumbnail(first, thumbnailSize)
+	if contentType == "image/jpeg" {
+		err = jpeg.Encode(&thumbOut, small, &jpeg.Options{Quality: jpegQuality})
+	} else {
+		err = png.Encode(&thumbOut, small)
+	}
+	if err != nil {
+		return "", nil, nil, config, err
+	}
+	return contentType, out.Bytes(), thumbOut.Bytes(), config, nil
+}
+
+// gifFramePixels adds up the area of every frame in a GIF by walking its
+// blocks, without decoding any of them.
+func gifFramePixels(data []byte) (int, error) {
+	errBad := errors.New("malformed GIF")
+	if len(data) < 13 {
+		return 0, errBad
+	}
+	pos := 13
+	if data[10]&0x80 != 0 {
+		// global colour table
+		pos += 3 << (data[10]&0x07 + 1)
+	}
+	// skipSubBlocks moves pos past a run of length-prefixed sub-blocks
+	skipSubBlocks := func() error {
+		for {
+			if pos >= len(data) {
+				return errBad
+			}
+			n := int(data[pos])
+			pos += 1 + n
+			if n == 0 {
+				return nil
+			}
+		}
+	}
+	pixels := 0
+	for pos < len(data) {
+		switch data[pos] {
+		case 0x21: // extension
+			pos += 2
+			if err := skipSubBlocks(); err != nil {
+				return 0, err
+			}
+		case 0x2C: // image descriptor
+			if pos+10 > len(data) {
+				return 0, errBad
+			}
+			w := int(data[pos+5]) | int(data[pos+6])<<8
+			h := int(data[pos+7]) | int(data[pos+8])<<8
+			pixels += w * h
+			flags := data[pos+9]
+			pos += 10
+			if flags&0x80 != 0 {
+				// local colour table
+				pos += 3 << (flags&0x07 + 1)
+			}
+			pos++ // LZW minimum code size
+			if err := skipSubBlocks(); err != nil {
+				return 0, err
+			}
+		case 0x3B: // trailer
+			return pixels, nil
+		default:
+			return 0, errBad
+		}
+	}
+	return pixels, nil
+}
+
+// thumbnail scales img down so its longest side is at most size pixels,
+// averaging a few source pixels behind each thumbnail pixel. It reads img
+// directly rather than converting it first, so a large image isn't copied.
+func thumbnail(img image.Image, size int) image.Image {
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	if w <= size && h <= size {
+		return img
+	}
+	tw, th := size, h*size/w
+	if h > w {
+		tw, th = w*size/h, size
+	}
+	tw, th = max(tw, 1), max(th, 1)
+
+	// at most thumbnailSamples x thumbnailSamples source pixels are
+	// averaged for each thumbnail pixel
+	const thumbnailSamples = 4
+	dst := image.NewRGBA(image.Rect(0, 0, tw, th))
+	for y := 0; y < th; y++ {
+		y0, y1 := y*h/th, max((y+1)*h/th, y*h/th+1)
+		ystep := max((y1-y0)/thumbnailSamples, 1)
+		for x := 0; x < tw; x++ {
+			x0, x1 := x*w/tw, max((x+1)*w/tw, x*w/tw+1)
+			xstep := max((x1-x0)/thumbnailSamples, 1)
+			var r, g, b, a, n uint32
+			for sy := y0; sy < y1; sy += ystep {
+				for sx := x0; sx < x1; sx += xstep {
+					sr, sg, sb, sa := img.At(bounds.Min.X+sx, bounds.Min.Y+sy).RGBA()
+					r += sr >> 8
+					g += sg >> 8
+					b += sb >> 8
+					a += sa >> 8
+					n++
+				}
+			}
+			i := dst.PixOffset(x, y)
+			dst.Pix[i] = uint8(r / n)
+			dst.Pix[i+1] = uint8(g / n)
+			dst.Pix[i+2] = uint8(b / n)
+			dst.Pix[i+3] = uint8(a / n)
+		}
+	}
+	return dst
+}
+
+func (db *DB) CreateMedia(media Media) (Media, error) {
+	err := db.update(func(structure *DBStructure) error {
+		for id := range structure.Media {
+			media.ID = max(media.ID, id)
+		}
+		media.ID++
+		media.URL = fmt.Sprintf("/api/media/%d", media.ID)
+		media.ThumbnailURL = fmt.Sprintf("/api/media/%d/thumbnail", media.ID)
+		media.CreatedAt = time.Now().UTC()
+		structure.Media[media.ID] = media
+		return nil
+	})
+	if err != nil {
+		return Media{}, err
+	}
+	fmt.Printf("Added media id %v for user %v\n", media.ID, media.OwnerID)
+	return media, nil
+}
+
+// checkChirpMedia makes sure a new chirp only attaches media its author
+// uploaded, and no more than maxChirpMedia of them.
+func checkChirpMedia(structure DBStructure, chirp Chirp) error {
+	if len(chirp.MediaIDs) > maxChirpMedia {
+		return fmt.Errorf("a chirp can have at most %d media attachments", maxChirpMedia)
+	}
+	for i, id := range chirp.MediaIDs {
+		media, ok := structure.Media[id]
+		if !ok || media.OwnerID != chirp.AuthorID {
+			return fmt.Errorf("media %v not found", id)
+		}
+		for _, other := range chirp.MediaIDs[:i] {
+			if other == id {
+				return fmt.Errorf("media %v attached twice", id)
+			}
+		}
+	}
+	return nil
+}
+
+// canViewMedia reports whether viewerID may fetch media. Its owner always
+// can; anyone else only once it is attached to a chirp they can see.
+func canViewMedia(dbs DBStructure, media Media, viewerID int) bool {
+	if viewerID != 0 && viewerID == media.OwnerID {
+		return true
+	}
+	for _, chirpID := range dbs.MediaChirps[media.ID] {
+		chirp, ok := dbs.Chirps[chirpID]
+		if ok && !chirp.Deleted && canView(dbs, chirp, viewerID) {
+			return true
+		}
+	}
+	return false
+}
+
+// chirpMedia looks up the attachments of a chirp for responses.
+func chirpMedia(dbs DBStructure, chirp Chirp) []Media {
+	var media []Media
+	for _, id := range chirp.MediaIDs {
+		if m, ok := dbs.Media[id]; ok {
+			media = append(media, m.public())
+		}
+	}
+	return media
+}
+
+func randomKey() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func uploadMediaHandler(w http.ResponseWriter, r *http.Request) {
+	validity, userID := IsJWTValid(w, r)
+	if !validity {
+		return
+	}
+
+	chirpdb, err := NewDB("database.json")
+	if err != nil {
+		fmt.Println(err)
+	}
+	user, err := chirpdb.GetUser(userID)
+	if err != nil {
+		respondWithError(w, 401, fmt.Sprintf("Couldn't get user from token: %s", err))
+		return
+	}
+
+	maxBytes := maxUploadBytes(user)
+	r.Body = http.MaxBytesReader(w, r.Body, maxBytes+multipartMemory)
+	file, _, err := r.FormFile("file")
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			respondWithError(w, 413, fmt.Sprintf("Uploads are limited to %d bytes", maxBytes))
+			return
+		}
+		respondWithError(w, 400, fmt.Sprintf("Couldn't read file from form field \"file\": %s", err))
+		return
+	}
+	defer file.Close()
+	data, err := io.ReadAll(io.LimitReader(file, maxBytes+1))
+	if err != nil {
+		respondWithError(w, 400, fmt.Sprintf("Couldn't read upload: %s", err))
+		return
+	}
+	if int64(len(data)) > maxBytes {
+		respondWithError(w, 413, fmt.Sprintf("Uploads are limited to %d bytes", maxBytes))
+		return
+	}
+
+	contentType, cleaned, thumb, config, err := processImage(data)
+	if errors.Is(err, errImageTooLarge) || errors.Is(err, errAnimationTooLarge) {
+		respondWithError(w, 413, err.Error())
+		return
+	} else if err != nil {
+		respondWithError(w, 415, err.Error())
+		return
+	}
+
+	key, err := randomKey()
+	if err != nil {
+		respondWithError(w, 500, fmt.Sprintf("Couldn't store media: %s", err))
+		return
+	}
+	media := Media{
+		OwnerID:      userID,
+		ContentType:  contentType,
+		Width:        config.Width,
+		Height:       config.Height,
+		Size:         len(cleaned),
+		Key:          key + allowedMediaTypes[contentType],
+		ThumbnailKey: key + "_thumb" + allowedMediaTypes[http.DetectContentType(thumb)],
+	}
+	err = blobs.Put(media.Key, bytes.NewReader(cleaned))
+	if err == nil {
+		err = blobs.Put(media.ThumbnailKey, bytes.NewReader(thumb))
+	}
+	if err == nil {
+		media, err = chirpdb.CreateMedia(media)
+	}
+	if err != nil {
+		blobs.Delete(media.Key)
+		blobs.Delete(media.ThumbnailKey)
+		respondWithError(w, 500, fmt.Sprintf("Couldn't store media: %s", err))
+		return
+	}
+	respondWithJSON(w, 201, media.public())
+}
+
+func getMediaHandler(w http.ResponseWriter, r *http.Request) {
+	pathVal := r.PathValue("id")
+	mediaID, err := strconv.Atoi(pathVal)
+	if err != nil {
+		respondWithError(w, 400, fmt.Sprintf("Cannot convert %s to integer", pathVal))
+		return
+	}
+
+	chirpdb, err := NewDB("database.json")
+	if err != nil {
+		fmt.Println(err)
+	}
+	dbs, err := chirpdb.loadDB()
+	if err != nil {
+		respondWithError(w, 500, fmt.Sprintf("Couldn't load media: %s", err))
+		return
+	}
+	// media nobody may see is reported as missing, so IDs can't be probed
+	media, ok := dbs.Media[mediaID]
+	if !ok || !canViewMedia(dbs, media, optionalUserID(r)) {
+		respondWithError(w, 404, "Media does not exist")
+		return
+	}
+
+	key, contentType := media.Key, media.ContentType
+	if strings.HasSuffix(r.URL.Path, "/thumbnail") {
+		key = media.ThumbnailKey
+		if contentType != "image/jpeg" {
+			contentType = "image/png"
+		}
+	}
+	blob, err := blobs.Get(key)
+	if err != nil {
+		respondWithError(w, 404, fmt.Sprintf("Media does not exist: %s", err))
+		return
+	}
+	defer blob.Close()
+	w.Header().Set("Content-Type", contentType)
+	// who may see it can change, so shared caches mustn't keep it
+	w.Header().Set("Cache-Control", "private, max-age=3600")
+	w.WriteHeader(http.StatusOK)
+	io.Copy(w, blob)
+}
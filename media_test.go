@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/gif"
+	"image/png"
+	"testing"
+)
+
+func testGIF(t *testing.T, frames int, w, h int) []byte {
+	t.Helper()
+	anim := &gif.GIF{}
+	for i := 0; i < frames; i++ {
+		anim.Image = append(anim.Image, image.NewPaletted(image.Rect(0, 0, w, h), palette.Plan9))
+		anim.Delay = append(anim.Delay, 10)
+	}
+	var buf bytes.Buffer
+	err := gif.EncodeAll(&buf, anim)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// pngHeader is the start of a PNG that claims to be w x h, which is all
+// image.DecodeConfig reads.
+func pngHeader(w, h uint32) []byte {
+	ihdr := make([]byte, 13)
+	binary.BigEndian.PutUint32(ihdr[0:], w)
+	binary.BigEndian.PutUint32(ihdr[4:], h)
+	ihdr[8], ihdr[9] = 8, 6 // 8-bit RGBA
+	var buf bytes.Buffer
+	buf.WriteString("\x89PNG\r\n\x1a\n")
+	binary.Write(&buf, binary.BigEndian, uint32(len(ihdr)))
+	chunk := append([]byte("IHDR"), ihdr...)
+	buf.Write(chunk)
+	binary.Write(&buf, binary.BigEndian, crc32.ChecksumIEEE(chunk))
+	return buf.Bytes()
+}
+
+func TestGIFFramePixels(t *testing.T) {
+	tests := []struct {
+		name   string
+		frames int
+		w, h   int
+	}{
+		{"single frame", 1, 10, 20},
+		{"animation", 5, 30, 30},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := gifFramePixels(testGIF(t, tt.frames, tt.w, tt.h))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := tt.frames * tt.w * tt.h; got != want {
+				t.Errorf("gifFramePixels = %d, want %d", got, want)
+			}
+		})
+	}
+	if _, err := gifFramePixels([]byte("GIF89a")); err == nil {
+		t.Error("gifFramePixels accepted a truncated GIF")
+	}
+}
+
+func TestProcessImageLimits(t *testing.T) {
+	_, _, _, _, err := processImage(pngHeader(5000, 5000))
+	if !errors.Is(err, errImageTooLarge) {
+		t.Errorf("25MP PNG: got error %v", err)
+	}
+	_, _, _, _, err = processImage(testGIF(t, 40, 1000, 1000))
+	if !errors.Is(err, errAnimationTooLarge) {
+		t.Errorf("40MP animation: got error %v", err)
+	}
+}
+
+func TestThumbnail(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 1000, 500))
+	for y := 0; y < 500; y++ {
+		for x := 0; x < 1000; x++ {
+			img.Set(x, y, color.RGBA{200, 100, 50, 255})
+		}
+	}
+	small := thumbnail(img, thumbnailSize)
+	if got := small.Bounds(); got.Dx() != 320 || got.Dy() != 160 {
+		t.Fatalf("thumbnail is %v, want 320x160", got)
+	}
+	if got := small.At(10, 10); got != (color.RGBA{200, 100, 50, 255}) {
+		t.Errorf("thumbnail pixel = %v, want the source colour", got)
+	}
+
+	var buf bytes.Buffer
+	png.Encode(&buf, img)
+	_, _, thumb, config, err := processImage(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Width != 1000 || len(thumb) == 0 {
+		t.Errorf("processImage returned width %d and %d thumbnail bytes", config.Width, len(thumb))
+	}
+}
@@ -0,0 +1,528 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	maxConversationMembers = 10
+	maxMessageLen          = 1000
+)
+
+// errDMNotAllowed is returned when a member only accepts conversations
+// from their followers.
+var errDMNotAllowed = errors.New("user only accepts messages from followers")
+
+// Conversation is a private exchange between two or more users. Its
+// messages are listed in DBStructure.ConversationMessages and each user's
+// conversations in DBStructure.UserConversations, both sorted.
+type Conversation struct {
+	ID            int       `json:"id"`
+	MemberIDs     []int     `json:"member_ids"`
+	CreatedAt     time.Time `json:"created_at"`
+	UpdatedAt     time.Time `json:"updated_at"`
+	LastMessageID int       `json:"last_message_id,omitempty"`
+	// ReadUpTo maps each member to the newest message they have read, and
+	// doubles as the read receipts.
+	ReadUpTo map[int]int `json:"read_up_to"`
+	// UnreadCount and LastMessage are filled in for the viewer on the way
+	// out.
+	UnreadCount int      `json:"unread_count"`
+	LastMessage *Message `json:"last_message,omitempty"`
+}
+
+type Message struct {
+	ID             int       `json:"id"`
+	ConversationID int       `json:"conversation_id"`
+	SenderID       int       `json:"sender_id"`
+	Body           string    `json:"body"`
+	CreatedAt      time.Time `json:"created_at"`
+	// ReadBy lists the other members who have read the message; it is
+	// worked out from Conversation.ReadUpTo on the way out.
+	ReadBy []int `json:"read_by"`
+}
+
+func (conv Conversation) isMember(userID int) bool {
+	_, found := slices.BinarySearch(conv.MemberIDs, userID)
+	return found
+}
+
+// memberConversation returns a conversation if userID is in it.
+func memberConversation(dbs DBStructure, convID, userID int) (Conversation, bool) {
+	conv, ok := dbs.Conversations[convID]
+	if !ok || !conv.isMember(userID) {
+		return Conversation{}, false
+	}
+	if conv.ReadUpTo == nil {
+		conv.ReadUpTo = make(map[int]int)
+	}
+	return conv, true
+}
+
+// canMessage reports whether senderID may start a conversation with
+// recipientID.
+func canMessage(dbs DBStructure, senderID, recipientID int) bool {
+	if blocked(dbs, senderID, recipientID) {
+		return false
+	}
+	recipient := dbs.Users[recipientID]
+	return !recipient.Settings.DMFollowersOnly || hasEdge(dbs.Followers, recipientID, senderID)
+}
+
+func viewMessage(conv Conversation, msg Message) Message {
+	msg.ReadBy = make([]int, 0)
+	for _, id := range conv.MemberIDs {
+		if id != msg.SenderID && conv.ReadUpTo[id] >= msg.ID {
+			msg.ReadBy = append(msg.ReadBy, id)
+		}
+	}
+	return msg
+}
+
+func viewConversation(dbs DBStructure, conv Conversation, viewerID int) Conversation {
+	conv.UnreadCount = 0
+	ids := dbs.ConversationMessages[conv.ID]
+	for i := len(ids) - 1; i >= 0 && ids[i] > conv.ReadUpTo[viewerID]; i-- {
+		if dbs.Messages[ids[i]].SenderID != viewerID {
+			conv.UnreadCount++
+		}
+	}
+	conv.LastMessage = nil
+	if msg, ok := dbs.Messages[conv.LastMessageID]; ok {
+		msg = viewMessage(conv, msg)
+		conv.LastMessage = &msg
+	}
+	return conv
+}
+
+// StartConversation opens a conversation between creatorID and memberIDs.
+// Two people share a single conversation, so asking again for the same
+// pair returns the existing one with created false; group conversations
+// are always new.
+func (db *DB) StartConversation(creatorID int, memberIDs []int) (conv Conversation, created bool, err error) {
+	members := append([]int{creatorID}, memberIDs...)
+	slices.Sort(members)
+	members = slices.Compact(members)
+	if len(members) < 2 {
+		return Conversation{}, false, errors.New("a conversation needs someone else in it")
+	}
+	if len(members) > maxConversationMembers {
+		return Conversation{}, false, fmt.Errorf("a conversation can have at most %d members", maxConversationMembers)
+	}
+
+	err = db.update(func(structure *DBStructure) error {
+		for _, id := range members {
+			if _, ok := structure.Users[id]; !ok {
+				return fmt.Errorf("user %v not found", id)
+			}
+		}
+		if len(members) == 2 {
+			for _, id := range structure.UserConversations[creatorID] {
+				if slices.Equal(structure.Conversations[id].MemberIDs, members) {
+					conv = viewConversation(*structure, structure.Conversations[id], creatorID)
+					return nil
+				}
+			}
+		}
+		for _, id := range members {
+			if id != creatorID && !canMessage(*structure, creatorID, id) {
+				return errDMNotAllowed
+			}
+		}
+
+		conv = Conversation{MemberIDs: members, ReadUpTo: make(map[int]int)}
+		for id := range structure.Conversations {
+			conv.ID = max(conv.ID, id)
+		}
+		conv.ID++
+		conv.CreatedAt = time.Now().UTC()
+		conv.UpdatedAt = conv.CreatedAt
+		structure.Conversations[conv.ID] = conv
+		for _, id := range members {
+			addEdge(structure.UserConversations, id, conv.ID)
+		}
+		created = true
+		return nil
+	})
+	if err != nil {
+		return Conversation{}, false, err
+	}
+	if created {
+		fmt.Printf("User %v started conversation %v\n", creatorID, conv.ID)
+	}
+	return conv, created, nil
+}
+
+// SendMessage adds a message to a conversation. Sending a message also
+// marks everything before it as read by the sender.
+func (db *DB) SendMessage(convID, senderID int, body string) (Message, error) {
+	body = strings.TrimSpace(body)
+	if body == "" {
+		return Message{}, errors.New("a message can't be empty")
+	}
+	if utf8.RuneCountInString(body) > maxMessageLen {
+		return Message{}, fmt.Errorf("messages can be at most %d characters", maxMessageLen)
+	}
+
+	var msg Message
+	err := db.update(func(structure *DBStructure) error {
+		conv, ok := memberConversation(*structure, convID, senderID)
+		if !ok {
+			return errNotFound
+		}
+		for _, id := range conv.MemberIDs {
+			if blocked(*structure, senderID, id) {
+				return errBlocked
+			}
+		}
+		msg = Message{
+			ConversationID: convID,
+			SenderID:       senderID,
+			Body:           body,
+			CreatedAt:      time.Now().UTC(),
+		}
+		for id := range structure.Messages {
+			msg.ID = max(msg.ID, id)
+		}
+		msg.ID++
+		structure.Messages[msg.ID] = msg
+		addEdge(structure.ConversationMessages, convID, msg.ID)
+
+		conv.LastMessageID = msg.ID
+		conv.UpdatedAt = msg.CreatedAt
+		conv.ReadUpTo[senderID] = msg.ID
+		structure.Conversations[convID] = conv
+		msg = viewMessage(conv, msg)
+		return nil
+	})
+	if err != nil {
+		return Message{}, err
+	}
+	fmt.Printf("User %v sent message %v in conversation %v\n", senderID, msg.ID, convID)
+	return msg, nil
+}
+
+// GetConversations returns userID's conversations, most recently active
+// first, starting offset conversations in. It also returns the offset of
+// the next page (0 when there is none) and the number of unread messages
+// across all of them.
+func (db *DB) GetConversations(userID, offset, limit int) (convs []Conversation, next, unread int, err error) {
+	convs = make([]Conversation, 0, limit)
+	dbs, err := db.loadDB()
+	if err != nil {
+		return convs, 0, 0, err
+	}
+	all := make([]Conversation, 0)
+	for _, id := range dbs.UserConversations[userID] {
+		conv := viewConversation(dbs, dbs.Conversations[id], userID)
+		unread += conv.UnreadCount
+		all = append(all, conv)
+	}
+	sort.Slice(all, func(i, j int) bool {
+		if !all[i].UpdatedAt.Equal(all[j].UpdatedAt) {
+			return all[i].UpdatedAt.After(all[j].UpdatedAt)
+		}
+		return all[i].ID > all[j].ID
+	})
+	if offset < len(all) {
+		convs = append(convs, all[offset:min(len(all), offset+limit)]...)
+	}
+	if offset+limit < len(all) {
+		next = offset + limit
+	}
+	return convs, next, unread, nil
+}
+
+func (db *DB) GetConversation(convID, userID int) (Conversation, error) {
+	dbs, err := db.loadDB()
+	if err != nil {
+		return Conversation{}, err
+	}
+	conv, ok := memberConversation(dbs, convID, userID)
+	if !ok {
+		return Conversation{}, errNotFound
+	}
+	return viewConversation(dbs, conv, userID), nil
+}
+
+// GetMessages returns a page of a conversation's messages, newest first,
+// below the message ID before (0 for the newest).
+func (db *DB) GetMessages(convID, userID, before, limit int) ([]Message, int, error) {
+	msgs := make([]Message, 0, limit)
+	dbs, err := db.loadDB()
+	if err != nil {
+		return msgs, 0, err
+	}
+	conv, ok := memberConversation(dbs, convID, userID)
+	if !ok {
+		return msgs, 0, errNotFound
+	}
+	ids := dbs.ConversationMessages[convID]
+	for i := len(ids) - 1; i >= 0; i-- {
+		if before > 0 && ids[i] >= before {
+			continue
+		}
+		if len(msgs) == limit {
+			return msgs, msgs[len(msgs)-1].ID, nil
+		}
+		msgs = append(msgs, viewMessage(conv, dbs.Messages[ids[i]]))
+	}
+	return msgs, 0, nil
+}
+
+// MarkConversationRead records that userID has read a conversation up to
+// message upTo, or to the end when upTo is 0. Read markers only move
+// forward.
+func (db *DB) MarkConversationRead(convID, userID, upTo int) (Conversation, error) {
+	var conv Conversation
+	err := db.update(func(structure *DBStructure) error {
+		var ok bool
+		conv, ok = memberConversation(*structure, convID, userID)
+		if !ok {
+			return errNotFound
+		}
+		if upTo <= 0 || upTo > conv.LastMessageID {
+			upTo = conv.LastMessageID
+		}
+		if upTo > conv.ReadUpTo[userID] {
+			conv.ReadUpTo[userID] = upTo
+			structure.Conversations[convID] = conv
+		}
+		conv = viewConversation(*structure, conv, userID)
+		return nil
+	})
+	return conv, err
+}
+
+func conversationsHandler(w http.ResponseWriter, r *http.Request) {
+	validity, userID := IsJWTValid(w, r)
+	if !validity {
+		return
+	}
+
+	chirpdb, err := NewDB("database.json")
+	if err != nil {
+		fmt.Println(err)
+	}
+
+	if r.Method == "GET" {
+		type returnVals struct {
+			Conversations []Conversation `json:"conversations"`
+			UnreadCount   int            `json:"unread_count"`
+			NextCursor    string         `json:"next_cursor,omitempty"`
+		}
+
+		limit, err := parseLimit(r.URL.Query().Get("limit"))
+		if err != nil {
+			respondWithError(w, 400, err.Error())
+			return
+		}
+		// the cursor holds the offset plus one, so the first page is 0
+		offset, err := decodeCursor(r.URL.Query().Get("cursor"))
+		if err != nil {
+			respondWithError(w, 400, err.Error())
+			return
+		}
+		offset = max(offset-1, 0)
+
+		convs, next, unread, err := chirpdb.GetConversations(userID, offset, limit)
+		if err != nil {
+			respondWithError(w, 500, fmt.Sprintf("Couldn't load conversations: %s", err))
+			return
+		}
+		retVals := returnVals{Conversations: convs, UnreadCount: unread}
+		if next > 0 {
+			retVals.NextCursor = encodeCursor(next + 1)
+		}
+		respondWithJSON(w, http.StatusOK, retVals)
+		return
+	}
+
+	type parameters struct {
+		MemberIDs []int  `json:"member_ids"`
+		Body      string `json:"body"`
+	}
+	params := parameters{}
+	decoder := json.NewDecoder(r.Body)
+	err = decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, 400, fmt.Sprintf("Error decoding parameters: %s", err))
+		return
+	}
+
+	conv, created, err := chirpdb.StartConversation(userID, params.MemberIDs)
+	if errors.Is(err, errDMNotAllowed) {
+		respondWithError(w, 403, err.Error())
+		return
+	} else if err != nil {
+		respondWithError(w, 400, fmt.Sprintf("Couldn't start conversation: %s", err))
+		return
+	}
+	if params.Body != "" {
+		_, err = chirpdb.SendMessage(conv.ID, userID, params.Body)
+		if errors.Is(err, errBlocked) {
+			respondWithError(w, 403, err.Error())
+			return
+		} else if err != nil {
+			respondWithError(w, 400, fmt.Sprintf("Couldn't send message: %s", err))
+			return
+		}
+		conv, err = chirpdb.GetConversation(conv.ID, userID)
+		if err != nil {
+			respondWithError(w, 500, fmt.Sprintf("Couldn't load conversation: %s", err))
+			return
+		}
+	}
+	if created {
+		respondWithJSON(w, 201, conv)
+	} else {
+		respondWithJSON(w, http.StatusOK, conv)
+	}
+}
+
+func conversationHandler(w http.ResponseWriter, r *http.Request) {
+	validity, userID := IsJWTValid(w, r)
+	if !validity {
+		return
+	}
+
+	pathVal := r.PathValue("id")
+	convID, err := strconv.Atoi(pathVal)
+	if err != nil {
+		respondWithError(w, 400, fmt.Sprintf("Cannot convert %s to integer", pathVal))
+		return
+	}
+
+	chirpdb, err := NewDB("database.json")
+	if err != nil {
+		fmt.Println(err)
+	}
+
+	conv, err := chirpdb.GetConversation(convID, userID)
+	if err != nil {
+		respondWithError(w, 404, "Conversation does not exist")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, conv)
+}
+
+func messagesHandler(w http.ResponseWriter, r *http.Request) {
+	validity, userID := IsJWTValid(w, r)
+	if !validity {
+		return
+	}
+
+	pathVal := r.PathValue("id")
+	convID, err := strconv.Atoi(pathVal)
+	if err != nil {
+		respondWithError(w, 400, fmt.Sprintf("Cannot convert %s to integer", pathVal))
+		return
+	}
+
+	chirpdb, err := NewDB("database.json")
+	if err != nil {
+		fmt.Println(err)
+	}
+
+	if r.Method == "GET" {
+		type returnVals struct {
+			Messages   []Message `json:"messages"`
+			NextCursor string    `json:"next_cursor,omitempty"`
+		}
+
+		limit, err := parseLimit(r.URL.Query().Get("limit"))
+		if err != nil {
+			respondWithError(w, 400, err.Error())
+			return
+		}
+		before, err := decodeCursor(r.URL.Query().Get("cursor"))
+		if err != nil {
+			respondWithError(w, 400, err.Error())
+			return
+		}
+		msgs, next, err := chirpdb.GetMessages(convID, userID, before, limit)
+		if err != nil {
+			respondWithError(w, 404, "Conversation does not exist")
+			return
+		}
+		respondWithJSON(w, http.StatusOK, returnVals{
+			Messages:   msgs,
+			NextCursor: encodeCursor(next),
+		})
+		return
+	}
+
+	type parameters struct {
+		Body string `json:"body"`
+	}
+	params := parameters{}
+	decoder := json.NewDecoder(r.Body)
+	err = decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, 400, fmt.Sprintf("Error decoding parameters: %s", err))
+		return
+	}
+
+	msg, err := chirpdb.SendMessage(convID, userID, params.Body)
+	if errors.Is(err, errNotFound) {
+		respondWithError(w, 404, "Conversation does not exist")
+		return
+	} else if errors.Is(err, errBlocked) {
+		respondWithError(w, 403, err.Error())
+		return
+	} else if err != nil {
+		respondWithError(w, 400, fmt.Sprintf("Couldn't send message: %s", err))
+		return
+	}
+	respondWithJSON(w, 201, msg)
+}
+
+func readConversationHandler(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		MessageID int `json:"message_id"`
+	}
+
+	validity, userID := IsJWTValid(w, r)
+	if !validity {
+		return
+	}
+
+	pathVal := r.PathValue("id")
+	convID, err := strconv.Atoi(pathVal)
+	if err != nil {
+		respondWithError(w, 400, fmt.Sprintf("Cannot convert %s to integer", pathVal))
+		return
+	}
+
+	// the body is optional; without one everything is marked read
+	params := parameters{}
+	if r.ContentLength != 0 {
+		decoder := json.NewDecoder(r.Body)
+		err = decoder.Decode(&params)
+		if err != nil {
+			respondWithError(w, 400, fmt.Sprintf("Error decoding parameters: %s", err))
+			return
+		}
+	}
+
+	chirpdb, err := NewDB("database.json")
+	if err != nil {
+		fmt.Println(err)
+	}
+
+	conv, err := chirpdb.MarkConversationRead(convID, userID, params.MessageID)
+	if err != nil {
+		respondWithError(w, 404, "Conversation does not exist")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, conv)
+}
@@ -0,0 +1,1017 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	ReportTargetChirp = "chirp"
+	ReportTargetUser  = "user"
+
+	ReportOpen      = "open"
+	ReportResolved  = "resolved"
+	ReportDismissed = "dismissed"
+
+	ModHide      = "hide"
+	ModUnhide    = "unhide"
+	ModWarn      = "warn"
+	ModSuspend   = "suspend"
+	ModBan       = "ban"
+	ModShadowban = "shadowban"
+	ModReinstate = "reinstate"
+
+	AppealOpen       = "open"
+	AppealUpheld     = "upheld"
+	AppealOverturned = "overturned"
+
+	UserActive       = ""
+	UserSuspended    = "suspended"
+	UserBanned       = "banned"
+	UserShadowbanned = "shadowbanned"
+
+	// ReportReasonAutomated is used for reports filed by Chirpy itself,
+	// such as chirps the content filter flags. Users can't choose it.
+	ReportReasonAutomated = "automated"
+
+	maxReportDetailsLen = 500
+)
+
+type ReportReason struct {
+	Reason      string `json:"reason"`
+	Description string `json:"description"`
+}
+
+var reportReasons = []ReportReason{
+	{"spam", "Spam, scams or platform manipulation"},
+	{"harassment", "Harassment or bullying"},
+	{"hate", "Hateful conduct"},
+	{"violence", "Violent threats or glorification of violence"},
+	{"self_harm", "Encouraging suicide or self-harm"},
+	{"sexual", "Unwanted sexual content"},
+	{"misinformation", "Misleading information"},
+	{"impersonation", "Pretending to be someone else"},
+	{"other", "Something else"},
+}
+
+func isReportReason(reason string) bool {
+	return slices.ContainsFunc(reportReasons, func(r ReportReason) bool { return r.Reason == reason })
+}
+
+var (
+	errDuplicateReport = errors.New("you have already reported this")
+	errDuplicateAppeal = errors.New("this action has already been appealed")
+)
+
+type Report struct {
+	ID         int    `json:"id"`
+	ReporterID int    `json:"reporter_id,omitempty"`
+	TargetType string `json:"target_type"`
+	TargetID   int    `json:"target_id"`
+	// TargetUserID is the user responsible for the target: the author of
+	// a chirp, or the reported user.
+	TargetUserID int       `json:"target_user_id"`
+	Reason       string    `json:"reason"`
+	Details      string    `json:"details,omitempty"`
+	Status       string    `json:"status"`
+	AssigneeID   int       `json:"assignee_id,omitempty"`
+	ActionID     int       `json:"action_id,omitempty"`
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+// ModAction records something a moderator did. Actions are never removed;
+// undoing one (on appeal, say) is another action.
+type ModAction struct {
+	ID          int        `json:"id"`
+	ModeratorID int        `json:"moderator_id"`
+	Action      string     `json:"action"`
+	TargetType  string     `json:"target_type"`
+	TargetID    int        `json:"target_id"`
+	UserID      int        `json:"user_id"`
+	ReportID    int        `json:"report_id,omitempty"`
+	AppealID    int        `json:"appeal_id,omitempty"`
+	Note        string     `json:"note,omitempty"`
+	Until       *time.Time `json:"until,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+}
+
+type Appeal struct {
+	ID         int       `json:"id"`
+	UserID     int       `json:"user_id"`
+	ActionID   int       `json:"action_id"`
+	Message    string    `json:"message"`
+	Status     string    `json:"status"`
+	ReviewerID int       `json:"reviewer_id,omitempty"`
+	Response   string    `json:"response,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// accountRestricted reports whether a user is currently suspended or
+// banned. Shadowbanned users aren't restricted; they just aren't seen.
+func accountRestricted(user User, now time.Time) bool {
+	switch user.Status {
+	case UserBanned:
+		return true
+	case UserSuspended:
+		return user.SuspendedUntil == nil || now.Before(*user.SuspendedUntil)
+	}
+	return false
+}
+
+// canView is the one check every read path makes before showing a chirp
+// to viewerID (0 when anonymous). Authors always see their own chirps;
+// nobody else sees chirps moderators have hidden, chirps by suspended,
+// banned or shadowbanned users, or chirps by someone they have blocked or
+// been blocked by.
+func canView(dbs DBStructure, chirp Chirp, viewerID int) bool {
+	if viewerID != 0 && viewerID == chirp.AuthorID {
+		return true
+	}
+	if chirp.Hidden || (viewerID != 0 && blocked(dbs, viewerID, chirp.AuthorID)) {
+		return false
+	}
+	author := dbs.Users[chirp.AuthorID]
+	return author.Status != UserShadowbanned && !accountRestricted(author, time.Now())
+}
+
+// canInteract is the check before userID reacts to, votes on or bookmarks
+// a chirp. As with replies, a block either way is reported as errBlocked;
+// a chirp userID can't see is reported as not found.
+func canInteract(dbs DBStructure, chirp Chirp, userID int) error {
+	if chirp.Deleted {
+		return errNotFound
+	}
+	if chirp.AuthorID != userID && blocked(dbs, userID, chirp.AuthorID) {
+		return errBlocked
+	}
+	if !canView(dbs, chirp, userID) {
+		return errNotFound
+	}
+	return nil
+}
+
+// unavailableChirp stands in for a chirp the viewer can't see where
+// leaving it out would break a thread or a quote.
+func unavailableChirp(chirp Chirp) Chirp {
+	return Chirp{
+		ID:         chirp.ID,
+		InReplyTo:  chirp.InReplyTo,
+		ReplyCount: chirp.ReplyCount,
+		Deleted:    true,
+	}
+}
+
+// reportTargetUser checks that a report target exists and returns the user
+// responsible for it.
+func reportTargetUser(structure DBStructure, targetType string, targetID int) (int, error) {
+	switch targetType {
+	case ReportTargetChirp:
+		chirp, ok := structure.Chirps[targetID]
+		if !ok || chirp.Deleted {
+			return 0, errChirpNotFound
+		}
+		return chirp.AuthorID, nil
+	case ReportTargetUser:
+		if _, ok := structure.Users[targetID]; !ok {
+			return 0, errUserNotFound
+		}
+		return targetID, nil
+	}
+	return 0, fmt.Errorf("target_type must be %s or %s", ReportTargetChirp, ReportTargetUser)
+}
+
+// fileReport adds a report to the moderation queue inside an update.
+func fileReport(structure *DBStructure, report Report) (Report, error) {
+	userID, err := reportTargetUser(*structure, report.TargetType, report.TargetID)
+	if err != nil {
+		return Report{}, err
+	}
+	for _, other := range structure.Reports {
+		if other.Status == ReportOpen && other.ReporterID == report.ReporterID &&
+			other.TargetType == report.TargetType && other.TargetID == report.TargetID {
+			return Report{}, errDuplicateReport
+		}
+	}
+	report.TargetUserID = userID
+	report.Status = ReportOpen
+	report.AssigneeID = 0
+	report.ActionID = 0
+	for id := range structure.Reports {
+		report.ID = max(report.ID, id)
+	}
+	report.ID++
+	report.CreatedAt = time.Now().UTC()
+	report.UpdatedAt = report.CreatedAt
+	structure.Reports[report.ID] = report
+	return report, nil
+}
+
+// flagForReview records the filter rules a chirp matched and puts it in
+// the moderation queue, unless it is already waiting there.
+func flagForReview(structure *DBStructure, chirpID int, ruleIDs []int) {
+	structure.FlaggedChirps[chirpID] = ruleIDs
+	_, err := fileReport(structure, Report{
+		TargetType: ReportTargetChirp,
+		TargetID:   chirpID,
+		Reason:     ReportReasonAutomated,
+		Details:    fmt.Sprintf("Matched content filter rules %v", ruleIDs),
+	})
+	if err != nil && !errors.Is(err, errDuplicateReport) {
+		fmt.Printf("Couldn't queue chirp %v for review: %s\n", chirpID, err)
+	}
+}
+
+func (db *DB) CreateReport(report Report) (Report, error) {
+	if !isReportReason(report.Reason) {
+		return Report{}, fmt.Errorf("unknown reason %s", report.Reason)
+	}
+	if utf8.RuneCountInString(report.Details) > maxReportDetailsLen {
+		return Report{}, fmt.Errorf("details can be at most %d characters", maxReportDetailsLen)
+	}
+	err := db.update(func(structure *DBStructure) error {
+		var err error
+		report, err = fileReport(structure, report)
+		if err == nil && report.TargetUserID == report.ReporterID {
+			return errors.New("you can't report yourself")
+		}
+		return err
+	})
+	if err != nil {
+		return Report{}, err
+	}
+	fmt.Printf("User %v reported %s %v for %s\n", report.ReporterID, report.TargetType, report.TargetID, report.Reason)
+	return report, nil
+}
+
+// ReportFilter selects reports for the moderation queue. Zero values
+// match everything; AssigneeID -1 matches unassigned reports.
+type ReportFilter struct {
+	Status       string
+	Reason       string
+	TargetType   string
+	TargetUserID int
+	AssigneeID   int
+}
+
+func (f ReportFilter) matches(report Report) bool {
+	return (f.Status == "" || report.Status == f.Status) &&
+		(f.Reason == "" || report.Reason == f.Reason) &&
+		(f.TargetType == "" || report.TargetType == f.TargetType) &&
+		(f.TargetUserID == 0 || report.TargetUserID == f.TargetUserID) &&
+		(f.AssigneeID == 0 || report.AssigneeID == max(f.AssigneeID, 0))
+}
+
+// GetReports returns a page of the moderation queue, oldest first, after
+// the report ID after.
+func (db *DB) GetReports(f ReportFilter, after, limit int) ([]Report, int, error) {
+	reports := make([]Report, 0, limit)
+	dbs, err := db.loadDB()
+	if err != nil {
+		return reports, 0, err
+	}
+	ids := make([]int, 0, len(dbs.Reports))
+	for id := range dbs.Reports {
+		if id > after {
+			ids = append(ids, id)
+		}
+	}
+	slices.Sort(ids)
+	for _, id := range ids {
+		report := dbs.Reports[id]
+		if !f.matches(report) {
+			continue
+		}
+		if len(reports) == limit {
+			return reports, reports[len(reports)-1].ID, nil
+		}
+		reports = append(reports, report)
+	}
+	return reports, 0, nil
+}
+
+func (db *DB) AssignReport(id, assigneeID int) (Report, error) {
+	var report Report
+	err := db.update(func(structure *DBStructure) error {
+		var ok bool
+		report, ok = structure.Reports[id]
+		if !ok {
+			return errNotFound
+		}
+		report.AssigneeID = assigneeID
+		report.UpdatedAt = time.Now().UTC()
+		structure.Reports[id] = report
+		return nil
+	})
+	return report, err
+}
+
+func (db *DB) DismissReport(id, moderatorID int) (Report, error) {
+	var report Report
+	var released Chirp
+	shadow := false
+	err := db.update(func(structure *DBStructure) error {
+		var ok bool
+		report, ok = structure.Reports[id]
+		if !ok {
+			return errNotFound
+		}
+		if report.Status != ReportOpen {
+			return errors.New("this report has already been handled")
+		}
+		report.Status = ReportDismissed
+		// dismissing the report on a chirp held as spam lets it through
+		chirp, ok := structure.Chirps[report.TargetID]
+		if report.Reason == ReportReasonAutomated && report.TargetType == ReportTargetChirp && ok &&
+			!chirp.Deleted && chirp.Hidden && structure.SpamVerdicts[chirp.ID].Outcome == SpamHold {
+			chirp.Hidden = false
+			structure.Chirps[chirp.ID] = chirp
+			released = chirp
+			shadow = structure.Users[chirp.AuthorID].Status == UserShadowbanned
+		}
+		if report.AssigneeID == 0 {
+			report.AssigneeID = moderatorID
+		}
+		report.UpdatedAt = time.Now().UTC()
+		structure.Reports[id] = report
+		return nil
+	})
+	if err != nil {
+		return report, err
+	}
+	// a released chirp goes out the way it would have when it was posted:
+	// notifications, trends and the live feeds all hear about it now
+	if released.ID != 0 {
+		fmt.Printf("Released held chirp id %v\n", released.ID)
+		bus.Publish(Event{Type: EventChirpCreated, ActorID: released.AuthorID, Chirp: released, Shadow: shadow})
+	}
+	return report, nil
+}
+
+// applyModAction validates a moderator action, makes it take effect and
+// records it, inside an update. An action taken on a report resolves every
+// open report about the same target.
+func applyModAction(structure *DBStructure, action ModAction) (ModAction, error) {
+	if action.ReportID != 0 {
+		report, ok := structure.Reports[action.ReportID]
+		if !ok {
+			return ModAction{}, errors.New("report not found")
+		}
+		if report.Status != ReportOpen {
+			return ModAction{}, errors.New("this report has already been handled")
+		}
+		action.TargetType, action.TargetID = report.TargetType, report.TargetID
+	}
+
+	switch action.Action {
+	case ModHide, ModUnhide:
+		if action.TargetType != ReportTargetChirp {
+			return ModAction{}, fmt.Errorf("%s applies to chirps", action.Action)
+		}
+		chirp, ok := structure.Chirps[action.TargetID]
+		if !ok || chirp.Deleted {
+			return ModAction{}, errChirpNotFound
+		}
+		chirp.Hidden = action.Action == ModHide
+		structure.Chirps[chirp.ID] = chirp
+		action.UserID = chirp.AuthorID
+	case ModWarn, ModSuspend, ModBan, ModShadowban, ModReinstate:
+		userID, err := reportTargetUser(*structure, action.TargetType, action.TargetID)
+		if err != nil {
+			return ModAction{}, err
+		}
+		user := structure.Users[userID]
+		switch action.Action {
+		case ModSuspend:
+			if action.Until == nil || !action.Until.After(time.Now()) {
+				return ModAction{}, errors.New("a suspension needs an end in the future")
+			}
+			user.Status = UserSuspended
+			until := action.Until.UTC()
+			user.SuspendedUntil = &until
+			user.RefreshToken = RefreshToken{}
+		case ModBan:
+			user.Status = UserBanned
+			user.SuspendedUntil = nil
+			user.RefreshToken = RefreshToken{}
+		case ModShadowban:
+			user.Status = UserShadowbanned
+			user.SuspendedUntil = nil
+		case ModReinstate:
+			user.Status = UserActive
+			user.SuspendedUntil = nil
+		}
+		structure.Users[userID] = user
+		action.UserID = userID
+	default:
+		return ModAction{}, fmt.Errorf("unknown action %s", action.Action)
+	}
+
+	for id := range structure.ModActions {
+		action.ID = max(action.ID, id)
+	}
+	action.ID++
+	action.CreatedAt = time.Now().UTC()
+	structure.ModActions[action.ID] = action
+
+	if action.ReportID != 0 {
+		for id, report := range structure.Reports {
+			if report.Status == ReportOpen && report.TargetType == action.TargetType && report.TargetID == action.TargetID {
+				report.Status = ReportResolved
+				report.ActionID = action.ID
+				if report.AssigneeID == 0 {
+					report.AssigneeID = action.ModeratorID
+				}
+				report.UpdatedAt = action.CreatedAt
+				structure.Reports[id] = report
+			}
+		}
+	}
+	return action, nil
+}
+
+// TakeModAction applies a moderator action and tells the user affected.
+func (db *DB) TakeModAction(action ModAction) (ModAction, error) {
+	err := db.update(func(structure *DBStructure) error {
+		var err error
+		action, err = applyModAction(structure, action)
+		return err
+	})
+	if err != nil {
+		return ModAction{}, err
+	}
+	fmt.Printf("Moderator %v: %s %s %v\n", action.ModeratorID, action.Action, action.TargetType, action.TargetID)
+	// a shadowban only works if its target doesn't hear about it
+	if action.Action != ModShadowban {
+		bus.Publish(Event{Type: EventModAction, ActorID: action.ModeratorID, UserID: action.UserID, Action: action})
+	}
+	return action, nil
+}
+
+// GetModActions returns the actions taken against userID, or every
+// action when userID is 0, newest first.
+func (db *DB) GetModActions(userID int) ([]ModAction, error) {
+	actions := make([]ModAction, 0)
+	dbs, err := db.loadDB()
+	if err != nil {
+		return actions, err
+	}
+	for _, action := range dbs.ModActions {
+		if userID == 0 || action.UserID == userID {
+			actions = append(actions, action)
+		}
+	}
+	slices.SortFunc(actions, func(a, b ModAction) int { return b.ID - a.ID })
+	return actions, nil
+}
+
+func (db *DB) CreateAppeal(appeal Appeal) (Appeal, error) {
+	if appeal.Message == "" {
+		return Appeal{}, errors.New("an appeal needs a message")
+	}
+	if utf8.RuneCountInString(appeal.Message) > maxReportDetailsLen {
+		return Appeal{}, fmt.Errorf("appeals can be at most %d characters", maxReportDetailsLen)
+	}
+	err := db.update(func(structure *DBStructure) error {
+		action, ok := structure.ModActions[appeal.ActionID]
+		// a shadowban is answered as if there were no such action, so an
+		// appeal can't be used to find out about one
+		if !ok || action.UserID != appeal.UserID || action.Action == ModShadowban {
+			return errNotFound
+		}
+		if action.Action == ModUnhide || action.Action == ModReinstate {
+			return errors.New("only penalties can be appealed")
+		}
+		for _, other := range structure.Appeals {
+			if other.ActionID == appeal.ActionID {
+				return errDuplicateAppeal
+			}
+		}
+		for id := range structure.Appeals {
+			appeal.ID = max(appeal.ID, id)
+		}
+		appeal.ID++
+		appeal.Status = AppealOpen
+		appeal.CreatedAt = time.Now().UTC()
+		appeal.UpdatedAt = appeal.CreatedAt
+		structure.Appeals[appeal.ID] = appeal
+		return nil
+	})
+	return appeal, err
+}
+
+// RestrictingAction returns the suspension or ban that currently keeps a
+// user out, which is what they would appeal.
+func (db *DB) RestrictingAction(userID int) (ModAction, error) {
+	dbs, err := db.loadDB()
+	if err != nil {
+		return ModAction{}, err
+	}
+	latest := ModAction{}
+	for _, action := range dbs.ModActions {
+		if action.UserID == userID && (action.Action == ModSuspend || action.Action == ModBan) && action.ID > latest.ID {
+			latest = action
+		}
+	}
+	if latest.ID == 0 {
+		return ModAction{}, errNotFound
+	}
+	return latest, nil
+}
+
+// GetAppeals returns appeals by userID, or every appeal when userID is 0,
+// with the given status (any when empty), newest first.
+func (db *DB) GetAppeals(userID int, status string) ([]Appeal, error) {
+	appeals := make([]Appeal, 0)
+	dbs, err := db.loadDB()
+	if err != nil {
+		return appeals, err
+	}
+	for _, appeal := range dbs.Appeals {
+		if (userID == 0 || appeal.UserID == userID) && (status == "" || appeal.Status == status) {
+			appeals = append(appeals, appeal)
+		}
+	}
+	slices.SortFunc(appeals, func(a, b Appeal) int { return b.ID - a.ID })
+	return appeals, nil
+}
+
+// DecideAppeal upholds or overturns an appeal. Overturning reverses the
+// original action with a new one, so the record shows both.
+func (db *DB) DecideAppeal(id, reviewerID int, overturn bool, response string) (Appeal, error) {
+	var appeal Appeal
+	var reversal *ModAction
+	err := db.update(func(structure *DBStructure) error {
+		var ok bool
+		appeal, ok = structure.Appeals[id]
+		if !ok {
+			return errNotFound
+		}
+		if appeal.Status != AppealOpen {
+			return errors.New("this appeal has already been decided")
+		}
+		appeal.Status = AppealUpheld
+		if overturn {
+			appeal.Status = AppealOverturned
+			original := structure.ModActions[appeal.ActionID]
+			undo := ModAction{
+				ModeratorID: reviewerID,
+				TargetType:  original.TargetType,
+				TargetID:    original.TargetID,
+				AppealID:    appeal.ID,
+				Note:        response,
+			}
+			switch original.Action {
+			case ModHide:
+				undo.Action = ModUnhide
+			case ModSuspend, ModBan, ModShadowban:
+				undo.Action = ModReinstate
+			}
+			if undo.Action != "" {
+				action, err := applyModAction(structure, undo)
+				if err != nil {
+					return err
+				}
+				reversal = &action
+			}
+		}
+		appeal.ReviewerID = reviewerID
+		appeal.Response = response
+		appeal.UpdatedAt = time.Now().UTC()
+		structure.Appeals[id] = appeal
+		return nil
+	})
+	if err != nil {
+		return Appeal{}, err
+	}
+	if reversal != nil {
+		bus.Publish(Event{Type: EventModAction, ActorID: reviewerID, UserID: reversal.UserID, Action: *reversal})
+	}
+	return appeal, nil
+}
+
+func reportHandler(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		TargetType string `json:"target_type"`
+		TargetID   int    `json:"target_id"`
+		Reason     string `json:"reason"`
+		Details    string `json:"details"`
+	}
+
+	validity, userID := IsJWTValid(w, r)
+	if !validity {
+		return
+	}
+
+	params := parameters{}
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, 400, fmt.Sprintf("Error decoding parameters: %s", err))
+		return
+	}
+
+	chirpdb, err := NewDB("database.json")
+	if err != nil {
+		fmt.Println(err)
+	}
+
+	report, err := chirpdb.CreateReport(Report{
+		ReporterID: userID,
+		TargetType: params.TargetType,
+		TargetID:   params.TargetID,
+		Reason:     params.Reason,
+		Details:    params.Details,
+	})
+	if errors.Is(err, errDuplicateReport) {
+		respondWithError(w, 409, err.Error())
+		return
+	} else if err != nil {
+		respondWithError(w, 400, fmt.Sprintf("Couldn't file report: %s", err))
+		return
+	}
+	respondWithJSON(w, 201, report)
+}
+
+func reportReasonsHandler(w http.ResponseWriter, r *http.Request) {
+	respondWithJSON(w, http.StatusOK, reportReasons)
+}
+
+func adminReportsHandler(w http.ResponseWriter, r *http.Request) {
+	type returnVals struct {
+		Reports    []Report `json:"reports"`
+		NextCursor string   `json:"next_cursor,omitempty"`
+	}
+
+	validity, adminID := requireAdmin(w, r)
+	if !validity {
+		return
+	}
+
+	query := r.URL.Query()
+	limit, err := parseLimit(query.Get("limit"))
+	if err != nil {
+		respondWithError(w, 400, err.Error())
+		return
+	}
+	after, err := decodeCursor(query.Get("cursor"))
+	if err != nil {
+		respondWithError(w, 400, err.Error())
+		return
+	}
+	f := ReportFilter{
+		Status:     query.Get("status"),
+		Reason:     query.Get("reason"),
+		TargetType: query.Get("target_type"),
+	}
+	if f.Status == "" {
+		f.Status = ReportOpen
+	} else if f.Status == "all" {
+		f.Status = ""
+	}
+	switch assignee := query.Get("assignee"); assignee {
+	case "":
+	case "me":
+		f.AssigneeID = adminID
+	case "none":
+		f.AssigneeID = -1
+	default:
+		f.AssigneeID, err = strconv.Atoi(assignee)
+		if err != nil {
+			respondWithError(w, 400, fmt.Sprintf("bad assignee provided: %s", assignee))
+			return
+		}
+	}
+	if val := query.Get("user_id"); val != "" {
+		f.TargetUserID, err = strconv.Atoi(val)
+		if err != nil {
+			respondWithError(w, 400, fmt.Sprintf("bad user_id provided: %s", val))
+			return
+		}
+	}
+
+	chirpdb, err := NewDB("database.json")
+	if err != nil {
+		fmt.Println(err)
+	}
+
+	reports, next, err := chirpdb.GetReports(f, after, limit)
+	if err != nil {
+		respondWithError(w, 500, fmt.Sprintf("Couldn't load reports: %s", err))
+		return
+	}
+	respondWithJSON(w, http.StatusOK, returnVals{
+		Reports:    reports,
+		NextCursor: encodeCursor(next),
+	})
+}
+
+func assignReportHandler(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		AssigneeID *int `json:"assignee_id"`
+	}
+
+	validity, adminID := requireAdmin(w, r)
+	if !validity {
+		return
+	}
+
+	pathVal := r.PathValue("id")
+	reportID, err := strconv.Atoi(pathVal)
+	if err != nil {
+		respondWithError(w, 400, fmt.Sprintf("Cannot convert %s to integer", pathVal))
+		return
+	}
+
+	// without an assignee the report is assigned to whoever asks
+	params := parameters{}
+	if r.ContentLength != 0 {
+		decoder := json.NewDecoder(r.Body)
+		err = decoder.Decode(&params)
+		if err != nil {
+			respondWithError(w, 400, fmt.Sprintf("Error decoding parameters: %s", err))
+			return
+		}
+	}
+	assigneeID := adminID
+	if params.AssigneeID != nil {
+		assigneeID = *params.AssigneeID
+	}
+
+	chirpdb, err := NewDB("database.json")
+	if err != nil {
+		fmt.Println(err)
+	}
+
+	if assigneeID != 0 {
+		assignee, err := chirpdb.GetUser(assigneeID)
+		if err != nil || !isAdmin(assignee) {
+			respondWithError(w, 400, "Reports can only be assigned to admins")
+			return
+		}
+	}
+	report, err := chirpdb.AssignReport(reportID, assigneeID)
+	if err != nil {
+		respondWithError(w, 404, "Report does not exist")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, report)
+}
+
+// modActionParams is the body of POST /admin/actions and of resolving a
+// report, which takes the target from the report instead.
+type modActionParams struct {
+	Action        string     `json:"action"`
+	TargetType    string     `json:"target_type"`
+	TargetID      int        `json:"target_id"`
+	Note          string     `json:"note"`
+	DurationHours int        `json:"duration_hours"`
+	Until         *time.Time `json:"until"`
+}
+
+func (params modActionParams) modAction(moderatorID int) ModAction {
+	action := ModAction{
+		ModeratorID: moderatorID,
+		Action:      params.Action,
+		TargetType:  params.TargetType,
+		TargetID:    params.TargetID,
+		Note:        params.Note,
+	}
+	if params.Until != nil {
+		until := params.Until.UTC()
+		action.Until = &until
+	} else if params.DurationHours > 0 {
+		until := time.Now().UTC().Add(time.Duration(params.DurationHours) * time.Hour)
+		action.Until = &until
+	}
+	return action
+}
+
+// resolveReportHandler handles a report either by taking an action against
+// its target or, with action "dismiss", by closing it without one.
+func resolveReportHandler(w http.ResponseWriter, r *http.Request) {
+	validity, adminID := requireAdmin(w, r)
+	if !validity {
+		return
+	}
+
+	pathVal := r.PathValue("id")
+	reportID, err := strconv.Atoi(pathVal)
+	if err != nil {
+		respondWithError(w, 400, fmt.Sprintf("Cannot convert %s to integer", pathVal))
+		return
+	}
+
+	params := modActionParams{}
+	decoder := json.NewDecoder(r.Body)
+	err = decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, 400, fmt.Sprintf("Error decoding parameters: %s", err))
+		return
+	}
+
+	chirpdb, err := NewDB("database.json")
+	if err != nil {
+		fmt.Println(err)
+	}
+
+	if params.Action == "dismiss" {
+		report, err := chirpdb.DismissReport(reportID, adminID)
+		if err != nil {
+			respondWithError(w, 400, fmt.Sprintf("Couldn't dismiss report: %s", err))
+			return
+		}
+		respondWithJSON(w, http.StatusOK, report)
+		return
+	}
+
+	action := params.modAction(adminID)
+	action.ReportID = reportID
+	action, err = chirpdb.TakeModAction(action)
+	if err != nil {
+		respondWithError(w, 400, fmt.Sprintf("Couldn't resolve report: %s", err))
+		return
+	}
+	recordModAction(r, action)
+	respondWithJSON(w, http.StatusOK, action)
+}
+
+func modActionsHandler(w http.ResponseWriter, r *http.Request) {
+	validity, adminID := requireAdmin(w, r)
+	if !validity {
+		return
+	}
+
+	chirpdb, err := NewDB("database.json")
+	if err != nil {
+		fmt.Println(err)
+	}
+
+	if r.Method == "GET" {
+		userID := 0
+		if val := r.URL.Query().Get("user_id"); val != "" {
+			userID, err = strconv.Atoi(val)
+			if err != nil {
+				respondWithError(w, 400, fmt.Sprintf("bad user_id provided: %s", val))
+				return
+			}
+		}
+		actions, err := chirpdb.GetModActions(userID)
+		if err != nil {
+			respondWithError(w, 500, fmt.Sprintf("Couldn't load actions: %s", err))
+			return
+		}
+		respondWithJSON(w, http.StatusOK, actions)
+		return
+	}
+
+	params := modActionParams{}
+	decoder := json.NewDecoder(r.Body)
+	err = decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, 400, fmt.Sprintf("Error decoding parameters: %s", err))
+		return
+	}
+	action, err := chirpdb.TakeModAction(params.modAction(adminID))
+	if err != nil {
+		respondWithError(w, 400, fmt.Sprintf("Couldn't take action: %s", err))
+		return
+	}
+	recordModAction(r, action)
+	respondWithJSON(w, 201, action)
+}
+
+// appealsHandler is the one endpoint that takes appeal tokens, so
+// suspended and banned users can still appeal.
+func appealsHandler(w http.ResponseWriter, r *http.Request) {
+	validity, userID, issuer := parseJWT(w, r)
+	if !validity {
+		return
+	}
+	if issuer != tokenIssuer && issuer != appealTokenIssuer {
+		respondWithError(w, 401, "Authorization failed!")
+		return
+	}
+
+	chirpdb, err := NewDB("database.json")
+	if err != nil {
+		fmt.Println(err)
+	}
+
+	if r.Method == "GET" {
+		appeals, err := chirpdb.GetAppeals(userID, "")
+		if err != nil {
+			respondWithError(w, 500, fmt.Sprintf("Couldn't load appeals: %s", err))
+			return
+		}
+		respondWithJSON(w, http.StatusOK, appeals)
+		return
+	}
+
+	type parameters struct {
+		ActionID int    `json:"action_id"`
+		Message  string `json:"message"`
+	}
+	params := parameters{}
+	decoder := json.NewDecoder(r.Body)
+	err = decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, 400, fmt.Sprintf("Error decoding parameters: %s", err))
+		return
+	}
+	appeal, err := chirpdb.CreateAppeal(Appeal{
+		UserID:   userID,
+		ActionID: params.ActionID,
+		Message:  params.Message,
+	})
+	if errors.Is(err, errDuplicateAppeal) {
+		respondWithError(w, 409, err.Error())
+		return
+	} else if errors.Is(err, errNotFound) {
+		respondWithError(w, 404, "Action does not exist")
+		return
+	} else if err != nil {
+		respondWithError(w, 400, fmt.Sprintf("Couldn't file appeal: %s", err))
+		return
+	}
+	respondWithJSON(w, 201, appeal)
+}
+
+func adminAppealsHandler(w http.ResponseWriter, r *http.Request) {
+	validity, _ := requireAdmin(w, r)
+	if !validity {
+		return
+	}
+
+	status := r.URL.Query().Get("status")
+	if status == "" {
+		status = AppealOpen
+	} else if status == "all" {
+		status = ""
+	}
+
+	chirpdb, err := NewDB("database.json")
+	if err != nil {
+		fmt.Println(err)
+	}
+
+	appeals, err := chirpdb.GetAppeals(0, status)
+	if err != nil {
+		respondWithError(w, 500, fmt.Sprintf("Couldn't load appeals: %s", err))
+		return
+	}
+	respondWithJSON(w, http.StatusOK, appeals)
+}
+
+func decideAppealHandler(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Decision string `json:"decision"`
+		Response string `json:"response"`
+	}
+
+	validity, adminID := requireAdmin(w, r)
+	if !validity {
+		return
+	}
+
+	pathVal := r.PathValue("id")
+	appealID, err := strconv.Atoi(pathVal)
+	if err != nil {
+		respondWithError(w, 400, fmt.Sprintf("Cannot convert %s to integer", pathVal))
+		return
+	}
+
+	params := parameters{}
+	decoder := json.NewDecoder(r.Body)
+	err = decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, 400, fmt.Sprintf("Error decoding parameters: %s", err))
+		return
+	}
+	if params.Decision != "uphold" && params.Decision != "overturn" {
+		respondWithError(w, 400, "decision must be uphold or overturn")
+		return
+	}
+
+	chirpdb, err := NewDB("database.json")
+	if err != nil {
+		fmt.Println(err)
+	}
+
+	appeal, err := chirpdb.DecideAppeal(appealID, adminID, params.Decision == "overturn", params.Response)
+	if errors.Is(err, errNotFound) {
+		respondWithError(w, 404, "Appeal does not exist")
+		return
+	} else if err != nil {
+		respondWithError(w, 400, fmt.Sprintf("Couldn't decide appeal: %s", err))
+		return
+	}
+	respondWithJSON(w, http.StatusOK, appeal)
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCanInteract(t *testing.T) {
+	structure := testStructure(t)
+	for id := 1; id <= 4; id++ {
+		structure.Users[id] = User{ID: id}
+	}
+	structure.Users[4] = User{ID: 4, Status: UserShadowbanned}
+	addEdge(structure.Blocks, 2, 1) // 2 has blocked 1
+	now := time.Now()
+	visible := addTestChirp(structure, 2, "visible chirp", now)
+	hidden := addTestChirp(structure, 3, "held chirp", now)
+	hidden.Hidden = true
+	shadow := addTestChirp(structure, 4, "shadowbanned chirp", now)
+	gone := addTestChirp(structure, 3, "deleted chirp", now)
+	gone.Deleted = true
+
+	tests := []struct {
+		name  string
+		chirp Chirp
+		user  int
+		want  error
+	}{
+		{"visible", visible, 3, nil},
+		{"blocked by the author", visible, 1, errBlocked},
+		{"own chirp", visible, 2, nil},
+		{"hidden", hidden, 1, errNotFound},
+		{"own hidden chirp", hidden, 3, nil},
+		{"shadowbanned author", shadow, 1, errNotFound},
+		{"deleted", gone, 3, errNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := canInteract(structure, tt.chirp, tt.user); !errors.Is(err, tt.want) {
+				t.Errorf("canInteract = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+)
+
+const (
+	NotificationReply      = "reply"
+	NotificationMention    = "mention"
+	NotificationFollow     = "follow"
+	NotificationRedUpgrade = "red_upgrade"
+	// NotificationModeration tells a user about an action taken against
+	// them. It can't be turned off, so it isn't in notificationTypes.
+	NotificationModeration = "moderation"
+)
+
+var notificationTypes = []string{
+	NotificationReply,
+	NotificationMention,
+	NotificationFollow,
+	NotificationRedUpgrade,
+}
+
+type Notification struct {
+	ID        int       `json:"id"`
+	UserID    int       `json:"user_id"`
+	Type      string    `json:"type"`
+	ActorID   int       `json:"actor_id,omitempty"`
+	ChirpID   int       `json:"chirp_id,omitempty"`
+	ActionID  int       `json:"action_id,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	Read      bool      `json:"read"`
+}
+
+// wantsNotification reports whether a user's settings allow notifications
+// of a type. Types are on unless turned off.
+func wantsNotification(user User, kind string) bool {
+	on, ok := user.Settings.Notify[kind]
+	return !ok || on
+}
+
+// notify turns events from the bus into notifications.
+func (db *DB) notify(event Event) {
+	var notes []Notification
+	switch event.Type {
+	case EventChirpCreated:
+		if event.Shadow {
+			return
+		}
+		notes = chirpNotifications(db, event.Chirp)
+	case EventUserFollowed:
+		notes = []Notification{{UserID: event.UserID, Type: NotificationFollow, ActorID: event.ActorID}}
+	case EventUserUpgraded:
+		notes = []Notification{{UserID: event.UserID, Type: NotificationRedUpgrade}}
+	case EventModAction:
+		note := Notification{UserID: event.UserID, Type: NotificationModeration, ActionID: event.Action.ID}
+		if event.Action.TargetType == ReportTargetChirp {
+			note.ChirpID = event.Action.TargetID
+		}
+		notes = []Notification{note}
+	case EventChirpDeleted:
+		err := db.removeChirpNotifications(event.Chirp.ID)
+		if err != nil {
+			fmt.Printf("Couldn't remove notifications: %s\n", err)
+		}
+		return
+	}
+	if len(notes) == 0 {
+		return
+	}
+	err := db.addNotifications(notes, event.At)
+	if err != nil {
+		fmt.Printf("Couldn't add notifications: %s\n", err)
+	}
+}
+
+// chirpNotifications tells the author of the parent of a reply, and
+// everyone mentioned, about a new chirp. Nobody is notified of their own
+// chirp or told twice about the same one.
+func chirpNotifications(db *DB, chirp Chirp) []Notification {
+	var notes []Notification
+	told := []int{chirp.AuthorID}
+	if chirp.InReplyTo != 0 {
+		parent, err := db.GetChirp(chirp.InReplyTo)
+		if err == nil && !slices.Contains(told, parent.AuthorID) {
+			told = append(told, parent.AuthorID)
+			notes = append(notes, Notification{
+				UserID:  parent.AuthorID,
+				Type:    NotificationReply,
+				ActorID: chirp.AuthorID,
+				ChirpID: chirp.ID,
+			})
+		}
+	}
+	// nobody hears about a mention across a block
+	rel, err := db.GetRelations(chirp.AuthorID)
+	if err != nil {
+		return notes
+	}
+	for _, entity := range chirp.Entities {
+		if entity.Type != EntityMention || slices.Contains(told, entity.UserID) || rel.blocks(entity.UserID) {
+			continue
+		}
+		told = append(told, entity.UserID)
+		notes = append(notes, Notification{
+			UserID:  entity.UserID,
+			Type:    NotificationMention,
+			ActorID: chirp.AuthorID,
+			ChirpID: chirp.ID,
+		})
+	}
+	return notes
+}
+
+// addNotifications stores notes for the users that want them and publishes
+// each one stored.
+func (db *DB) addNotifications(notes []Notification, at time.Time) error {
+	var added []Notification
+	err := db.update(func(structure *DBStructure) error {
+		added = nil
+		for _, note := range notes {
+			user, ok := structure.Users[note.UserID]
+			if !ok || !wantsNotification(user, note.Type) {
+				continue
+			}
+			if structure.Users[note.ActorID].Status == UserShadowbanned {
+				continue
+			}
+			structure.LastNotificationID++
+			note.ID = structure.LastNotificationID
+			note.CreatedAt = at
+			structure.Notifications[note.ID] = note
+			addEdge(structure.UserNotifications, note.UserID, note.ID)
+			added = append(added, note)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, note := range added {
+		bus.Publish(Event{Type: EventNotification, UserID: note.UserID, At: at, Notification: note})
+	}
+	return nil
+}
+
+// removeChirpNotifications drops the notifications about a deleted chirp.
+func (db *DB) removeChirpNotifications(chirpID int) error {
+	return db.update(func(structure *DBStructure) error {
+		for id, note := range structure.Notifications {
+			if note.ChirpID == chirpID {
+				delete(structure.Notifications, id)
+				removeEdge(structure.UserNotifications, note.UserID, id)
+			}
+		}
+		return nil
+	})
+}
+
+func unreadNotifications(dbs DBStructure, userID int) int {
+	unread := 0
+	for _, id := range dbs.UserNotifications[userID] {
+		if !dbs.Notifications[id].Read {
+			unread++
+		}
+	}
+	return unread
+}
+
+// GetNotifications returns a page of userID's notifications, newest first,
+// below the notification ID before (0 for the newest), together with the
+// cursor for the next page and the number of unread notifications.
+func (db *DB) GetNotifications(userID int, unreadOnly bool, before, limit int) (notes []Notification, next, unread int, err error) {
+	notes = make([]Notification, 0, limit)
+	dbs, err := db.loadDB()
+	if err != nil {
+		return notes, 0, 0, err
+	}
+	ids := dbs.UserNotifications[userID]
+	for i := len(ids) - 1; i >= 0; i-- {
+		note := dbs.Notifications[ids[i]]
+		if (before > 0 && note.ID >= before) || (unreadOnly && note.Read) {
+			continue
+		}
+		if len(notes) == limit {
+			next = notes[len(notes)-1].ID
+			break
+		}
+		notes = append(notes, note)
+	}
+	return notes, next, unreadNotifications(dbs, userID), nil
+}
+
+// MarkNotificationsRead marks the given notifications of userID as read,
+// or all of them when ids is empty, and returns the new unread count.
+func (db *DB) MarkNotificationsRead(userID int, ids []int) (int, error) {
+	unread := 0
+	err := db.update(func(structure *DBStructure) error {
+		if len(ids) == 0 {
+			ids = structure.UserNotifications[userID]
+		}
+		for _, id := range ids {
+			note, ok := structure.Notifications[id]
+			if !ok || note.UserID != userID {
+				return errNotFound
+			}
+			note.Read = true
+			structure.Notifications[id] = note
+		}
+		unread = unreadNotifications(*structure, userID)
+		return nil
+	})
+	return unread, err
+}
+
+func notificationsHandler(w http.ResponseWriter, r *http.Request) {
+	type returnVals struct {
+		Notifications []Notification `json:"notifications"`
+		UnreadCount   int            `json:"unread_count"`
+		NextCursor    string         `json:"next_cursor,omitempty"`
+	}
+
+	validity, userID := IsJWTValid(w, r)
+	if !validity {
+		return
+	}
+
+	limit, err := parseLimit(r.URL.Query().Get("limit"))
+	if err != nil {
+		respondWithError(w, 400, err.Error())
+		return
+	}
+	before, err := decodeCursor(r.URL.Query().Get("cursor"))
+	if err != nil {
+		respondWithError(w, 400, err.Error())
+		return
+	}
+	unreadOnly := r.URL.Query().Get("unread") == "true"
+
+	chirpdb, err := NewDB("database.json")
+	if err != nil {
+		fmt.Println(err)
+	}
+
+	notes, next, unread, err := chirpdb.GetNotifications(userID, unreadOnly, before, limit)
+	if err != nil {
+		respondWithError(w, 500, fmt.Sprintf("Couldn't load notifications: %s", err))
+		return
+	}
+	respondWithJSON(w, http.StatusOK, returnVals{
+		Notifications: notes,
+		UnreadCount:   unread,
+		NextCursor:    encodeCursor(next),
+	})
+}
+
+// readNotificationsHandler serves both POST /api/notifications/read, which
+// takes an optional list of IDs and otherwise marks everything read, and
+// POST /api/notifications/{id}/read.
+func readNotificationsHandler(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		IDs []int `json:"ids"`
+	}
+	type returnVals struct {
+		UnreadCount int `json:"unread_count"`
+	}
+
+	validity, userID := IsJWTValid(w, r)
+	if !validity {
+		return
+	}
+
+	params := parameters{}
+	if pathVal := r.PathValue("id"); pathVal != "" {
+		id, err := strconv.Atoi(pathVal)
+		if err != nil {
+			respondWithError(w, 400, fmt.Sprintf("Cannot convert %s to integer", pathVal))
+			return
+		}
+		params.IDs = []int{id}
+	} else if r.ContentLength != 0 {
+		decoder := json.NewDecoder(r.Body)
+		err := decoder.Decode(&params)
+		if err != nil {
+			respondWithError(w, 400, fmt.Sprintf("Error decoding parameters: %s", err))
+			return
+		}
+	}
+
+	chirpdb, err := NewDB("database.json")
+	if err != nil {
+		fmt.Println(err)
+	}
+
+	unread, err := chirpdb.MarkNotificationsRead(userID, params.IDs)
+	if err != nil {
+		respondWithError(w, 404, "Notification does not exist")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, returnVals{UnreadCount: unread})
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	minPollOptions   = 2
+	maxPollOptions   = 4
+	maxPollOptionLen = 25
+	minPollDuration  = 5 * time.Minute
+)
+
+// errAlreadyVoted is returned by Vote when the user has voted before.
+var errAlreadyVoted = errors.New("you have already voted in this poll")
+
+// Poll is attached to a chirp at creation. Votes holds the tally for each
+// option and is kept in step with DBStructure.PollVotes inside the same
+// update, like reaction counts.
+type Poll struct {
+	Options     []string  `json:"options"`
+	Votes       []int     `json:"votes,omitempty"`
+	TotalVotes  int       `json:"total_votes"`
+	ClosesAt    time.Time `json:"closes_at"`
+	HideResults bool      `json:"hide_results,omitempty"`
+	// Duration is how long a new poll stays open. checkPoll turns it into
+	// ClosesAt, measured from the chirp's creation time.
+	Duration time.Duration `json:"-"`
+	// Closed and VotedFor are filled in on the way out and never stored.
+	Closed   bool `json:"closed"`
+	VotedFor *int `json:"voted_for,omitempty"`
+}
+
+// maxPollDuration is how long a poll may stay open, from POLL_MAX_DURATION.
+func maxPollDuration() time.Duration {
+	return envDuration("POLL_MAX_DURATION", 7*24*time.Hour)
+}
+
+// checkPoll validates the poll of a chirp about to be created at now and
+// resets its tallies.
+func checkPoll(chirp *Chirp, now time.Time) error {
+	poll := chirp.Poll
+	if poll == nil {
+		return nil
+	}
+	if chirp.Kind == ChirpKindRechirp {
+		return errors.New("a rechirp can't have a poll")
+	}
+	if len(poll.Options) < minPollOptions || len(poll.Options) > maxPollOptions {
+		return fmt.Errorf("a poll needs %d to %d options", minPollOptions, maxPollOptions)
+	}
+	for i, option := range poll.Options {
+		option = strings.TrimSpace(option)
+		if option == "" {
+			return errors.New("poll options can't be empty")
+		}
+		if utf8.RuneCountInString(option) > maxPollOptionLen {
+			return fmt.Errorf("poll options can be at most %d characters", maxPollOptionLen)
+		}
+		if slices.Contains(poll.Options[:i], option) {
+			return errors.New("poll options must be different")
+		}
+		poll.Options[i] = option
+	}
+	if poll.Duration < minPollDuration || poll.Duration > maxPollDuration() {
+		return fmt.Errorf("a poll must stay open between %s and %s", minPollDuration, maxPollDuration())
+	}
+	chirp.Poll = &Poll{
+		Options:     poll.Options,
+		Votes:       make([]int, len(poll.Options)),
+		ClosesAt:    now.Add(poll.Duration).UTC(),
+		HideResults: poll.HideResults,
+	}
+	return nil
+}
+
+// viewPoll returns a copy of a chirp's poll as viewerID sees it. Tallies
+// of a poll with HideResults stay hidden until it closes.
+func viewPoll(dbs DBStructure, chirp Chirp, viewerID int) *Poll {
+	if chirp.Poll == nil {
+		return nil
+	}
+	poll := *chirp.Poll
+	poll.Votes = slices.Clone(poll.Votes)
+	poll.Closed = !time.Now().Before(poll.ClosesAt)
+	if poll.HideResults && !poll.Closed {
+		poll.Votes = nil
+	}
+	poll.VotedFor = nil
+	if option, ok := dbs.PollVotes[chirp.ID][viewerID]; ok && viewerID != 0 {
+		poll.VotedFor = &option
+	}
+	return &poll
+}
+
+// Vote records userID's vote for option (counting from 0) in a chirp's
+// poll. The check for an earlier vote and the tally happen in one update,
+// so concurrent requests can't vote twice. The chirp is returned as userID
+// sees it.
+func (db *DB) Vote(chirpID, userID, option int) (Chirp, error) {
+	var chirp Chirp
+	err := db.update(func(structure *DBStructure) error {
+		var ok bool
+		chirp, ok = structure.Chirps[chirpID]
+		if !ok || chirp.Poll == nil {
+			return errNotFound
+		}
+		err := canInteract(*structure, chirp, userID)
+		if err != nil {
+			return err
+		}
+		if !time.Now().Before(chirp.Poll.ClosesAt) {
+			return errors.New("this poll has closed")
+		}
+		if option < 0 || option >= len(chirp.Poll.Options) {
+			return fmt.Errorf("option must be between 0 and %d", len(chirp.Poll.Options)-1)
+		}
+		if _, voted := structure.PollVotes[chirpID][userID]; voted {
+			return errAlreadyVoted
+		}
+		if structure.PollVotes[chirpID] == nil {
+			structure.PollVotes[chirpID] = make(map[int]int)
+		}
+		structure.PollVotes[chirpID][userID] = option
+
+		poll := *chirp.Poll
+		poll.Votes = slices.Clone(poll.Votes)
+		poll.Votes[option]++
+		poll.TotalVotes++
+		chirp.Poll = &poll
+		structure.Chirps[chirpID] = chirp
+		chirp = viewChirp(*structure, chirp, userID)
+		return nil
+	})
+	if err != nil {
+		return Chirp{}, err
+	}
+	fmt.Printf("User %v voted %v in poll %v\n", userID, option, chirpID)
+	return chirp, nil
+}
+
+func voteHandler(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Option *int `json:"option"`
+	}
+	type returnVals struct {
+		ChirpID int   `json:"chirp_id"`
+		Poll    *Poll `json:"poll"`
+	}
+
+	validity, userID := IsJWTValid(w, r)
+	if !validity {
+		return
+	}
+
+	pathVal := r.PathValue("id")
+	chirpID, err := strconv.Atoi(pathVal)
+	if err != nil {
+		respondWithError(w, 400, fmt.Sprintf("Cannot convert %s to integer", pathVal))
+		return
+	}
+
+	params := parameters{}
+	decoder := json.NewDecoder(r.Body)
+	err = decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, 400, fmt.Sprintf("Error decoding parameters: %s", err))
+		return
+	}
+	if params.Option == nil {
+		respondWithError(w, 400, "No option provided")
+		return
+	}
+
+	chirpdb, err := NewDB("database.json")
+	if err != nil {
+		fmt.Println(err)
+	}
+
+	chirp, err := chirpdb.Vote(chirpID, userID, *params.Option)
+	if errors.Is(err, errAlreadyVoted) {
+		respondWithError(w, 409, err.Error())
+		return
+	} else if errors.Is(err, errBlocked) {
+		respondWithError(w, 403, err.Error())
+		return
+	} else if errors.Is(err, errNotFound) {
+		respondWithError(w, 404, "Poll does not exist")
+		return
+	} else if err != nil {
+		respondWithError(w, 400, fmt.Sprintf("Couldn't vote: %s", err))
+		return
+	}
+	respondWithJSON(w, http.StatusOK, returnVals{ChirpID: chirpID, Poll: chirp.Poll})
+}
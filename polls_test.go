@@ -0,0 +1,59 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCheckPollDuration(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		duration time.Duration
+		ok       bool
+	}{
+		{"minimum", minPollDuration, true},
+		{"under minimum", minPollDuration - time.Second, false},
+		{"a day", 24 * time.Hour, true},
+		{"maximum", 7 * 24 * time.Hour, true},
+		{"over maximum", 7*24*time.Hour + time.Second, false},
+		{"unset", 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chirp := Chirp{Poll: &Poll{Options: []string{"yes", "no"}, Duration: tt.duration}}
+			err := checkPoll(&chirp, now)
+			if (err == nil) != tt.ok {
+				t.Fatalf("checkPoll with %s: error %v", tt.duration, err)
+			}
+			if err == nil && !chirp.Poll.ClosesAt.Equal(now.Add(tt.duration)) {
+				t.Errorf("ClosesAt = %s, want %s", chirp.Poll.ClosesAt, now.Add(tt.duration))
+			}
+		})
+	}
+}
+
+func TestCheckPollOptions(t *testing.T) {
+	tests := []struct {
+		name    string
+		options []string
+		ok      bool
+	}{
+		{"two", []string{"yes", "no"}, true},
+		{"four", []string{"a", "b", "c", "d"}, true},
+		{"one", []string{"yes"}, false},
+		{"five", []string{"a", "b", "c", "d", "e"}, false},
+		{"blank", []string{"yes", "  "}, false},
+		{"duplicate after trimming", []string{"yes", " yes "}, false},
+		{"too long", []string{"yes", "this option is far too long to fit"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chirp := Chirp{Poll: &Poll{Options: tt.options, Duration: time.Hour}}
+			err := checkPoll(&chirp, time.Now())
+			if (err == nil) != tt.ok {
+				t.Errorf("checkPoll(%q): error %v", tt.options, err)
+			}
+		})
+	}
+}
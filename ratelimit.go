@@ -0,0 +1,271 @@
+package main
+
+import (
+	"fmt"
+	"github.com/joho/godotenv"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rateLimitPolicy allows Limit requests per Window, or RedLimit for Chirpy
+// Red subscribers, refilling steadily rather than all at once. A zero
+// Limit means no limit.
+type rateLimitPolicy struct {
+	Limit    int
+	RedLimit int
+	Window   time.Duration
+	// ByIP keys the policy on the client IP even for signed-in users, for
+	// routes that are abused before anyone has a token.
+	ByIP bool
+}
+
+// rateLimitPolicies are matched against the route pattern a request is
+// served by, with its method in front. Routes not listed share
+// defaultRateLimit.
+var rateLimitPolicies = map[string]rateLimitPolicy{
+	"POST /api/login":             {Limit: 5, Window: time.Minute, ByIP: true},
+	"POST /api/users":             {Limit: 3, Window: time.Hour, ByIP: true},
+	"PUT /api/users":              {Limit: 10, Window: time.Hour},
+	"POST /api/refresh":           {Limit: 30, Window: time.Hour},
+	"POST /api/chirps":            {Limit: 10, RedLimit: 30, Window: time.Minute},
+	"PATCH /api/chirps/{id}":      {Limit: 10, RedLimit: 30, Window: time.Minute},
+	"POST /api/chirps/{id}/votes": {Limit: 30, Window: time.Minute},
+	"POST /api/media":             {Limit: 20, RedLimit: 60, Window: time.Hour},
+	"POST /api/drafts":            {Limit: 30, RedLimit: 90, Window: time.Hour},
+	"POST /api/reports":           {Limit: 20, Window: time.Hour},
+	"POST /api/appeals":           {Limit: 5, Window: time.Hour},
+	"POST /api/conversations":     {Limit: 10, RedLimit: 30, Window: time.Hour},
+
+	"POST /api/conversations/{id}/messages": {Limit: 30, RedLimit: 60, Window: time.Minute},
+	"POST /api/chirps/{id}/reactions":       {Limit: 60, RedLimit: 120, Window: time.Minute},
+
+	"GET /api/search": {Limit: 30, RedLimit: 90, Window: time.Minute},
+	"GET /api/stream": {Limit: 10, Window: time.Minute},
+	"GET /api/ws":     {Limit: 10, Window: time.Minute},
+
+	// Polka retries on its own schedule, and health checks are cheap
+	"POST /api/polka/webhooks": {},
+	"GET /api/healthz":         {},
+	"GET /app/":                {},
+}
+
+var defaultRateLimit = rateLimitPolicy{Limit: 300, RedLimit: 600, Window: time.Minute}
+
+func (p rateLimitPolicy) limit(red bool) int {
+	if red && p.RedLimit > p.Limit {
+		return p.RedLimit
+	}
+	return p.Limit
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter keeps one token bucket per policy and client. Idle buckets
+// are forgotten now and then; by then they are full, as a new one would be.
+// It also remembers which users are Chirpy Red, so most requests are
+// limited without reading the database.
+type rateLimiter struct {
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+	red       map[int]bool
+}
+
+var limiter = &rateLimiter{buckets: make(map[string]*tokenBucket), red: make(map[int]bool)}
+
+// Observe keeps the Chirpy Red cache current from the event bus. Nobody
+// stops being Red, so upgrades are the only change.
+func (l *rateLimiter) Observe(event Event) {
+	if event.Type == EventUserUpgraded {
+		l.mu.Lock()
+		l.red[event.UserID] = true
+		l.mu.Unlock()
+	}
+}
+
+// isRed reports whether userID is a Chirpy Red subscriber, reading the
+// database only the first time it is asked about them.
+func (l *rateLimiter) isRed(userID int) bool {
+	l.mu.Lock()
+	red, ok := l.red[userID]
+	l.mu.Unlock()
+	if ok {
+		return red
+	}
+	chirpdb, err := NewDB("database.json")
+	if err != nil {
+		return false
+	}
+	user, err := chirpdb.GetUser(userID)
+	if err != nil {
+		// not cached, so a user created later is looked up then
+		return false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	// an upgrade seen meanwhile wins over what was read
+	l.red[userID] = l.red[userID] || user.IsChirpyRed
+	return l.red[userID]
+}
+
+// take spends a token from the bucket for key if there is one. It returns
+// the tokens left and how long until the next one.
+func (l *rateLimiter) take(key string, limit int, window time.Duration, now time.Time) (bool, int, time.Duration) {
+	rate := float64(limit) / window.Seconds()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now.Sub(l.lastSweep) > time.Minute {
+		l.sweep(now)
+	}
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: float64(limit), last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = min(float64(limit), b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+	if b.tokens < 1 {
+		wait := time.Duration((1 - b.tokens) / rate * float64(time.Second))
+		return false, 0, wait
+	}
+	b.tokens--
+	return true, int(b.tokens), time.Duration((float64(limit) - b.tokens) / rate * float64(time.Second))
+}
+
+// takeUser spends a token from a route's policy for a signed-in user, for
+// requests that reach the route's work some other way, such as chirps
+// posted over the websocket. It shares the bucket rateLimit uses.
+func (l *rateLimiter) takeUser(pattern string, userID int, now time.Time) (bool, time.Duration) {
+	policy := rateLimitPolicies[pattern]
+	client := fmt.Sprintf("user:%v", userID)
+	allowed, _, wait := l.take(pattern+"|"+client, policy.limit(l.isRed(userID)), policy.Window, now)
+	return allowed, wait
+}
+
+// sweep drops buckets that have been idle for an hour, as long as the
+// longest policy window takes to refill. Callers must hold l.mu.
+func (l *rateLimiter) sweep(now time.Time) {
+	for key, b := range l.buckets {
+		if now.Sub(b.last) > time.Hour {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastSweep = now
+}
+
+// rateLimit applies the policy for each request's route before handing it
+// to next; sm is only used to look up the route.
+func rateLimit(sm *http.ServeMux, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, pattern := sm.Handler(r)
+		if !strings.Contains(pattern, " ") {
+			pattern = r.Method + " " + pattern
+		}
+		policy, ok := rateLimitPolicies[pattern]
+		if !ok {
+			policy = defaultRateLimit
+		}
+		if policy.Limit == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		client, red := "ip:"+clientIP(r), false
+		if !policy.ByIP {
+			// restricted accounts are turned away by the handler; here a
+			// valid token is enough to tell clients apart
+			if userID := tokenUserID(r); userID != 0 {
+				client = fmt.Sprintf("user:%v", userID)
+				red = limiter.isRed(userID)
+			}
+		}
+		limit := policy.limit(red)
+		allowed, remaining, wait := limiter.take(pattern+"|"+client, limit, policy.Window, time.Now())
+
+		w.Header().Set("RateLimit-Limit", strconv.Itoa(limit))
+		w.Header().Set("RateLimit-Remaining", strconv.Itoa(remaining))
+		w.Header().Set("RateLimit-Reset", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		w.Header().Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d", limit, int(policy.Window.Seconds())))
+		if !allowed {
+			retryAfter := int(math.Ceil(wait.Seconds()))
+			w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+			respondWithError(w, 429, fmt.Sprintf("Too many requests, try again in %d seconds", retryAfter))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// clientIP is the address the request came from. Behind a proxy listed in
+// TRUSTED_PROXIES (IPs or CIDRs, comma separated) it is the last address in
+// X-Forwarded-For that isn't one of those proxies; anything further left
+// could have been made up by the client.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	trusted := trustedProxies()
+	if !isTrusted(host, trusted) {
+		return host
+	}
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if net.ParseIP(hop) == nil {
+			break
+		}
+		host = hop
+		if !isTrusted(hop, trusted) {
+			break
+		}
+	}
+	return host
+}
+
+func trustedProxies() []*net.IPNet {
+	godotenv.Load()
+	var nets []*net.IPNet
+	for _, entry := range strings.Split(os.Getenv("TRUSTED_PROXIES"), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			if strings.Contains(entry, ":") {
+				entry += "/128"
+			} else {
+				entry += "/32"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			fmt.Printf("Bad entry in TRUSTED_PROXIES: %s\n", entry)
+			continue
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets
+}
+
+func isTrusted(addr string, trusted []*net.IPNet) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, ipNet := range trusted {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
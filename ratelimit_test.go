@@ -0,0 +1,149 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	type step struct {
+		after     time.Duration // since start
+		key       string
+		allowed   bool
+		remaining int
+		wait      time.Duration
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{"burst up to the limit", []step{
+			{0, "a", true, 2, 20 * time.Second},
+			{0, "a", true, 1, 40 * time.Second},
+			{0, "a", true, 0, time.Minute},
+			{0, "a", false, 0, 20 * time.Second},
+		}},
+		{"refills steadily", []step{
+			{0, "a", true, 2, 20 * time.Second},
+			{0, "a", true, 1, 40 * time.Second},
+			{0, "a", true, 0, time.Minute},
+			{10 * time.Second, "a", false, 0, 10 * time.Second},
+			{20 * time.Second, "a", true, 0, time.Minute},
+			{30 * time.Second, "a", false, 0, 10 * time.Second},
+		}},
+		{"never holds more than the limit", []step{
+			{0, "a", true, 2, 20 * time.Second},
+			{time.Hour, "a", true, 2, 20 * time.Second},
+		}},
+		{"keys are separate", []step{
+			{0, "a", true, 2, 20 * time.Second},
+			{0, "a", true, 1, 40 * time.Second},
+			{0, "a", true, 0, time.Minute},
+			{0, "b", true, 2, 20 * time.Second},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := &rateLimiter{buckets: make(map[string]*tokenBucket), lastSweep: start}
+			for i, s := range tt.steps {
+				allowed, remaining, wait := l.take(s.key, 3, time.Minute, start.Add(s.after))
+				if allowed != s.allowed || remaining != s.remaining || wait != s.wait {
+					t.Errorf("step %d: take = %t, %d, %s; want %t, %d, %s",
+						i, allowed, remaining, wait, s.allowed, s.remaining, s.wait)
+				}
+			}
+		})
+	}
+}
+
+func TestRateLimitSweep(t *testing.T) {
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	l := &rateLimiter{buckets: make(map[string]*tokenBucket), lastSweep: start}
+	l.take("old", 3, time.Minute, start)
+	l.take("new", 3, time.Minute, start.Add(time.Hour))
+	l.take("new", 3, time.Minute, start.Add(time.Hour+2*time.Minute))
+	if _, ok := l.buckets["old"]; ok {
+		t.Error("idle bucket wasn't swept")
+	}
+	if _, ok := l.buckets["new"]; !ok {
+		t.Error("active bucket was swept")
+	}
+}
+
+func TestRateLimitPolicyLimit(t *testing.T) {
+	p := rateLimitPolicy{Limit: 10, RedLimit: 30, Window: time.Minute}
+	if got := p.limit(false); got != 10 {
+		t.Errorf("limit(false) = %d, want 10", got)
+	}
+	if got := p.limit(true); got != 30 {
+		t.Errorf("limit(true) = %d, want 30", got)
+	}
+	if got := (rateLimitPolicy{Limit: 5}).limit(true); got != 5 {
+		t.Errorf("limit(true) without RedLimit = %d, want 5", got)
+	}
+}
+
+func TestRedCache(t *testing.T) {
+	l := &rateLimiter{buckets: make(map[string]*tokenBucket), red: map[int]bool{7: false}}
+	if l.isRed(7) {
+		t.Fatal("cached user is Red before upgrading")
+	}
+	l.Observe(Event{Type: EventUserUpgraded, UserID: 7})
+	if !l.isRed(7) {
+		t.Error("upgrade didn't reach the cache")
+	}
+}
+
+func TestTakeUser(t *testing.T) {
+	l := &rateLimiter{buckets: make(map[string]*tokenBucket), red: map[int]bool{7: false, 8: true}}
+	now := time.Now()
+	for i := 0; i < 10; i++ {
+		if ok, _ := l.takeUser("POST /api/chirps", 7, now); !ok {
+			t.Fatalf("post %d refused", i+1)
+		}
+	}
+	ok, wait := l.takeUser("POST /api/chirps", 7, now)
+	if ok || wait != 6*time.Second {
+		t.Errorf("11th post: allowed %t, wait %v, want refused for 6s", ok, wait)
+	}
+	// the bucket is the one rateLimit spends from for the route
+	if b := l.buckets["POST /api/chirps|user:7"]; b == nil || b.tokens >= 1 {
+		t.Errorf("takeUser didn't spend from the route's bucket: %+v", b)
+	}
+	for i := 0; i < 30; i++ {
+		if ok, _ := l.takeUser("POST /api/chirps", 8, now); !ok {
+			t.Fatalf("Red post %d refused", i+1)
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		name    string
+		trusted string
+		remote  string
+		xff     string
+		want    string
+	}{
+		{"direct", "", "203.0.113.5:1234", "", "203.0.113.5"},
+		{"untrusted proxy", "", "10.0.0.1:1234", "198.51.100.7", "10.0.0.1"},
+		{"trusted proxy", "10.0.0.1", "10.0.0.1:1234", "198.51.100.7", "198.51.100.7"},
+		{"spoofed hop", "10.0.0.0/8", "10.0.0.1:1234", "1.2.3.4, 198.51.100.7, 10.0.0.2", "198.51.100.7"},
+		{"garbage hop", "10.0.0.1", "10.0.0.1:1234", "nonsense", "10.0.0.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("TRUSTED_PROXIES", tt.trusted)
+			r := httptest.NewRequest("GET", "/api/chirps", nil)
+			r.RemoteAddr = tt.remote
+			if tt.xff != "" {
+				r.Header.Set("X-Forwarded-For", tt.xff)
+			}
+			if got := clientIP(r); got != tt.want {
+				t.Errorf("clientIP = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/joho/godotenv"
+)
+
+// likeReaction is always allowed, and is what GET /api/users/{id}/likes
+// lists.
+const likeReaction = "❤️"
+
+// allowedReactions returns the emoji users may react with: the like plus
+// whatever CHIRP_REACTIONS lists, comma separated.
+func allowedReactions() []string {
+	godotenv.Load()
+	allowed := []string{likeReaction}
+	configured := os.Getenv("CHIRP_REACTIONS")
+	if configured == "" {
+		configured = "👍,😂,😮,😢,🔥"
+	}
+	for _, emoji := range strings.Split(configured, ",") {
+		emoji = strings.TrimSpace(emoji)
+		if emoji != "" && !slices.Contains(allowed, emoji) {
+			allowed = append(allowed, emoji)
+		}
+	}
+	return allowed
+}
+
+// AddReaction records userID reacting to a chirp with emoji and keeps the
+// chirp's aggregated counts in step, all in one update. The chirp is
+// returned as userID sees it.
+func (db *DB) AddReaction(chirpID, userID int, emoji string) (Chirp, error) {
+	return db.changeReaction(chirpID, userID, emoji, true)
+}
+
+func (db *DB) RemoveReaction(chirpID, userID int, emoji string) (Chirp, error) {
+	return db.changeReaction(chirpID, userID, emoji, false)
+}
+
+func (db *DB) changeReaction(chirpID, userID int, emoji string, add bool) (Chirp, error) {
+	var chirp Chirp
+	err := db.update(func(structure *DBStructure) error {
+		var ok bool
+		chirp, ok = structure.Chirps[chirpID]
+		if !ok || chirp.Deleted {
+			return errNotFound
+		}
+		// taking a reaction back is always allowed
+		if add {
+			err := canInteract(*structure, chirp, userID)
+			if err != nil {
+				return err
+			}
+		}
+		if structure.Reactions[chirpID] == nil {
+			structure.Reactions[chirpID] = make(map[string][]int)
+		}
+		byEmoji := structure.Reactions[chirpID]
+		if add {
+			addEdge(byEmoji, emoji, userID)
+		} else {
+			removeEdge(byEmoji, emoji, userID)
+		}
+		if len(byEmoji) == 0 {
+			delete(structure.Reactions, chirpID)
+		}
+		if emoji == likeReaction {
+			if add {
+				addEdge(structure.Likes, userID, chirpID)
+			} else {
+				removeEdge(structure.Likes, userID, chirpID)
+			}
+		}
+
+		chirp.Reactions = nil
+		for e, users := range byEmoji {
+			if chirp.Reactions == nil {
+				chirp.Reactions = make(map[string]int)
+			}
+			chirp.Reactions[e] = len(users)
+		}
+		structure.Chirps[chirpID] = chirp
+		chirp = viewChirp(*structure, chirp, userID)
+		return nil
+	})
+	return chirp, err
+}
+
+// removeReactions forgets every reaction to a chirp that is being deleted.
+func removeReactions(structure DBStructure, chirpID int) {
+	for _, userID := range structure.Reactions[chirpID][likeReaction] {
+		removeEdge(structure.Likes, userID, chirpID)
+	}
+	delete(structure.Reactions, chirpID)
+}
+
+// reactedBy lists the emoji viewerID has reacted to a chirp with.
+func reactedBy(dbs DBStructure, chirpID, viewerID int) []string {
+	var reacted []string
+	for emoji, users := range dbs.Reactions[chirpID] {
+		if _, found := slices.BinarySearch(users, viewerID); found {
+			reacted = append(reacted, emoji)
+		}
+	}
+	slices.Sort(reacted)
+	return reacted
+}
+
+// GetLikes returns the chirps userID has liked, most recent chirp first,
+// paginated like the home timeline.
+func (db *DB) GetLikes(userID, viewerID, before, limit int) ([]Chirp, int, error) {
+	dbs, err := db.loadDB()
+	if err != nil {
+		return make([]Chirp, 0), 0, err
+	}
+	if _, ok := dbs.Users[userID]; !ok {
+		return make([]Chirp, 0), 0, errNotFound
+	}
+	chirps, next := pageChirpIDs(dbs, dbs.Likes[userID], viewerID, before, limit)
+	return chirps, next, nil
+}
+
+func reactionHandler(w http.ResponseWriter, r *http.Request) {
+	type returnVals struct {
+		ChirpID     int            `json:"chirp_id"`
+		Reactions   map[string]int `json:"reactions"`
+		ReactedByMe []string       `json:"reacted_by_me"`
+	}
+
+	validity, userID := IsJWTValid(w, r)
+	if !validity {
+		return
+	}
+
+	pathVal := r.PathValue("id")
+	chirpID, err := strconv.Atoi(pathVal)
+	if err != nil {
+		respondWithError(w, 400, fmt.Sprintf("Cannot convert %s to integer", pathVal))
+		return
+	}
+
+	emoji := r.URL.Query().Get("emoji")
+	if r.Method == "POST" {
+		type parameters struct {
+			Emoji string `json:"emoji"`
+		}
+		params := parameters{}
+		decoder := json.NewDecoder(r.Body)
+		err = decoder.Decode(&params)
+		if err != nil {
+			respondWithError(w, 400, fmt.Sprintf("Error decoding parameters: %s", err))
+			return
+		}
+		emoji = params.Emoji
+	}
+	if emoji == "" {
+		emoji = likeReaction
+	}
+	if !slices.Contains(allowedReactions(), emoji) {
+		respondWithError(w, 400, fmt.Sprintf("Reaction %s is not allowed", emoji))
+		return
+	}
+
+	chirpdb, err := NewDB("database.json")
+	if err != nil {
+		fmt.Println(err)
+	}
+
+	var chirp Chirp
+	if r.Method == "POST" {
+		chirp, err = chirpdb.AddReaction(chirpID, userID, emoji)
+	} else {
+		chirp, err = chirpdb.RemoveReaction(chirpID, userID, emoji)
+	}
+	if errors.Is(err, errBlocked) {
+		respondWithError(w, 403, err.Error())
+		return
+	} else if err != nil {
+		respondWithError(w, 404, fmt.Sprintf("Chirp does not exist: %s", err))
+		return
+	}
+
+	retVals := returnVals{
+		ChirpID:     chirpID,
+		Reactions:   chirp.Reactions,
+		ReactedByMe: chirp.ReactedByMe,
+	}
+	if retVals.Reactions == nil {
+		retVals.Reactions = map[string]int{}
+	}
+	if retVals.ReactedByMe == nil {
+		retVals.ReactedByMe = []string{}
+	}
+	respondWithJSON(w, http.StatusOK, retVals)
+}
+
+func userLikesHandler(w http.ResponseWriter, r *http.Request) {
+	pathVal := r.PathValue("id")
+	userID, err := strconv.Atoi(pathVal)
+	if err != nil {
+		respondWithError(w, 400, fmt.Sprintf("Cannot convert %s to integer", pathVal))
+		return
+	}
+	respondWithChirpPage(w, r, func(db *DB, viewerID, before, limit int) ([]Chirp, int, error) {
+		return db.GetLikes(userID, viewerID, before, limit)
+	})
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+)
+
+// Chirp kinds besides an ordinary chirp. Both point at the original
+// through RefID.
+const (
+	ChirpKindRechirp = "rechirp"
+	ChirpKindQuote   = "quote"
+)
+
+// resolveReference checks that a rechirp or quote points at a live chirp.
+// Rechirping a rechirp shares the chirp it points at instead.
+func resolveReference(structure *DBStructure, newChirp *Chirp) error {
+	switch newChirp.Kind {
+	case "":
+		newChirp.RefID = 0
+		return nil
+	case ChirpKindRechirp, ChirpKindQuote:
+	default:
+		return errors.New("unknown chirp kind")
+	}
+	ref, ok := structure.Chirps[newChirp.RefID]
+	if !ok || ref.Deleted {
+		return errors.New("referenced chirp not found")
+	}
+	if ref.Kind == ChirpKindRechirp {
+		ref, ok = structure.Chirps[ref.RefID]
+		if !ok || ref.Deleted {
+			return errors.New("referenced chirp not found")
+		}
+	}
+	if blocked(*structure, ref.AuthorID, newChirp.AuthorID) {
+		return errBlocked
+	}
+	newChirp.RefID = ref.ID
+	if newChirp.Kind != ChirpKindRechirp {
+		return nil
+	}
+	if newChirp.InReplyTo != 0 {
+		return errors.New("a rechirp can't be a reply")
+	}
+	newChirp.Body = ""
+	newChirp.MediaIDs = nil
+	for _, id := range structure.References[ref.ID] {
+		other := structure.Chirps[id]
+		if other.Kind == ChirpKindRechirp && other.AuthorID == newChirp.AuthorID {
+			return errors.New("chirp already rechirped")
+		}
+	}
+	return nil
+}
+
+// addReference counts a new rechirp or quote against its original.
+func addReference(structure DBStructure, chirp Chirp) {
+	if chirp.RefID == 0 {
+		return
+	}
+	addEdge(structure.References, chirp.RefID, chirp.ID)
+	ref := structure.Chirps[chirp.RefID]
+	if chirp.Kind == ChirpKindRechirp {
+		ref.RechirpCount++
+	} else {
+		ref.QuoteCount++
+	}
+	structure.Chirps[ref.ID] = ref
+}
+
+// removeReference undoes addReference when a rechirp or quote is deleted.
+// The original may already be gone.
+func removeReference(structure DBStructure, chirp Chirp) {
+	if chirp.RefID == 0 {
+		return
+	}
+	removeEdge(structure.References, chirp.RefID, chirp.ID)
+	ref, ok := structure.Chirps[chirp.RefID]
+	if !ok {
+		return
+	}
+	if chirp.Kind == ChirpKindRechirp {
+		ref.RechirpCount = max(ref.RechirpCount-1, 0)
+	} else {
+		ref.QuoteCount = max(ref.QuoteCount-1, 0)
+	}
+	structure.Chirps[ref.ID] = ref
+}
+
+// embedReference attaches the original of a rechirp or quote. An original
+// that has since been deleted, or that the viewer can't see, is embedded as
+// a bare tombstone so clients can say so.
+func embedReference(dbs DBStructure, chirp Chirp, viewerID int) *Chirp {
+	if chirp.RefID == 0 {
+		return nil
+	}
+	ref, ok := dbs.Chirps[chirp.RefID]
+	if !ok || ref.Deleted || !canView(dbs, ref, viewerID) {
+		return &Chirp{ID: chirp.RefID, Deleted: true}
+	}
+	ref = viewChirp(dbs, ref, viewerID)
+	ref.RefChirp = nil
+	return &ref
+}
+
+// embedReferenceFor loads the original of a freshly created rechirp or
+// quote for the creation response.
+func embedReferenceFor(db *DB, chirp Chirp, viewerID int) *Chirp {
+	dbs, err := db.loadDB()
+	if err != nil {
+		return nil
+	}
+	ref := embedReference(dbs, chirp, viewerID)
+	if ref != nil {
+		ref.Body = cleanupBadWords(ref.Body)
+	}
+	return ref
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+const maxSearchUsers = 10
+
+var errEmptyQuery = errors.New("search query has no words to search for")
+
+// tokenize splits text into lower-cased words, dropping punctuation, so
+// "#Go!" and "go" index the same way.
+func tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !isWordRune(r)
+	})
+}
+
+// indexSearchTerms adds a chirp's words to the inverted index, remembering
+// where each one appears so phrase queries can check adjacency.
+func indexSearchTerms(structure DBStructure, chirp Chirp) {
+	for pos, term := range tokenize(chirp.Body) {
+		postings := structure.SearchIndex[term]
+		if postings == nil {
+			postings = make(map[int][]int)
+			structure.SearchIndex[term] = postings
+		}
+		postings[chirp.ID] = append(postings[chirp.ID], pos)
+	}
+}
+
+func unindexSearchTerms(structure DBStructure, chirp Chirp) {
+	for _, term := range tokenize(chirp.Body) {
+		postings := structure.SearchIndex[term]
+		delete(postings, chirp.ID)
+		if len(postings) == 0 {
+			delete(structure.SearchIndex, term)
+		}
+	}
+}
+
+// searchClause is one part of a query: a single word, a word prefix
+// written as "go*", or a quoted phrase.
+type searchClause struct {
+	terms  []string
+	prefix bool
+}
+
+func parseSearchQuery(q string) []searchClause {
+	var clauses []searchClause
+	for i, part := range strings.Split(q, `"`) {
+		if i%2 == 1 {
+			if terms := tokenize(part); len(terms) > 0 {
+				clauses = append(clauses, searchClause{terms: terms})
+			}
+			continue
+		}
+		for _, word := range strings.Fields(part) {
+			prefix := strings.HasSuffix(word, "*")
+			for _, term := range tokenize(word) {
+				clauses = append(clauses, searchClause{terms: []string{term}})
+			}
+			if prefix && len(clauses) > 0 {
+				clauses[len(clauses)-1].prefix = true
+			}
+		}
+	}
+	return clauses
+}
+
+// match returns how often the clause occurs in each chirp that has it.
+func (c searchClause) match(index map[string]map[int][]int) map[int]int {
+	hits := make(map[int]int)
+	if c.prefix {
+		for term, postings := range index {
+			if strings.HasPrefix(term, c.terms[0]) {
+				for id, positions := range postings {
+					hits[id] += len(positions)
+				}
+			}
+		}
+		return hits
+	}
+	for id, positions := range index[c.terms[0]] {
+		for _, pos := range positions {
+			if phraseAt(index, c.terms[1:], id, pos+1) {
+				hits[id]++
+			}
+		}
+	}
+	return hits
+}
+
+func phraseAt(index map[string]map[int][]int, rest []string, id, pos int) bool {
+	for i, term := range rest {
+		if !slices.Contains(index[term][id], pos+i) {
+			return false
+		}
+	}
+	return true
+}
+
+// SearchChirps ranks the chirps matching every clause of q by TF-IDF
+// relevance, boosted towards recent chirps, and returns one page of them.
+// The second return value is the offset of the next page, or 0.
+func (db *DB) SearchChirps(q string, viewerID, offset, limit int) ([]Chirp, int, error) {
+	clauses := parseSearchQuery(q)
+	if len(clauses) == 0 {
+		return nil, 0, errEmptyQuery
+	}
+	dbs, err := db.loadDB()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	total := float64(len(dbs.Chirps))
+	scores := make(map[int]float64)
+	for i, clause := range clauses {
+		hits := clause.match(dbs.SearchIndex)
+		idf := math.Log(1 + total/float64(max(len(hits), 1)))
+		for id := range scores {
+			if _, ok := hits[id]; !ok {
+				delete(scores, id)
+			}
+		}
+		for id, tf := range hits {
+			if _, ok := scores[id]; ok || i == 0 {
+				scores[id] += float64(tf) * idf
+			}
+		}
+	}
+
+	type result struct {
+		chirp Chirp
+		score float64
+	}
+	results := make([]result, 0, len(scores))
+	now := time.Now()
+	for id, score := range scores {
+		chirp, ok := dbs.Chirps[id]
+		if !ok || chirp.Deleted || !canView(dbs, chirp, viewerID) || muted(dbs, chirp, viewerID, now) {
+			continue
+		}
+		ageDays := now.Sub(chirp.CreatedAt).Hours() / 24
+		score *= 1 + 1/(1+max(ageDays, 0))
+		results = append(results, result{chirp: chirp, score: score})
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].score != results[j].score {
+			return results[i].score > results[j].score
+		}
+		return results[i].chirp.ID > results[j].chirp.ID
+	})
+
+	chirps := make([]Chirp, 0, limit)
+	for i := offset; i < len(results) && len(chirps) < limit; i++ {
+		chirps = append(chirps, viewChirp(dbs, results[i].chirp, viewerID))
+	}
+	next := 0
+	if offset+limit < len(results) {
+		next = offset + limit
+	}
+	return chirps, next, nil
+}
+
+// SearchUsers returns users whose handle starts with any word of q,
+// exact matches first. Banned users and users who have blocked viewerID
+// are left out.
+func (db *DB) SearchUsers(q string, viewerID int) ([]User, error) {
+	terms := tokenize(q)
+	users := make([]User, 0)
+	if len(terms) == 0 {
+		return users, nil
+	}
+	dbs, err := db.loadDB()
+	if err != nil {
+		return users, err
+	}
+	for handle, id := range dbs.Handles {
+		if dbs.Users[id].Status == UserBanned || (viewerID != 0 && hasEdge(dbs.Blocks, id, viewerID)) {
+			continue
+		}
+		for _, term := range terms {
+			if strings.HasPrefix(handle, term) {
+				users = append(users, dbs.Users[id])
+				break
+			}
+		}
+	}
+	sort.Slice(users, func(i, j int) bool {
+		iExact := slices.Contains(terms, normalizeHandle(users[i].Handle))
+		jExact := slices.Contains(terms, normalizeHandle(users[j].Handle))
+		if iExact != jExact {
+			return iExact
+		}
+		return users[i].Handle < users[j].Handle
+	})
+	return users[:min(len(users), maxSearchUsers)], nil
+}
+
+// rebuildSearchIndex indexes every chirp from scratch. It is only needed
+// once, for databases written before search existed.
+func (db *DB) rebuildSearchIndex() error {
+	return db.update(func(structure *DBStructure) error {
+		if len(structure.SearchIndex) > 0 {
+			return nil
+		}
+		for _, chirp := range structure.Chirps {
+			if !chirp.Deleted {
+				indexSearchTerms(*structure, chirp)
+			}
+		}
+		return nil
+	})
+}
+
+func searchHandler(w http.ResponseWriter, r *http.Request) {
+	type userVals struct {
+		ID     int    `json:"id"`
+		Handle string `json:"handle"`
+	}
+	type returnVals struct {
+		Chirps     []Chirp    `json:"chirps"`
+		Users      []userVals `json:"users"`
+		NextCursor string     `json:"next_cursor,omitempty"`
+	}
+
+	query := r.URL.Query()
+	q := strings.TrimSpace(query.Get("q"))
+	if q == "" {
+		respondWithError(w, 400, "Search query q is required")
+		return
+	}
+	limit, err := parseLimit(query.Get("limit"))
+	if err != nil {
+		respondWithError(w, 400, err.Error())
+		return
+	}
+	// the search cursor wraps an offset into the ranked results, shifted by
+	// one so that the first page never needs a cursor
+	offset, err := decodeCursor(query.Get("cursor"))
+	if err != nil {
+		respondWithError(w, 400, err.Error())
+		return
+	}
+	offset = max(offset-1, 0)
+
+	chirpdb, err := NewDB("database.json")
+	if err != nil {
+		fmt.Println(err)
+	}
+
+	retVals := returnVals{
+		Chirps: make([]Chirp, 0),
+		Users:  make([]userVals, 0),
+	}
+	viewerID := optionalUserID(r)
+	chirps, next, err := chirpdb.SearchChirps(q, viewerID, offset, limit)
+	if errors.Is(err, errEmptyQuery) {
+		respondWithError(w, 400, "Search query has no words to search for")
+		return
+	} else if err != nil {
+		respondWithError(w, 500, fmt.Sprintf("Couldn't search chirps: %s", err))
+		return
+	}
+	for _, chirp := range chirps {
+		chirp.Body = cleanupBadWords(chirp.Body)
+		retVals.Chirps = append(retVals.Chirps, chirp)
+	}
+	if next > 0 {
+		retVals.NextCursor = encodeCursor(next + 1)
+	}
+	if offset == 0 {
+		users, err := chirpdb.SearchUsers(q, viewerID)
+		if err != nil {
+			respondWithError(w, 500, fmt.Sprintf("Couldn't search users: %s", err))
+			return
+		}
+		for _, user := range users {
+			retVals.Users = append(retVals.Users, userVals{ID: user.ID, Handle: user.Handle})
+		}
+	}
+	respondWithJSON(w, http.StatusOK, retVals)
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseSearchQuery(t *testing.T) {
+	tests := []struct {
+		q    string
+		want []searchClause
+	}{
+		{"", nil},
+		{"  !!  ", nil},
+		{"Go", []searchClause{{terms: []string{"go"}}}},
+		{"#Go! rocks", []searchClause{{terms: []string{"go"}}, {terms: []string{"rocks"}}}},
+		{"gopher*", []searchClause{{terms: []string{"gopher"}, prefix: true}}},
+		{`"hello world"`, []searchClause{{terms: []string{"hello", "world"}}}},
+		{`say "Hello, World!" loudly`, []searchClause{
+			{terms: []string{"say"}},
+			{terms: []string{"hello", "world"}},
+			{terms: []string{"loudly"}},
+		}},
+		{`""`, nil},
+		{`"unterminated phrase`, []searchClause{{terms: []string{"unterminated", "phrase"}}}},
+		{"well-known", []searchClause{{terms: []string{"well"}}, {terms: []string{"known"}}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.q, func(t *testing.T) {
+			if got := parseSearchQuery(tt.q); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseSearchQuery(%q) = %+v, want %+v", tt.q, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSearchClauseMatch(t *testing.T) {
+	structure := testStructure(t)
+	now := time.Now()
+	addTestChirp(structure, 1, "hello world", now)                    // 1
+	addTestChirp(structure, 1, "world hello", now)                    // 2
+	addTestChirp(structure, 1, "hello world, hello world again", now) // 3
+	addTestChirp(structure, 1, "gophers say hello", now)              // 4
+	tests := []struct {
+		name   string
+		clause searchClause
+		want   map[int]int
+	}{
+		{"word", searchClause{terms: []string{"hello"}}, map[int]int{1: 1, 2: 1, 3: 2, 4: 1}},
+		{"phrase", searchClause{terms: []string{"hello", "world"}}, map[int]int{1: 1, 3: 2}},
+		{"reversed phrase", searchClause{terms: []string{"world", "hello"}}, map[int]int{2: 1, 3: 1}},
+		{"phrase across a comma", searchClause{terms: []string{"world", "hello", "world"}}, map[int]int{3: 1}},
+		{"prefix", searchClause{terms: []string{"goph"}, prefix: true}, map[int]int{4: 1}},
+		{"missing", searchClause{terms: []string{"nothing"}}, map[int]int{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.clause.match(structure.SearchIndex); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("match = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSearchChirps(t *testing.T) {
+	db, err := NewDB(filepath.Join(t.TempDir(), "database.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.update(func(structure *DBStructure) error {
+		structure.Users[1] = User{ID: 1}
+		structure.Users[2] = User{ID: 2, Status: UserShadowbanned}
+		for _, c := range []struct {
+			author int
+			body   string
+		}{
+			{1, "gophers love go"},
+			{1, "go go go, said the gopher"},
+			{1, "rust and go"},
+			{2, "go go go go go"},
+			{1, "nothing to see"},
+		} {
+			_, err := createChirp(structure, Chirp{AuthorID: c.author, Body: c.body})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		q      string
+		viewer int
+		offset int
+		limit  int
+		want   []int
+		next   int
+	}{
+		{"ranked by frequency", "go", 0, 0, 10, []int{2, 3, 1}, 0},
+		{"author sees shadowbanned chirp", "go", 2, 0, 10, []int{4, 2, 3, 1}, 0},
+		{"every clause must match", "go rust", 0, 0, 10, []int{3}, 0},
+		{"phrase", `"love go"`, 0, 0, 10, []int{1}, 0},
+		{"prefix", "goph*", 0, 0, 10, []int{2, 1}, 0},
+		{"first page", "go", 0, 0, 2, []int{2, 3}, 2},
+		{"second page", "go", 0, 2, 2, []int{1}, 0},
+		{"no match", "python", 0, 0, 10, []int{}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chirps, next, err := db.SearchChirps(tt.q, tt.viewer, tt.offset, tt.limit)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := chirpIDs(chirps); !reflect.DeepEqual(got, tt.want) || next != tt.next {
+				t.Errorf("SearchChirps(%q) = %v next %d, want %v next %d", tt.q, got, next, tt.want, tt.next)
+			}
+		})
+	}
+	if _, _, err := db.SearchChirps("!!", 0, 0, 10); !errors.Is(err, errEmptyQuery) {
+		t.Errorf("SearchChirps with no words: got error %v, want errEmptyQuery", err)
+	}
+}
+
+func TestSearchUsers(t *testing.T) {
+	db, err := NewDB(filepath.Join(t.TempDir(), "database.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.update(func(structure *DBStructure) error {
+		for _, user := range []User{
+			{ID: 1, Handle: "gopher"},
+			{ID: 2, Handle: "gopher_fan"},
+			{ID: 3, Handle: "gophers_banned", Status: UserBanned},
+			{ID: 4, Handle: "viewer"},
+		} {
+			structure.Users[user.ID] = user
+			structure.Handles[normalizeHandle(user.Handle)] = user.ID
+		}
+		addEdge(structure.Blocks, 2, 4) // gopher_fan has blocked viewer
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handles := func(viewerID int) []string {
+		users, err := db.SearchUsers("gopher", viewerID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out := make([]string, 0, len(users))
+		for _, user := range users {
+			out = append(out, user.Handle)
+		}
+		return out
+	}
+	if got := handles(0); !reflect.DeepEqual(got, []string{"gopher", "gopher_fan"}) {
+		t.Errorf("anonymous search = %v", got)
+	}
+	if got := handles(4); !reflect.DeepEqual(got, []string{"gopher"}) {
+		t.Errorf("search by a blocked viewer = %v", got)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+)
+
+// UserSettings holds the preferences a user can change at /api/settings.
+type UserSettings struct {
+	// DMFollowersOnly refuses new conversations from users who don't
+	// follow this one.
+	DMFollowersOnly bool `json:"dm_followers_only"`
+	// Notify turns notification types on or off; missing types are on.
+	Notify map[string]bool `json:"notify,omitempty"`
+}
+
+func (db *DB) UpdateSettings(userID int, fn func(settings *UserSettings)) (UserSettings, error) {
+	user, err := db.updateUser(userID, func(user *User) {
+		fn(&user.Settings)
+	})
+	return user.Settings, err
+}
+
+func settingsHandler(w http.ResponseWriter, r *http.Request) {
+	validity, userID := IsJWTValid(w, r)
+	if !validity {
+		return
+	}
+
+	chirpdb, err := NewDB("database.json")
+	if err != nil {
+		fmt.Println(err)
+	}
+
+	if r.Method == "GET" {
+		user, err := chirpdb.GetUser(userID)
+		if err != nil {
+			respondWithError(w, 404, fmt.Sprintf("User does not exist: %s", err))
+			return
+		}
+		respondWithJSON(w, http.StatusOK, user.Settings)
+		return
+	}
+
+	// Only the settings present in the body change.
+	type parameters struct {
+		DMFollowersOnly *bool           `json:"dm_followers_only"`
+		Notify          map[string]bool `json:"notify"`
+	}
+	params := parameters{}
+	decoder := json.NewDecoder(r.Body)
+	err = decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, 400, fmt.Sprintf("Error decoding parameters: %s", err))
+		return
+	}
+	for kind := range params.Notify {
+		if !slices.Contains(notificationTypes, kind) {
+			respondWithError(w, 400, fmt.Sprintf("Unknown notification type %s", kind))
+			return
+		}
+	}
+
+	settings, err := chirpdb.UpdateSettings(userID, func(settings *UserSettings) {
+		if params.DMFollowersOnly != nil {
+			settings.DMFollowersOnly = *params.DMFollowersOnly
+		}
+		for kind, on := range params.Notify {
+			if settings.Notify == nil {
+				settings.Notify = make(map[string]bool)
+			}
+			settings.Notify[kind] = on
+		}
+	})
+	if err != nil {
+		respondWithError(w, 404, fmt.Sprintf("Couldn't update settings: %s", err))
+		return
+	}
+	respondWithJSON(w, http.StatusOK, settings)
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Every new chirp is scored by each of spamChecks. The total decides what
+// happens to it: below SPAM_HOLD_SCORE it is posted, from there up to
+// SPAM_REJECT_SCORE it is posted hidden and queued for a moderator, and
+// above that it is refused. A check is a function, so adding one means
+// adding an entry to spamChecks.
+
+const (
+	SpamAllow  = "allow"
+	SpamHold   = "hold"
+	SpamReject = "reject"
+
+	// duplicates are only worth catching in chirps with a few words
+	minHashedTerms = 3
+)
+
+type SpamSignal struct {
+	Check  string `json:"check"`
+	Score  int    `json:"score"`
+	Reason string `json:"reason"`
+}
+
+// SpamVerdict is kept for every chirp that scored anything, and for
+// rejected chirps, which have no ID and keep their body instead.
+type SpamVerdict struct {
+	ChirpID   int          `json:"chirp_id,omitempty"`
+	AuthorID  int          `json:"author_id"`
+	Body      string       `json:"body,omitempty"`
+	Score     int          `json:"score"`
+	Outcome   string       `json:"outcome"`
+	Signals   []SpamSignal `json:"signals"`
+	CreatedAt time.Time    `json:"created_at"`
+}
+
+type spamCheck struct {
+	name  string
+	score func(dbs DBStructure, chirp Chirp, now time.Time) (int, string)
+}
+
+var spamChecks = []spamCheck{
+	{"duplicate", duplicateScore},
+	{"links", linkScore},
+	{"new_account", newAccountScore},
+	{"burst", burstScore},
+}
+
+// errChirpSpam is what the author of a rejected chirp is told; the
+// reasons are only for moderators.
+var errChirpSpam = errors.New("chirp looks like spam")
+
+type spamError struct {
+	verdict SpamVerdict
+}
+
+func (e *spamError) Error() string { return errChirpSpam.Error() }
+func (e *spamError) Unwrap() error { return errChirpSpam }
+
+// scoreChirp runs every check against a chirp about to be created.
+func scoreChirp(dbs DBStructure, chirp Chirp, now time.Time) SpamVerdict {
+	verdict := SpamVerdict{
+		AuthorID:  chirp.AuthorID,
+		Outcome:   SpamAllow,
+		Signals:   make([]SpamSignal, 0),
+		CreatedAt: now,
+	}
+	for _, check := range spamChecks {
+		score, reason := check.score(dbs, chirp, now)
+		if score > 0 {
+			verdict.Score += score
+			verdict.Signals = append(verdict.Signals, SpamSignal{Check: check.name, Score: score, Reason: reason})
+		}
+	}
+	if verdict.Score >= envInt("SPAM_REJECT_SCORE", 90) {
+		verdict.Outcome = SpamReject
+		verdict.Body = chirp.Body
+	} else if verdict.Score >= envInt("SPAM_HOLD_SCORE", 50) {
+		verdict.Outcome = SpamHold
+	}
+	return verdict
+}
+
+// contentHash identifies a chirp body regardless of case, spacing and
+// punctuation, or returns "" for bodies too short to be worth comparing.
+func contentHash(body string) string {
+	terms := tokenize(body)
+	if len(terms) < minHashedTerms {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(strings.Join(terms, " ")))
+	return hex.EncodeToString(sum[:16])
+}
+
+func indexContentHash(structure DBStructure, chirp Chirp) {
+	if hash := contentHash(chirp.Body); hash != "" {
+		addEdge(structure.ContentHashes, hash, chirp.ID)
+	}
+}
+
+func unindexContentHash(structure DBStructure, chirp Chirp) {
+	if hash := contentHash(chirp.Body); hash != "" {
+		removeEdge(structure.ContentHashes, hash, chirp.ID)
+	}
+}
+
+// duplicateScore catches an author repeating themselves, and the same
+// text being posted by several accounts, within SPAM_DUPLICATE_WINDOW.
+func duplicateScore(dbs DBStructure, chirp Chirp, now time.Time) (int, string) {
+	hash := contentHash(chirp.Body)
+	if hash == "" {
+		return 0, ""
+	}
+	since := now.Add(-envDuration("SPAM_DUPLICATE_WINDOW", 24*time.Hour))
+	own := 0
+	others := make([]int, 0)
+	for _, id := range dbs.ContentHashes[hash] {
+		other, ok := dbs.Chirps[id]
+		if !ok || other.CreatedAt.Before(since) {
+			continue
+		}
+		if other.AuthorID == chirp.AuthorID {
+			own++
+		} else if !slices.Contains(others, other.AuthorID) {
+			others = append(others, other.AuthorID)
+		}
+	}
+	score := 0
+	reasons := make([]string, 0, 2)
+	if own > 0 {
+		score += min(own*40, 80)
+		reasons = append(reasons, fmt.Sprintf("author posted the same text %d times already", own))
+	}
+	if len(others) >= 2 {
+		score += 40
+		reasons = append(reasons, fmt.Sprintf("%d other accounts posted the same text", len(others)))
+	}
+	return score, strings.Join(reasons, ", ")
+}
+
+// linkScore catches chirps that are mostly links.
+func linkScore(dbs DBStructure, chirp Chirp, now time.Time) (int, string) {
+	links := urlPattern.FindAllString(chirp.Body, -1)
+	if len(links) == 0 {
+		return 0, ""
+	}
+	text := strings.TrimSpace(urlPattern.ReplaceAllString(chirp.Body, ""))
+	switch {
+	case len(links) >= 3:
+		return 35, fmt.Sprintf("%d links", len(links))
+	case len(tokenize(text)) < minHashedTerms:
+		return 20, "little text besides links"
+	}
+	return 0, ""
+}
+
+// newAccountScore is wary of accounts younger than SPAM_NEW_ACCOUNT_AGE,
+// more so when they post links or mention lots of people.
+func newAccountScore(dbs DBStructure, chirp Chirp, now time.Time) (int, string) {
+	author := dbs.Users[chirp.AuthorID]
+	if author.CreatedAt.IsZero() || now.Sub(author.CreatedAt) >= envDuration("SPAM_NEW_ACCOUNT_AGE", 24*time.Hour) {
+		return 0, ""
+	}
+	mentions := 0
+	for _, entity := range extractEntities(dbs, chirp.Body) {
+		if entity.Type == EntityMention {
+			mentions++
+		}
+	}
+	if urlPattern.MatchString(chirp.Body) || mentions >= 3 {
+		return 40, "new account posting links or mass mentions"
+	}
+	return 20, "new account"
+}
+
+// burstScore catches authors posting faster than SPAM_BURST_LIMIT chirps
+// per SPAM_BURST_WINDOW.
+func burstScore(dbs DBStructure, chirp Chirp, now time.Time) (int, string) {
+	since := now.Add(-envDuration("SPAM_BURST_WINDOW", time.Minute))
+	limit := envInt("SPAM_BURST_LIMIT", 5)
+	recent := 0
+	// IDs grow with time, so walk back from the newest chirp until one is
+	// older than the window
+	for id := maxChirpID(dbs); id > 0; id-- {
+		other, ok := dbs.Chirps[id]
+		if !ok {
+			continue
+		}
+		if other.CreatedAt.Before(since) {
+			break
+		}
+		if other.AuthorID == chirp.AuthorID {
+			recent++
+		}
+	}
+	if recent < limit {
+		return 0, ""
+	}
+	return min(30+10*(recent-limit), 60), fmt.Sprintf("%d chirps in the last %s", recent, envDuration("SPAM_BURST_WINDOW", time.Minute))
+}
+
+// scoreEdit runs the checks against the new body of an edited chirp, as if
+// it were being posted now, so spam can't be edited into a chirp that
+// passed when it was created. A rejected edit fails with a spamError; a
+// held one hides the chirp and queues it like a new chirp would be. The
+// chirp must already be out of the body indexes.
+func scoreEdit(structure *DBStructure, chirp Chirp, body string, now time.Time) (Chirp, error) {
+	// leave the chirp out so it doesn't count against itself
+	delete(structure.Chirps, chirp.ID)
+	verdict := scoreChirp(*structure, Chirp{AuthorID: chirp.AuthorID, Body: body}, now)
+	structure.Chirps[chirp.ID] = chirp
+	switch verdict.Outcome {
+	case SpamReject:
+		return chirp, &spamError{verdict}
+	case SpamHold:
+		chirp.Hidden = true
+	}
+	verdict.ChirpID = chirp.ID
+	if previous, ok := structure.SpamVerdicts[chirp.ID]; ok && previous.Outcome == SpamHold && verdict.Outcome != SpamHold {
+		// the chirp is still held from before; keep the verdict that says
+		// why, so dismissing its report releases it
+		return chirp, nil
+	}
+	recordSpamVerdict(structure, verdict)
+	return chirp, nil
+}
+
+// recordSpamVerdict stores the verdict on a new chirp and, when it is
+// held, puts it in the moderation queue. Held chirps are created hidden.
+func recordSpamVerdict(structure *DBStructure, verdict SpamVerdict) {
+	if verdict.Score == 0 {
+		return
+	}
+	structure.SpamVerdicts[verdict.ChirpID] = verdict
+	if verdict.Outcome != SpamHold {
+		return
+	}
+	reasons := make([]string, 0, len(verdict.Signals))
+	for _, signal := range verdict.Signals {
+		reasons = append(reasons, signal.Reason)
+	}
+	_, err := fileReport(structure, Report{
+		TargetType: ReportTargetChirp,
+		TargetID:   verdict.ChirpID,
+		Reason:     ReportReasonAutomated,
+		Details:    fmt.Sprintf("Held as likely spam (score %d): %s", verdict.Score, strings.Join(reasons, "; ")),
+	})
+	if err != nil && !errors.Is(err, errDuplicateReport) {
+		fmt.Printf("Couldn't queue chirp %v for review: %s\n", verdict.ChirpID, err)
+	}
+}
+
+// logSpamRejection keeps the last SPAM_REJECTION_LOG rejected chirps.
+func logSpamRejection(structure *DBStructure, verdict SpamVerdict) {
+	size := max(envInt("SPAM_REJECTION_LOG", 500), 1)
+	structure.SpamRejections = append(structure.SpamRejections, verdict)
+	if over := len(structure.SpamRejections) - size; over > 0 {
+		structure.SpamRejections = slices.Delete(structure.SpamRejections, 0, over)
+	}
+	fmt.Printf("Rejected chirp by user %v as spam, score %v\n", verdict.AuthorID, verdict.Score)
+}
+
+func (db *DB) recordSpamRejection(err error) {
+	var spam *spamError
+	if !errors.As(err, &spam) {
+		return
+	}
+	err = db.update(func(structure *DBStructure) error {
+		logSpamRejection(structure, spam.verdict)
+		return nil
+	})
+	if err != nil {
+		fmt.Printf("Couldn't log spam rejection: %s\n", err)
+	}
+}
+
+// GetSpamVerdicts returns stored verdicts with the given outcome (any
+// when empty), newest first.
+func (db *DB) GetSpamVerdicts(outcome string, limit int) ([]SpamVerdict, error) {
+	verdicts := make([]SpamVerdict, 0)
+	dbs, err := db.loadDB()
+	if err != nil {
+		return verdicts, err
+	}
+	for _, verdict := range dbs.SpamVerdicts {
+		if outcome == "" || verdict.Outcome == outcome {
+			verdicts = append(verdicts, verdict)
+		}
+	}
+	if outcome == "" || outcome == SpamReject {
+		verdicts = append(verdicts, dbs.SpamRejections...)
+	}
+	slices.SortFunc(verdicts, func(a, b SpamVerdict) int { return b.CreatedAt.Compare(a.CreatedAt) })
+	return verdicts[:min(len(verdicts), limit)], nil
+}
+
+func spamVerdictsHandler(w http.ResponseWriter, r *http.Request) {
+	validity, _ := requireAdmin(w, r)
+	if !validity {
+		return
+	}
+
+	outcome := r.URL.Query().Get("outcome")
+	if outcome != "" && outcome != SpamAllow && outcome != SpamHold && outcome != SpamReject {
+		respondWithError(w, 400, fmt.Sprintf("bad outcome provided, want allow, hold or reject: %s", outcome))
+		return
+	}
+	limit, err := parseLimit(r.URL.Query().Get("limit"))
+	if err != nil {
+		respondWithError(w, 400, err.Error())
+		return
+	}
+
+	chirpdb, err := NewDB("database.json")
+	if err != nil {
+		fmt.Println(err)
+	}
+
+	verdicts, err := chirpdb.GetSpamVerdicts(outcome, limit)
+	if err != nil {
+		respondWithError(w, 500, fmt.Sprintf("Couldn't load verdicts: %s", err))
+		return
+	}
+	respondWithJSON(w, http.StatusOK, verdicts)
+}
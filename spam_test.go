@@ -0,0 +1,139 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testStructure is an empty database with every map made, as readDB
+// returns it.
+func testStructure(t *testing.T) DBStructure {
+	t.Helper()
+	db := &DB{path: filepath.Join(t.TempDir(), "database.json"), mux: &sync.RWMutex{}}
+	structure, err := db.readDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return structure
+}
+
+// addTestChirp stores a chirp and indexes it the way createChirp does.
+func addTestChirp(structure DBStructure, authorID int, body string, at time.Time) Chirp {
+	chirp := Chirp{ID: maxChirpID(structure) + 1, AuthorID: authorID, Body: body, CreatedAt: at}
+	structure.Chirps[chirp.ID] = chirp
+	indexChirp(structure, chirp)
+	addEdge(structure.AuthorChirps, authorID, chirp.ID)
+	return chirp
+}
+
+func TestScoreChirp(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	old, fresh := 1, 2
+	spam := "buy cheap pills today"
+	tests := []struct {
+		name    string
+		setup   func(structure DBStructure)
+		author  int
+		body    string
+		score   int
+		outcome string
+	}{
+		{"clean", nil, old, "lovely weather we are having", 0, SpamAllow},
+		{"new account", nil, fresh, "lovely weather we are having", 20, SpamAllow},
+		{"new account with a bare link", nil, fresh, "https://example.com", 60, SpamHold},
+		{"three links", nil, old, "a http://a.co b http://b.co c http://c.co and more words", 35, SpamAllow},
+		{"repeated once", func(s DBStructure) {
+			addTestChirp(s, old, spam, now.Add(-time.Hour))
+		}, old, spam, 40, SpamAllow},
+		{"repeated twice", func(s DBStructure) {
+			addTestChirp(s, old, spam, now.Add(-time.Hour))
+			addTestChirp(s, old, "Buy cheap pills, today!", now.Add(-2*time.Hour))
+		}, old, spam, 80, SpamHold},
+		{"repeats are capped", func(s DBStructure) {
+			for i := 0; i < 4; i++ {
+				addTestChirp(s, old, spam, now.Add(-time.Hour))
+			}
+		}, old, spam, 80, SpamHold},
+		{"repeat outside the window", func(s DBStructure) {
+			addTestChirp(s, old, spam, now.Add(-48*time.Hour))
+		}, old, spam, 0, SpamAllow},
+		{"copied by other accounts", func(s DBStructure) {
+			addTestChirp(s, 10, spam, now.Add(-time.Hour))
+			addTestChirp(s, 11, spam, now.Add(-time.Hour))
+		}, old, spam, 40, SpamAllow},
+		{"short text isn't compared", func(s DBStructure) {
+			addTestChirp(s, old, "good morning", now.Add(-time.Hour))
+		}, old, "good morning", 0, SpamAllow},
+		{"burst", func(s DBStructure) {
+			for i := 0; i < 5; i++ {
+				addTestChirp(s, old, fmt.Sprintf("chirp number %d here", i), now.Add(-time.Duration(50-i)*time.Second))
+			}
+		}, old, "one more chirp here", 30, SpamAllow},
+		{"longer burst", func(s DBStructure) {
+			for i := 0; i < 7; i++ {
+				addTestChirp(s, old, fmt.Sprintf("chirp number %d here", i), now.Add(-time.Duration(50-i)*time.Second))
+			}
+		}, old, "one more chirp here", 50, SpamHold},
+		{"rejected", func(s DBStructure) {
+			addTestChirp(s, fresh, spam, now.Add(-time.Hour))
+			addTestChirp(s, fresh, spam, now.Add(-time.Hour))
+		}, fresh, spam, 100, SpamReject},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			structure := testStructure(t)
+			structure.Users[old] = User{ID: old, CreatedAt: now.Add(-30 * 24 * time.Hour)}
+			structure.Users[fresh] = User{ID: fresh, CreatedAt: now.Add(-time.Hour)}
+			if tt.setup != nil {
+				tt.setup(structure)
+			}
+			verdict := scoreChirp(structure, Chirp{AuthorID: tt.author, Body: tt.body}, now)
+			if verdict.Score != tt.score || verdict.Outcome != tt.outcome {
+				t.Errorf("scoreChirp = %d %s (%+v), want %d %s",
+					verdict.Score, verdict.Outcome, verdict.Signals, tt.score, tt.outcome)
+			}
+		})
+	}
+}
+
+func TestScoreEdit(t *testing.T) {
+	now := time.Now().UTC()
+	structure := testStructure(t)
+	structure.Users[1] = User{ID: 1, CreatedAt: now.Add(-30 * 24 * time.Hour)}
+	structure.Users[2] = User{ID: 2, CreatedAt: now.Add(-time.Hour)}
+	spam := "buy cheap pills today"
+	addTestChirp(structure, 2, spam, now.Add(-time.Hour))
+	addTestChirp(structure, 2, spam, now.Add(-time.Hour))
+
+	// an edit that keeps the same text doesn't count as a repeat of itself
+	chirp := addTestChirp(structure, 1, "lovely weather we are having", now.Add(-time.Minute))
+	unindexChirp(structure, chirp)
+	edited, err := scoreEdit(&structure, chirp, "lovely weather we are having", now)
+	if err != nil || edited.Hidden {
+		t.Errorf("unchanged edit: hidden %t, error %v", edited.Hidden, err)
+	}
+
+	chirp = addTestChirp(structure, 2, "hello there everyone", now.Add(-time.Minute))
+	unindexChirp(structure, chirp)
+	_, err = scoreEdit(&structure, chirp, spam, now)
+	if !errors.Is(err, errChirpSpam) {
+		t.Errorf("spam edit: error %v, want errChirpSpam", err)
+	}
+
+	chirp = addTestChirp(structure, 2, "hello there everyone", now.Add(-time.Minute))
+	unindexChirp(structure, chirp)
+	edited, err = scoreEdit(&structure, chirp, "https://example.com", now)
+	if err != nil || !edited.Hidden {
+		t.Fatalf("link edit: hidden %t, error %v, want it held", edited.Hidden, err)
+	}
+	if verdict := structure.SpamVerdicts[chirp.ID]; verdict.Outcome != SpamHold {
+		t.Errorf("held edit recorded verdict %+v", verdict)
+	}
+	if len(structure.Reports) != 1 {
+		t.Errorf("held edit filed %d reports, want 1", len(structure.Reports))
+	}
+}
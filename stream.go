@@ -0,0 +1,272 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// streamEvent is one message on GET /api/stream.
+type streamEvent struct {
+	ID       int64
+	Type     string
+	UserID   int // the only user who may see it, or 0 for anyone
+	AuthorID int // the chirp's author, for chirp events
+	Data     []byte
+}
+
+type streamClient struct {
+	userID    int
+	home      bool // only chirps by the user and the people they follow
+	following map[int]bool
+	relations relations
+	events    chan streamEvent
+}
+
+func (c *streamClient) wants(event streamEvent) bool {
+	if event.UserID != 0 {
+		return event.UserID == c.userID
+	}
+	if event.AuthorID != c.userID && c.relations.hides(event.AuthorID) {
+		return false
+	}
+	return !c.home || event.AuthorID == c.userID || c.following[event.AuthorID]
+}
+
+// streamHub fans events from the bus out to stream subscribers. It keeps
+// the last few events in a bounded log so a client that reconnects with
+// Last-Event-ID can catch up. A client that stops reading until its buffer
+// fills is disconnected rather than allowed to hold up everyone else; it
+// resumes from the log when it reconnects.
+type streamHub struct {
+	mu      sync.Mutex
+	nextID  int64
+	log     []streamEvent
+	logSize int
+	buffer  int
+	clients map[*streamClient]bool
+}
+
+var hub = newStreamHub()
+
+func newStreamHub() *streamHub {
+	return &streamHub{
+		// IDs start from the clock so they keep increasing across
+		// restarts, and an ID from before one is recognised as too old.
+		nextID:  time.Now().UnixMicro(),
+		logSize: max(envInt("STREAM_LOG_SIZE", 1000), 1),
+		buffer:  max(envInt("STREAM_BUFFER", 64), 1),
+		clients: make(map[*streamClient]bool),
+	}
+}
+
+// Observe feeds the hub from the event bus.
+func (h *streamHub) Observe(event Event) {
+	switch event.Type {
+	case EventChirpCreated:
+		chirp := event.Chirp
+		chirp.Body = cleanupBadWords(chirp.Body)
+		se := streamEvent{Type: event.Type, AuthorID: chirp.AuthorID}
+		if event.Shadow {
+			se.UserID = chirp.AuthorID
+		}
+		h.publish(se, chirp)
+	case EventChirpDeleted:
+		type deleted struct {
+			ID       int `json:"id"`
+			AuthorID int `json:"author_id"`
+		}
+		h.publish(streamEvent{Type: event.Type, AuthorID: event.Chirp.AuthorID}, deleted{event.Chirp.ID, event.Chirp.AuthorID})
+	case EventNotification:
+		h.publish(streamEvent{Type: event.Type, UserID: event.UserID}, event.Notification)
+	case EventUserFollowed, EventUserUnfollowed:
+		h.mu.Lock()
+		for c := range h.clients {
+			if c.userID == event.ActorID {
+				c.following[event.UserID] = event.Type == EventUserFollowed
+			}
+		}
+		h.mu.Unlock()
+	case EventUserBlocked, EventUserUnblocked, EventUserMuted, EventUserUnmuted:
+		h.mu.Lock()
+		for c := range h.clients {
+			c.relations.observe(c.userID, event)
+		}
+		h.mu.Unlock()
+	}
+}
+
+func (h *streamHub) publish(event streamEvent, payload interface{}) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		fmt.Printf("Couldn't encode stream event: %s\n", err)
+		return
+	}
+	event.Data = data
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	event.ID = h.nextID
+	h.nextID++
+	if len(h.log) == h.logSize {
+		copy(h.log, h.log[1:])
+		h.log = h.log[:len(h.log)-1]
+	}
+	h.log = append(h.log, event)
+	for c := range h.clients {
+		if !c.wants(event) {
+			continue
+		}
+		select {
+		case c.events <- event:
+		default:
+			fmt.Printf("Dropping slow stream client for user %v\n", c.userID)
+			delete(h.clients, c)
+			close(c.events)
+		}
+	}
+}
+
+// subscribe registers a client and returns the logged events after
+// lastID that it missed. When lastID is set but older than the log
+// reaches, reset is true and the client should reload instead.
+func (h *streamHub) subscribe(c *streamClient, lastID int64) (replay []streamEvent, reset bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	c.events = make(chan streamEvent, h.buffer)
+	h.clients[c] = true
+	if lastID == 0 {
+		return nil, false
+	}
+	oldest := h.nextID
+	if len(h.log) > 0 {
+		oldest = h.log[0].ID
+	}
+	if lastID+1 < oldest || lastID >= h.nextID {
+		return nil, true
+	}
+	for _, event := range h.log {
+		if event.ID > lastID && c.wants(event) {
+			replay = append(replay, event)
+		}
+	}
+	return replay, false
+}
+
+func (h *streamHub) unsubscribe(c *streamClient) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.clients[c] {
+		delete(h.clients, c)
+		close(c.events)
+	}
+}
+
+func writeStreamEvent(w http.ResponseWriter, event streamEvent) error {
+	_, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, event.Data)
+	return err
+}
+
+// streamHandler serves GET /api/stream as Server-Sent Events. By default
+// it carries chirps from the user and the people they follow; filter=all
+// carries every chirp. The user's own notifications are always included.
+// EventSource can't set headers, so the token may come as ?access_token=.
+func streamHandler(w http.ResponseWriter, r *http.Request) {
+	validity, userID := IsJWTValid(w, r)
+	if !validity {
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		respondWithError(w, 500, "Streaming is not supported")
+		return
+	}
+
+	topicFilter := r.URL.Query().Get("filter")
+	if topicFilter != "" && topicFilter != "home" && topicFilter != "all" {
+		respondWithError(w, 400, fmt.Sprintf("Unknown filter %s", topicFilter))
+		return
+	}
+
+	// browsers resend Last-Event-ID themselves; other clients may use the
+	// query parameter
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = r.URL.Query().Get("last_event_id")
+	}
+	var lastID int64
+	if lastEventID != "" {
+		var err error
+		lastID, err = strconv.ParseInt(lastEventID, 10, 64)
+		if err != nil {
+			respondWithError(w, 400, fmt.Sprintf("Bad Last-Event-ID %s", lastEventID))
+			return
+		}
+	}
+
+	chirpdb, err := NewDB("database.json")
+	if err != nil {
+		fmt.Println(err)
+	}
+	following, err := chirpdb.GetFollowing(userID)
+	if err != nil {
+		respondWithError(w, 404, fmt.Sprintf("User does not exist: %s", err))
+		return
+	}
+	rel, err := chirpdb.GetRelations(userID)
+	if err != nil {
+		respondWithError(w, 500, fmt.Sprintf("Couldn't load blocks: %s", err))
+		return
+	}
+
+	client := &streamClient{
+		userID:    userID,
+		home:      topicFilter != "all",
+		following: make(map[int]bool),
+		relations: rel,
+	}
+	for _, user := range following {
+		client.following[user.ID] = true
+	}
+	replay, reset := hub.subscribe(client, lastID)
+	defer hub.unsubscribe(client)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	if reset {
+		fmt.Fprint(w, "event: reset\ndata: {}\n\n")
+	}
+	for _, event := range replay {
+		writeStreamEvent(w, event)
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(envDuration("STREAM_HEARTBEAT", 15*time.Second))
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			_, err = fmt.Fprint(w, ": heartbeat\n\n")
+		case event, ok := <-client.events:
+			if !ok {
+				// dropped for falling behind; the client reconnects
+				// and catches up from the log
+				return
+			}
+			err = writeStreamEvent(w, event)
+		}
+		if err != nil {
+			return
+		}
+		flusher.Flush()
+	}
+}
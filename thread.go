@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+const (
+	defaultThreadDepth = 10
+	maxThreadDepth     = 50
+)
+
+// ThreadNode is a chirp together with the replies below it, as far down as
+// the requested depth allows. Deleted chirps, and chirps the viewer can't
+// see, appear as tombstones.
+type ThreadNode struct {
+	Chirp
+	Replies []ThreadNode `json:"replies,omitempty"`
+}
+
+type Thread struct {
+	Ancestors []Chirp    `json:"ancestors"`
+	Chirp     ThreadNode `json:"chirp"`
+}
+
+// GetThread returns the conversation around a chirp as viewerID sees it: up
+// to depth ancestors, closest to the root first, and up to depth levels of
+// replies below it.
+func (db *DB) GetThread(id, depth, viewerID int) (Thread, error) {
+	dbs, err := db.loadDB()
+	if err != nil {
+		return Thread{}, err
+	}
+	chirp, ok := dbs.Chirps[id]
+	if !ok || !canView(dbs, chirp, viewerID) {
+		return Thread{}, errNotFound
+	}
+
+	ancestors := make([]Chirp, 0)
+	for parentID := chirp.InReplyTo; parentID != 0 && len(ancestors) < depth; {
+		parent, ok := dbs.Chirps[parentID]
+		if !ok {
+			break
+		}
+		ancestors = append(ancestors, threadChirp(dbs, parent, viewerID))
+		parentID = parent.InReplyTo
+	}
+	for i, j := 0, len(ancestors)-1; i < j; i, j = i+1, j-1 {
+		ancestors[i], ancestors[j] = ancestors[j], ancestors[i]
+	}
+
+	return Thread{
+		Ancestors: ancestors,
+		Chirp:     buildThreadNode(dbs, chirp, depth, viewerID),
+	}, nil
+}
+
+func buildThreadNode(dbs DBStructure, chirp Chirp, depth, viewerID int) ThreadNode {
+	node := ThreadNode{Chirp: threadChirp(dbs, chirp, viewerID)}
+	if depth == 0 {
+		return node
+	}
+	for _, replyID := range dbs.Replies[chirp.ID] {
+		if reply, ok := dbs.Chirps[replyID]; ok {
+			node.Replies = append(node.Replies, buildThreadNode(dbs, reply, depth-1, viewerID))
+		}
+	}
+	return node
+}
+
+// threadChirp keeps a chirp the viewer can't see in its place in the
+// thread, without its content.
+func threadChirp(dbs DBStructure, chirp Chirp, viewerID int) Chirp {
+	if !canView(dbs, chirp, viewerID) {
+		return unavailableChirp(chirp)
+	}
+	return viewChirp(dbs, chirp, viewerID)
+}
+
+func cleanupThreadNode(node *ThreadNode) {
+	node.Body = cleanupBadWords(node.Body)
+	for i := range node.Replies {
+		cleanupThreadNode(&node.Replies[i])
+	}
+}
+
+func chirpThreadHandler(w http.ResponseWriter, r *http.Request) {
+	pathVal := r.PathValue("id")
+	chirpID, err := strconv.Atoi(pathVal)
+	if err != nil {
+		respondWithError(w, 400, fmt.Sprintf("Cannot convert %s to integer", pathVal))
+		return
+	}
+
+	depth := defaultThreadDepth
+	if val := r.URL.Query().Get("depth"); val != "" {
+		depth, err = strconv.Atoi(val)
+		if err != nil || depth < 0 {
+			respondWithError(w, 400, fmt.Sprintf("bad depth provided: %s", val))
+			return
+		}
+		depth = min(depth, maxThreadDepth)
+	}
+
+	chirpdb, err := NewDB("database.json")
+	if err != nil {
+		fmt.Println(err)
+	}
+
+	thread, err := chirpdb.GetThread(chirpID, depth, optionalUserID(r))
+	if err != nil {
+		respondWithError(w, 404, fmt.Sprintf("Chirp does not exist: %s", err))
+		return
+	}
+	for i := range thread.Ancestors {
+		thread.Ancestors[i].Body = cleanupBadWords(thread.Ancestors[i].Body)
+	}
+	cleanupThreadNode(&thread.Chirp)
+	respondWithJSON(w, http.StatusOK, thread)
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Hashtag usage is counted in five minute buckets, enough resolution for
+// the shortest window without keeping a bucket per chirp.
+const trendBucket = 5 * time.Minute
+
+var trendWindows = map[string]time.Duration{
+	"1h":  time.Hour,
+	"24h": 24 * time.Hour,
+	"7d":  7 * 24 * time.Hour,
+}
+
+const longestTrendWindow = 7 * 24 * time.Hour
+
+type Trend struct {
+	Tag      string  `json:"tag"`
+	Count1h  int     `json:"count_1h"`
+	Count24h int     `json:"count_24h"`
+	Count7d  int     `json:"count_7d"`
+	Velocity float64 `json:"velocity"`
+	Spiking  bool    `json:"spiking"`
+}
+
+func (t Trend) count(window string) int {
+	switch window {
+	case "1h":
+		return t.Count1h
+	case "7d":
+		return t.Count7d
+	}
+	return t.Count24h
+}
+
+// trendAggregator keeps sliding-window hashtag counts in memory. Chirp
+// creation feeds it through the event bus, and a background loop prunes old buckets and
+// recomputes the ranking that GET /api/trends serves.
+type trendAggregator struct {
+	mu       sync.Mutex
+	buckets  map[string]map[int64]int
+	spelling map[string]string
+	snapshot []Trend
+	updated  time.Time
+}
+
+var trends = &trendAggregator{
+	buckets:  make(map[string]map[int64]int),
+	spelling: make(map[string]string),
+}
+
+// Observe feeds the aggregator from the event bus.
+func (t *trendAggregator) Observe(event Event) {
+	if event.Type == EventChirpCreated && !event.Shadow {
+		t.Record(event.Chirp)
+	}
+}
+
+// Record counts the hashtags of a chirp.
+func (t *trendAggregator) Record(chirp Chirp) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	bucket := chirp.CreatedAt.Truncate(trendBucket).Unix()
+	for _, entity := range chirp.Entities {
+		if entity.Type != EntityHashtag {
+			continue
+		}
+		tag := normalizeTag(entity.Text)
+		if t.buckets[tag] == nil {
+			t.buckets[tag] = make(map[int64]int)
+		}
+		t.buckets[tag][bucket]++
+		t.spelling[tag] = entity.Text
+	}
+}
+
+// Seed loads the last week of hashtag use from the database, so trends
+// survive a restart. Like Observe it only counts chirps everyone can see.
+func (t *trendAggregator) Seed(db *DB) error {
+	dbs, err := db.loadDB()
+	if err != nil {
+		return err
+	}
+	cutoff := time.Now().Add(-longestTrendWindow)
+	for _, chirp := range dbs.Chirps {
+		if !chirp.Deleted && chirp.CreatedAt.After(cutoff) && canView(dbs, chirp, 0) {
+			t.Record(chirp)
+		}
+	}
+	t.recompute(time.Now())
+	return nil
+}
+
+// Run recomputes trends every interval until the process exits.
+func (t *trendAggregator) Run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		t.recompute(now)
+	}
+}
+
+// recompute drops buckets older than the longest window and ranks every
+// remaining tag. Velocity compares the last hour against the hourly
+// average of the rest of the week; a tag is spiking when that ratio passes
+// TRENDS_SPIKE_FACTOR with at least TRENDS_MIN_COUNT uses in the hour.
+func (t *trendAggregator) recompute(now time.Time) {
+	spikeFactor := float64(envInt("TRENDS_SPIKE_FACTOR", 3))
+	minCount := envInt("TRENDS_MIN_COUNT", 3)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	oldest := now.Add(-longestTrendWindow).Truncate(trendBucket).Unix()
+	snapshot := make([]Trend, 0, len(t.buckets))
+	for tag, buckets := range t.buckets {
+		trend := Trend{Tag: t.spelling[tag]}
+		for bucket, n := range buckets {
+			if bucket < oldest {
+				delete(buckets, bucket)
+				continue
+			}
+			age := now.Sub(time.Unix(bucket, 0))
+			if age < time.Hour {
+				trend.Count1h += n
+			}
+			if age < 24*time.Hour {
+				trend.Count24h += n
+			}
+			trend.Count7d += n
+		}
+		if len(buckets) == 0 {
+			delete(t.buckets, tag)
+			delete(t.spelling, tag)
+			continue
+		}
+		baseline := float64(trend.Count7d-trend.Count1h) / (longestTrendWindow.Hours() - 1)
+		trend.Velocity = float64(trend.Count1h) / max(baseline, 1)
+		trend.Spiking = trend.Velocity >= spikeFactor && trend.Count1h >= minCount
+		snapshot = append(snapshot, trend)
+	}
+	t.snapshot = snapshot
+	t.updated = now
+}
+
+// Top returns the limit most used tags in window, spiking tags first.
+func (t *trendAggregator) Top(window string, limit int) ([]Trend, time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	top := make([]Trend, 0, len(t.snapshot))
+	for _, trend := range t.snapshot {
+		if trend.count(window) > 0 {
+			top = append(top, trend)
+		}
+	}
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].Spiking != top[j].Spiking {
+			return top[i].Spiking
+		}
+		if top[i].count(window) != top[j].count(window) {
+			return top[i].count(window) > top[j].count(window)
+		}
+		if top[i].Velocity != top[j].Velocity {
+			return top[i].Velocity > top[j].Velocity
+		}
+		return top[i].Tag < top[j].Tag
+	})
+	return top[:min(len(top), limit)], t.updated
+}
+
+func trendsHandler(w http.ResponseWriter, r *http.Request) {
+	type returnVals struct {
+		Window    string    `json:"window"`
+		UpdatedAt time.Time `json:"updated_at"`
+		Trends    []Trend   `json:"trends"`
+	}
+
+	window := r.URL.Query().Get("window")
+	if window == "" {
+		window = "24h"
+	}
+	if _, ok := trendWindows[window]; !ok {
+		respondWithError(w, 400, fmt.Sprintf("bad window provided, want 1h, 24h or 7d: %s", window))
+		return
+	}
+	limit, err := parseLimit(r.URL.Query().Get("limit"))
+	if err != nil {
+		respondWithError(w, 400, err.Error())
+		return
+	}
+
+	top, updated := trends.Top(window, limit)
+	respondWithJSON(w, http.StatusOK, returnVals{
+		Window:    window,
+		UpdatedAt: updated,
+		Trends:    top,
+	})
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTrendsSeed(t *testing.T) {
+	db, err := NewDB(filepath.Join(t.TempDir(), "database.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().UTC()
+	tag := func(text string) []Entity {
+		return []Entity{{Type: EntityHashtag, Text: text}}
+	}
+	err = db.update(func(structure *DBStructure) error {
+		structure.Users[1] = User{ID: 1}
+		structure.Users[2] = User{ID: 2, Status: UserShadowbanned}
+		chirps := []Chirp{
+			{ID: 1, AuthorID: 1, Entities: tag("visible"), CreatedAt: now},
+			{ID: 2, AuthorID: 1, Entities: tag("held"), CreatedAt: now, Hidden: true},
+			{ID: 3, AuthorID: 2, Entities: tag("shadow"), CreatedAt: now},
+			{ID: 4, AuthorID: 1, Entities: tag("gone"), CreatedAt: now, Deleted: true},
+			{ID: 5, AuthorID: 1, Entities: tag("old"), CreatedAt: now.Add(-8 * 24 * time.Hour)},
+		}
+		for _, chirp := range chirps {
+			structure.Chirps[chirp.ID] = chirp
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	agg := &trendAggregator{buckets: make(map[string]map[int64]int), spelling: make(map[string]string)}
+	err = agg.Seed(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	top, _ := agg.Top("7d", 10)
+	if len(top) != 1 || top[0].Tag != "visible" || top[0].Count7d != 1 {
+		t.Errorf("Seed counted %+v, want only #visible once", top)
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// A minimal RFC 6455 server: enough for JSON text messages, control
+// frames and a clean close, without pulling in a dependency.
+
+const (
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xA
+
+	wsCloseNormal        = 1000
+	wsCloseProtocolError = 1002
+	wsCloseUnsupported   = 1003
+	wsCloseInvalidData   = 1007
+	wsClosePolicy        = 1008
+	wsCloseTooBig        = 1009
+	wsCloseTryAgainLater = 1013
+
+	wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+)
+
+var errWSClosed = errors.New("websocket closed")
+
+type wsConn struct {
+	conn    net.Conn
+	rw      *bufio.ReadWriter
+	writeMu sync.Mutex
+	maxSize int
+	// onPong is called for every pong received.
+	onPong func()
+}
+
+// wsUpgrade completes the opening handshake and takes over the
+// connection. On failure it has already responded with an error.
+func wsUpgrade(w http.ResponseWriter, r *http.Request, maxSize int) (*wsConn, error) {
+	if !headerContains(r.Header, "Connection", "upgrade") || !headerContains(r.Header, "Upgrade", "websocket") {
+		respondWithError(w, 400, "Expected a WebSocket upgrade")
+		return nil, errors.New("not a websocket upgrade")
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		respondWithError(w, 426, "Unsupported WebSocket version")
+		return nil, errors.New("unsupported websocket version")
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if decoded, err := base64.StdEncoding.DecodeString(key); err != nil || len(decoded) != 16 {
+		respondWithError(w, 400, "Bad Sec-WebSocket-Key")
+		return nil, errors.New("bad websocket key")
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		respondWithError(w, 500, "WebSockets are not supported")
+		return nil, errors.New("connection can't be hijacked")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha1.Sum([]byte(key + wsGUID))
+	fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\n"+
+		"Upgrade: websocket\r\n"+
+		"Connection: Upgrade\r\n"+
+		"Sec-WebSocket-Accept: %s\r\n\r\n", base64.StdEncoding.EncodeToString(sum[:]))
+	err = rw.Flush()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &wsConn{conn: conn, rw: rw, maxSize: maxSize, onPong: func() {}}, nil
+}
+
+func headerContains(h http.Header, name, token string) bool {
+	for _, value := range h.Values(name) {
+		for _, part := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ReadMessage returns the next text message, answering pings and
+// reassembling fragments on the way. It returns errWSClosed once the
+// client has closed the connection.
+func (c *wsConn) ReadMessage() ([]byte, error) {
+	var message []byte
+	started := false
+	for {
+		fin, opcode, payload, err := c.readFrame()
+		if err != nil {
+			return nil, err
+		}
+		switch opcode {
+		case wsOpPing:
+			err = c.writeFrame(wsOpPong, payload)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		case wsOpPong:
+			c.onPong()
+			continue
+		case wsOpClose:
+			c.Close(wsCloseNormal, "")
+			return nil, errWSClosed
+		case wsOpText:
+			if started {
+				c.Close(wsCloseProtocolError, "expected a continuation frame")
+				return nil, errWSClosed
+			}
+			started = true
+		case wsOpContinuation:
+			if !started {
+				c.Close(wsCloseProtocolError, "unexpected continuation frame")
+				return nil, errWSClosed
+			}
+		case wsOpBinary:
+			c.Close(wsCloseUnsupported, "only text messages are supported")
+			return nil, errWSClosed
+		default:
+			c.Close(wsCloseProtocolError, "unknown opcode")
+			return nil, errWSClosed
+		}
+		if len(message)+len(payload) > c.maxSize {
+			c.Close(wsCloseTooBig, "message too big")
+			return nil, errWSClosed
+		}
+		message = append(message, payload...)
+		if fin {
+			if !utf8.Valid(message) {
+				c.Close(wsCloseInvalidData, "messages must be UTF-8")
+				return nil, errWSClosed
+			}
+			return message, nil
+		}
+	}
+}
+
+func (c *wsConn) readFrame() (fin bool, opcode byte, payload []byte, err error) {
+	var header [2]byte
+	_, err = io.ReadFull(c.rw, header[:])
+	if err != nil {
+		return false, 0, nil, err
+	}
+	fin = header[0]&0x80 != 0
+	opcode = header[0] & 0x0F
+	if header[0]&0x70 != 0 || header[1]&0x80 == 0 {
+		// no extensions were negotiated, and clients must mask
+		c.Close(wsCloseProtocolError, "bad frame header")
+		return false, 0, nil, errWSClosed
+	}
+
+	length := uint64(header[1] & 0x7F)
+	switch length {
+	case 126:
+		var ext [2]byte
+		_, err = io.ReadFull(c.rw, ext[:])
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		_, err = io.ReadFull(c.rw, ext[:])
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if err != nil {
+		return false, 0, nil, err
+	}
+	if opcode >= wsOpClose && (length > 125 || !fin) {
+		c.Close(wsCloseProtocolError, "bad control frame")
+		return false, 0, nil, errWSClosed
+	}
+	if length > uint64(c.maxSize) {
+		c.Close(wsCloseTooBig, "message too big")
+		return false, 0, nil, errWSClosed
+	}
+
+	var mask [4]byte
+	_, err = io.ReadFull(c.rw, mask[:])
+	if err != nil {
+		return false, 0, nil, err
+	}
+	payload = make([]byte, length)
+	_, err = io.ReadFull(c.rw, payload)
+	if err != nil {
+		return false, 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return fin, opcode, payload, nil
+}
+
+// WriteText sends a text message. It is safe to call from several
+// goroutines.
+func (c *wsConn) WriteText(message []byte) error {
+	return c.writeFrame(wsOpText, message)
+}
+
+func (c *wsConn) Ping() error {
+	return c.writeFrame(wsOpPing, nil)
+}
+
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	header := []byte{0x80 | opcode}
+	switch {
+	case len(payload) < 126:
+		header = append(header, byte(len(payload)))
+	case len(payload) <= 0xFFFF:
+		header = append(header, 126)
+		header = binary.BigEndian.AppendUint16(header, uint16(len(payload)))
+	default:
+		header = append(header, 127)
+		header = binary.BigEndian.AppendUint64(header, uint64(len(payload)))
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	_, err := c.rw.Write(header)
+	if err == nil {
+		_, err = c.rw.Write(payload)
+	}
+	if err == nil {
+		err = c.rw.Flush()
+	}
+	return err
+}
+
+// Close sends a close frame with code and reason and closes the
+// connection. Calling it more than once is harmless.
+func (c *wsConn) Close(code int, reason string) error {
+	payload := binary.BigEndian.AppendUint16(nil, uint16(code))
+	payload = append(payload, reason...)
+	c.writeFrame(wsOpClose, payload)
+	return c.conn.Close()
+}
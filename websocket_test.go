@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+type wsFrame struct {
+	fin     bool
+	opcode  byte
+	payload []byte
+}
+
+// clientFrame encodes a frame the way a client sends it, masked unless
+// told otherwise.
+func clientFrame(fin bool, opcode byte, payload []byte, masked bool) []byte {
+	b := []byte{opcode}
+	if fin {
+		b[0] |= 0x80
+	}
+	maskBit := byte(0)
+	if masked {
+		maskBit = 0x80
+	}
+	switch {
+	case len(payload) < 126:
+		b = append(b, maskBit|byte(len(payload)))
+	case len(payload) <= 0xFFFF:
+		b = append(b, maskBit|126)
+		b = binary.BigEndian.AppendUint16(b, uint16(len(payload)))
+	default:
+		b = append(b, maskBit|127)
+		b = binary.BigEndian.AppendUint64(b, uint64(len(payload)))
+	}
+	if !masked {
+		return append(b, payload...)
+	}
+	mask := []byte{0x12, 0x34, 0x56, 0x78}
+	b = append(b, mask...)
+	for i, c := range payload {
+		b = append(b, c^mask[i%4])
+	}
+	return b
+}
+
+// readServerFrames decodes the unmasked frames a server wrote until the
+// connection closes.
+func readServerFrames(r io.Reader) []wsFrame {
+	var frames []wsFrame
+	br := bufio.NewReader(r)
+	for {
+		var header [2]byte
+		if _, err := io.ReadFull(br, header[:]); err != nil {
+			return frames
+		}
+		length := uint64(header[1] & 0x7F)
+		switch length {
+		case 126:
+			var ext [2]byte
+			io.ReadFull(br, ext[:])
+			length = uint64(binary.BigEndian.Uint16(ext[:]))
+		case 127:
+			var ext [8]byte
+			io.ReadFull(br, ext[:])
+			length = binary.BigEndian.Uint64(ext[:])
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(br, payload); err != nil {
+			return frames
+		}
+		frames = append(frames, wsFrame{header[0]&0x80 != 0, header[0] & 0x0F, payload})
+	}
+}
+
+// exchange feeds input to a server-side wsConn, reads one message from it
+// and returns the message, the error and every frame the server sent back.
+func exchange(t *testing.T, maxSize int, input []byte) ([]byte, error, []wsFrame) {
+	t.Helper()
+	server, client := net.Pipe()
+	c := &wsConn{
+		conn:    server,
+		rw:      bufio.NewReadWriter(bufio.NewReader(server), bufio.NewWriter(server)),
+		maxSize: maxSize,
+		onPong:  func() {},
+	}
+	go client.Write(input)
+	done := make(chan []wsFrame)
+	go func() { done <- readServerFrames(client) }()
+	message, err := c.ReadMessage()
+	server.Close()
+	frames := <-done
+	client.Close()
+	return message, err, frames
+}
+
+func closeCode(frames []wsFrame) int {
+	for _, f := range frames {
+		if f.opcode == wsOpClose && len(f.payload) >= 2 {
+			return int(binary.BigEndian.Uint16(f.payload))
+		}
+	}
+	return 0
+}
+
+func concat(frames ...[]byte) []byte {
+	return bytes.Join(frames, nil)
+}
+
+func TestWSReadMessage(t *testing.T) {
+	big := bytes.Repeat([]byte("x"), 300)
+	tests := []struct {
+		name  string
+		input []byte
+		want  string
+		code  int // close code sent by the server, 0 for none
+	}{
+		{"text", clientFrame(true, wsOpText, []byte("hello"), true), "hello", 0},
+		{"16-bit length", clientFrame(true, wsOpText, big, true), string(big), 0},
+		{"fragmented", concat(
+			clientFrame(false, wsOpText, []byte("hel"), true),
+			clientFrame(false, wsOpContinuation, []byte("l"), true),
+			clientFrame(true, wsOpContinuation, []byte("o"), true),
+		), "hello", 0},
+		{"ping between fragments", concat(
+			clientFrame(false, wsOpText, []byte("hel"), true),
+			clientFrame(true, wsOpPing, []byte("p"), true),
+			clientFrame(true, wsOpContinuation, []byte("lo"), true),
+		), "hello", 0},
+		{"unmasked", clientFrame(true, wsOpText, []byte("hello"), false), "", wsCloseProtocolError},
+		{"reserved bits", append([]byte{0xC1}, clientFrame(true, wsOpText, []byte("hi"), true)[1:]...), "", wsCloseProtocolError},
+		{"binary", clientFrame(true, wsOpBinary, []byte{1, 2}, true), "", wsCloseUnsupported},
+		{"unknown opcode", clientFrame(true, 0x3, nil, true), "", wsCloseProtocolError},
+		{"continuation first", clientFrame(true, wsOpContinuation, []byte("x"), true), "", wsCloseProtocolError},
+		{"text inside message", concat(
+			clientFrame(false, wsOpText, []byte("a"), true),
+			clientFrame(true, wsOpText, []byte("b"), true),
+		), "", wsCloseProtocolError},
+		{"fragmented ping", clientFrame(false, wsOpPing, nil, true), "", wsCloseProtocolError},
+		{"long ping", clientFrame(true, wsOpPing, big[:126], true), "", wsCloseProtocolError},
+		{"invalid utf-8", clientFrame(true, wsOpText, []byte{0xff, 0xfe}, true), "", wsCloseInvalidData},
+		{"frame too big", clientFrame(true, wsOpText, bytes.Repeat([]byte("x"), 1025), true), "", wsCloseTooBig},
+		{"fragments too big", concat(
+			clientFrame(false, wsOpText, bytes.Repeat([]byte("x"), 600), true),
+			clientFrame(true, wsOpContinuation, bytes.Repeat([]byte("x"), 600), true),
+		), "", wsCloseTooBig},
+		{"client close", clientFrame(true, wsOpClose, binary.BigEndian.AppendUint16(nil, 1001), true), "", wsCloseNormal},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			message, err, frames := exchange(t, 1024, tt.input)
+			if tt.code == 0 {
+				if err != nil {
+					t.Fatalf("ReadMessage: %s", err)
+				}
+				if string(message) != tt.want {
+					t.Errorf("ReadMessage = %q, want %q", message, tt.want)
+				}
+				return
+			}
+			if !errors.Is(err, errWSClosed) {
+				t.Fatalf("ReadMessage error = %v, want errWSClosed", err)
+			}
+			if got := closeCode(frames); got != tt.code {
+				t.Errorf("close code = %d, want %d", got, tt.code)
+			}
+		})
+	}
+}
+
+func TestWSPong(t *testing.T) {
+	input := concat(
+		clientFrame(true, wsOpPing, []byte("are you there"), true),
+		clientFrame(true, wsOpText, []byte("hi"), true),
+	)
+	_, err, frames := exchange(t, 1024, input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(frames) == 0 || frames[0].opcode != wsOpPong || string(frames[0].payload) != "are you there" {
+		t.Errorf("server sent %+v, want a pong echoing the ping", frames)
+	}
+}
+
+func TestWSWriteFrame(t *testing.T) {
+	for _, size := range []int{0, 125, 126, 0xFFFF, 0x10000} {
+		server, client := net.Pipe()
+		c := &wsConn{conn: server, rw: bufio.NewReadWriter(bufio.NewReader(server), bufio.NewWriter(server))}
+		payload := bytes.Repeat([]byte("y"), size)
+		done := make(chan []wsFrame)
+		go func() { done <- readServerFrames(client) }()
+		err := c.WriteText(payload)
+		server.Close()
+		frames := <-done
+		client.Close()
+		if err != nil {
+			t.Fatalf("WriteText(%d bytes): %s", size, err)
+		}
+		if len(frames) != 1 || !frames[0].fin || frames[0].opcode != wsOpText || !bytes.Equal(frames[0].payload, payload) {
+			t.Errorf("WriteText(%d bytes) wrote %d frames", size, len(frames))
+		}
+	}
+}